@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Backends.
+const (
+	BackendNone   = "none"
+	BackendMemory = "memory"
+	BackendDisk   = "disk"
+)
+
+// Store keeps values until they expire.
+type Store interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, expiresAt time.Time) error
+}
+
+// Options configure a Cache.
+type Options struct {
+	TTL        time.Duration
+	MaxEntries int    // 0 keeps every entry until it expires
+	Dir        string // disk backend
+}
+
+// Cache stores responses under a canonical hash of the request.
+type Cache struct {
+	store Store
+	ttl   time.Duration
+}
+
+// New creates a cache for backend. It returns nil if caching is disabled.
+func New(backend string, opts Options) (*Cache, error) {
+	var store Store
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "", BackendNone:
+		return nil, nil
+	case BackendMemory:
+		store = NewMemoryStore(opts.MaxEntries)
+	case BackendDisk:
+		disk, err := NewDiskStore(opts.Dir, opts.MaxEntries)
+		if err != nil {
+			return nil, err
+		}
+		store = disk
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q (want %s, %s or %s)", backend, BackendNone, BackendMemory, BackendDisk)
+	}
+	return &Cache{store: store, ttl: opts.TTL}, nil
+}
+
+func (c *Cache) Get(key string) ([]byte, bool) {
+	return c.store.Get(key)
+}
+
+func (c *Cache) Set(key string, value []byte) error {
+	return c.store.Set(key, value, time.Now().Add(c.ttl))
+}
+
+// Key hashes v's JSON encoding. Callers normalize the request into v first
+// so that equivalent requests encode the same way; encoding/json already
+// sorts map keys.
+func Key(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
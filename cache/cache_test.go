@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyIsStable(t *testing.T) {
+	type request struct {
+		Model   string         `json:"model"`
+		Options map[string]any `json:"options"`
+	}
+	a, err := Key(request{"m", map[string]any{"top_p": 0.5, "seed": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := Key(request{"m", map[string]any{"seed": 1, "top_p": 0.5}})
+	if a != b {
+		t.Errorf("keys of equal requests differ: %s, %s", a, b)
+	}
+	// A key names a file of the disk backend, so it mustn't change between
+	// versions
+	if want := "682b4c09bd2479a10c20d78cef667c5b6a9b84c33f95797d882f2df69818f54d"; a != want {
+		t.Errorf("key = %s, want %s", a, want)
+	}
+	c, _ := Key(request{"m", map[string]any{"seed": 2, "top_p": 0.5}})
+	if a == c {
+		t.Error("keys of different requests are equal")
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, backend := range []string{"", "none", " None "} {
+		if c, err := New(backend, Options{}); c != nil || err != nil {
+			t.Errorf("New(%q) = %v, %v, want no cache", backend, c, err)
+		}
+	}
+	if _, err := New("redis", Options{}); err == nil {
+		t.Error("New accepted an unknown backend")
+	}
+
+	c, err := New("memory", Options{TTL: time.Hour, MaxEntries: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("key", []byte("value"))
+	if value, ok := c.Get("key"); !ok || string(value) != "value" {
+		t.Errorf("Get = %q, %v", value, ok)
+	}
+}
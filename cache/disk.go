@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often Set removes the expired entries of a
+// DiskStore.
+const sweepInterval = time.Minute
+
+// DiskStore keeps one JSON file per key in dir, so the cache survives
+// restarts. An index of the files in memory keeps at most maxEntries of
+// them, evicting the least recently used, and expired files are swept out
+// every sweepInterval.
+type DiskStore struct {
+	dir        string
+	maxEntries int
+
+	mu        sync.Mutex
+	order     *list.List // front is most recently used
+	entries   map[string]*list.Element
+	nextSweep time.Time
+}
+
+type diskEntry struct {
+	ExpiresAt time.Time       `json:"expires_at"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// diskIndexEntry is the index entry of a file.
+type diskIndexEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// NewDiskStore opens the cache in dir, creating it if needed. The files of
+// an earlier run are indexed by their last use, and expired or unreadable
+// ones are removed.
+func NewDiskStore(dir string, maxEntries int) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	d := &DiskStore{
+		dir:        dir,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		nextSweep:  time.Now().Add(sweepInterval),
+	}
+	if err := d.load(); err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	return d, nil
+}
+
+// load indexes the files in dir, most recently used first.
+func (d *DiskStore) load() error {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	type file struct {
+		entry   diskIndexEntry
+		modTime time.Time
+	}
+	var found []file
+	now := time.Now()
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			continue
+		}
+		// A temporary file left by a crash in the middle of Set
+		if strings.HasSuffix(name, ".tmp") {
+			_ = os.Remove(filepath.Join(d.dir, name))
+			continue
+		}
+		key, ok := strings.CutSuffix(name, ".json")
+		if !ok {
+			continue
+		}
+		entry, err := d.read(key)
+		info, statErr := f.Info()
+		if err != nil || statErr != nil || now.After(entry.ExpiresAt) {
+			_ = os.Remove(d.path(key))
+			continue
+		}
+		found = append(found, file{diskIndexEntry{key, entry.ExpiresAt}, info.ModTime()})
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.After(found[j].modTime) })
+	for _, f := range found {
+		entry := f.entry
+		d.entries[entry.key] = d.order.PushBack(&entry)
+	}
+	d.evict()
+	return nil
+}
+
+func (d *DiskStore) path(key string) string {
+	return filepath.Join(d.dir, key+".json")
+}
+
+func (d *DiskStore) read(key string) (diskEntry, error) {
+	var entry diskEntry
+	data, err := os.ReadFile(d.path(key))
+	if err == nil {
+		err = json.Unmarshal(data, &entry)
+	}
+	return entry, err
+}
+
+func (d *DiskStore) Get(key string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	el, ok := d.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry, err := d.read(key)
+	if err != nil || time.Now().After(entry.ExpiresAt) {
+		d.remove(el)
+		return nil, false
+	}
+	d.order.MoveToFront(el)
+	// The modification time orders the files by use after a restart
+	now := time.Now()
+	_ = os.Chtimes(d.path(key), now, now)
+	return entry.Value, true
+}
+
+// Set writes the entry to a temporary file first so readers never see a
+// partial file.
+func (d *DiskStore) Set(key string, value []byte, expiresAt time.Time) error {
+	data, err := json.Marshal(diskEntry{ExpiresAt: expiresAt, Value: value})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tmp, err := os.CreateTemp(d.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), d.path(key)); err != nil {
+		return err
+	}
+
+	if el, ok := d.entries[key]; ok {
+		el.Value.(*diskIndexEntry).expiresAt = expiresAt
+		d.order.MoveToFront(el)
+	} else {
+		d.entries[key] = d.order.PushFront(&diskIndexEntry{key: key, expiresAt: expiresAt})
+	}
+	if now := time.Now(); now.After(d.nextSweep) {
+		d.sweep(now)
+		d.nextSweep = now.Add(sweepInterval)
+	}
+	d.evict()
+	return nil
+}
+
+// sweep removes the entries expired at now.
+func (d *DiskStore) sweep(now time.Time) {
+	for el := d.order.Front(); el != nil; {
+		next := el.Next()
+		if now.After(el.Value.(*diskIndexEntry).expiresAt) {
+			d.remove(el)
+		}
+		el = next
+	}
+}
+
+// evict removes the least recently used entries over maxEntries.
+func (d *DiskStore) evict() {
+	for d.maxEntries > 0 && d.order.Len() > d.maxEntries {
+		d.remove(d.order.Back())
+	}
+}
+
+func (d *DiskStore) remove(el *list.Element) {
+	entry := el.Value.(*diskIndexEntry)
+	d.order.Remove(el)
+	delete(d.entries, entry.key)
+	_ = os.Remove(d.path(entry.key))
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// files returns the names of the files in dir.
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestDiskStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set("a", []byte(`{"n":1}`), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := d.Get("a"); !ok || string(value) != `{"n":1}` {
+		t.Errorf("Get(a) after a restart = %s, %v", value, ok)
+	}
+}
+
+func TestDiskStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	d.Set("a", []byte("1"), expires)
+	d.Set("b", []byte("2"), expires)
+	d.Get("a")
+	d.Set("c", []byte("3"), expires)
+
+	if _, ok := d.Get("b"); ok {
+		t.Error("least recently used entry was kept")
+	}
+	if names := files(t, dir); len(names) != 2 {
+		t.Errorf("files = %v, want 2", names)
+	}
+
+	// A smaller limit after a restart evicts the least recently used files
+	d, err = NewDiskStore(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := files(t, dir); len(names) != 1 {
+		t.Errorf("files after a restart = %v, want 1", names)
+	}
+}
+
+func TestDiskStoreSweepsExpiredFiles(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Set("old", []byte("1"), time.Now().Add(-time.Second))
+	d.Set("other", []byte("2"), time.Now().Add(-time.Second))
+
+	// Never read again, the expired files go with the next sweep
+	d.nextSweep = time.Time{}
+	d.Set("new", []byte("3"), time.Now().Add(time.Hour))
+	if names := files(t, dir); len(names) != 1 || names[0] != "new.json" {
+		t.Errorf("files = %v, want only new.json", names)
+	}
+}
+
+func TestDiskStoreCleansUpOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Set("old", []byte("1"), time.Now().Add(-time.Second))
+	for name, data := range map[string]string{"broken.json": "{", "new.abc.tmp": "{}"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewDiskStore(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if names := files(t, dir); len(names) != 0 {
+		t.Errorf("files = %v, want expired, unreadable and temporary files removed", names)
+	}
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an LRU holding at most maxEntries values.
+type MemoryStore struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	return &MemoryStore{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (m *MemoryStore) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*memoryEntry)
+	if time.Now().After(entry.expiresAt) {
+		m.order.Remove(el)
+		delete(m.entries, key)
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (m *MemoryStore) Set(key string, value []byte, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		entry := el.Value.(*memoryEntry)
+		entry.value, entry.expiresAt = value, expiresAt
+		m.order.MoveToFront(el)
+		return nil
+	}
+
+	m.entries[key] = m.order.PushFront(&memoryEntry{key: key, value: value, expiresAt: expiresAt})
+	for m.maxEntries > 0 && m.order.Len() > m.maxEntries {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	m := NewMemoryStore(2)
+	expires := time.Now().Add(time.Hour)
+	m.Set("a", []byte("1"), expires)
+	m.Set("b", []byte("2"), expires)
+	m.Get("a")
+	m.Set("c", []byte("3"), expires)
+
+	if _, ok := m.Get("b"); ok {
+		t.Error("least recently used entry was kept")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := m.Get(key); !ok {
+			t.Errorf("entry %s was evicted", key)
+		}
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	m := NewMemoryStore(0)
+	m.Set("old", []byte("1"), time.Now().Add(-time.Second))
+	m.Set("new", []byte("2"), time.Now().Add(time.Hour))
+
+	if _, ok := m.Get("old"); ok {
+		t.Error("expired entry was served")
+	}
+	if value, ok := m.Get("new"); !ok || string(value) != "2" {
+		t.Errorf("Get(new) = %q, %v", value, ok)
+	}
+	if len(m.entries) != 1 {
+		t.Errorf("%d entries kept, want the expired one removed", len(m.entries))
+	}
+}
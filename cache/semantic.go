@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Embedder turns texts into embedding vectors.
+type Embedder interface {
+	Embed(ctx context.Context, model string, input []string) ([][]float32, error)
+}
+
+// SemanticOptions configure a Semantic cache.
+type SemanticOptions struct {
+	Model      string  // embedding model
+	Threshold  float64 // minimum cosine similarity of a hit
+	TTL        time.Duration
+	MaxEntries int // per scope, bounds the entries a lookup compares against
+	MaxTotal   int // across all scopes; oldest entries are evicted first
+}
+
+// Semantic stores responses next to the embedding of their prompt and finds
+// them again for prompts that mean the same thing. Entries are only compared
+// within a scope, e.g. the same model and API key.
+//
+// A lookup costs one call to the embedding model plus a comparison against
+// every entry of the scope, so MaxEntries bounds the comparisons and MaxTotal
+// the memory. Callers should try the exact cache first.
+type Semantic struct {
+	embedder Embedder
+	opts     SemanticOptions
+
+	mu     sync.Mutex
+	scopes map[string][]*semanticEntry
+	order  *list.List // of *semanticEntry, oldest first
+}
+
+type semanticEntry struct {
+	scope     string
+	vector    []float32 // unit length
+	value     []byte
+	expiresAt time.Time
+	elem      *list.Element
+}
+
+// Query is an embedded prompt, ready to look up or store.
+type Query struct {
+	scope  string
+	vector []float32
+}
+
+func NewSemantic(embedder Embedder, opts SemanticOptions) *Semantic {
+	return &Semantic{
+		embedder: embedder,
+		opts:     opts,
+		scopes:   make(map[string][]*semanticEntry),
+		order:    list.New(),
+	}
+}
+
+// Embed embeds text for lookups in scope.
+func (s *Semantic) Embed(ctx context.Context, scope, text string) (*Query, error) {
+	vectors, err := s.embedder.Embed(ctx, s.opts.Model, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	vector := normalize(vectors[0])
+	if vector == nil {
+		return nil, errors.New("embedding model returned an empty or zero vector")
+	}
+	return &Query{scope: scope, vector: vector}, nil
+}
+
+// Get returns the most similar live entry of the query's scope, if its
+// similarity reaches the threshold.
+func (s *Semantic) Get(q *Query) (value []byte, similarity float64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	best := -1.0
+	var hit *semanticEntry
+	for _, e := range s.scopes[q.scope] {
+		if now.After(e.expiresAt) || len(e.vector) != len(q.vector) {
+			continue
+		}
+		if sim := dot(e.vector, q.vector); sim > best {
+			best, hit = sim, e
+		}
+	}
+	if hit == nil || best < s.opts.Threshold {
+		return nil, best, false
+	}
+	return hit.value, best, true
+}
+
+// Set stores value for the query's prompt, evicting expired entries and
+// then the oldest ones over the limits.
+func (s *Semantic) Set(q *Query, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Every entry lives for the same TTL, so the oldest expire first.
+	now := time.Now()
+	for front := s.order.Front(); front != nil; front = s.order.Front() {
+		e := front.Value.(*semanticEntry)
+		if now.Before(e.expiresAt) {
+			break
+		}
+		s.remove(e)
+	}
+
+	e := &semanticEntry{
+		scope:     q.scope,
+		vector:    q.vector,
+		value:     value,
+		expiresAt: now.Add(s.opts.TTL),
+	}
+	e.elem = s.order.PushBack(e)
+	s.scopes[q.scope] = append(s.scopes[q.scope], e)
+
+	if entries := s.scopes[q.scope]; s.opts.MaxEntries > 0 && len(entries) > s.opts.MaxEntries {
+		s.remove(entries[0])
+	}
+	for s.opts.MaxTotal > 0 && s.order.Len() > s.opts.MaxTotal {
+		s.remove(s.order.Front().Value.(*semanticEntry))
+	}
+}
+
+// remove drops e, and its scope once it is empty.
+func (s *Semantic) remove(e *semanticEntry) {
+	s.order.Remove(e.elem)
+	entries := s.scopes[e.scope]
+	for i, other := range entries {
+		if other == e {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(s.scopes, e.scope)
+		return
+	}
+	s.scopes[e.scope] = entries
+}
+
+// normalize scales v to unit length so that cosine similarity is a dot
+// product. It returns nil for a zero vector.
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return nil
+	}
+	norm := math.Sqrt(sum)
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = float32(float64(x) / norm)
+	}
+	return out
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// vectorEmbedder embeds the texts it knows as the given vectors.
+type vectorEmbedder map[string][]float32
+
+func (e vectorEmbedder) Embed(ctx context.Context, model string, input []string) ([][]float32, error) {
+	v, ok := e[input[0]]
+	if !ok {
+		return nil, fmt.Errorf("no embedding for %q", input[0])
+	}
+	return [][]float32{v}, nil
+}
+
+// axisEmbedder embeds "n" as the unit vector along axis n, so different
+// prompts are never similar.
+type axisEmbedder struct{}
+
+func (axisEmbedder) Embed(ctx context.Context, model string, input []string) ([][]float32, error) {
+	var n int
+	fmt.Sscan(input[0], &n)
+	v := make([]float32, 16)
+	v[n%len(v)] = 1
+	return [][]float32{v}, nil
+}
+
+func store(t *testing.T, s *Semantic, scope string, n int) *Query {
+	t.Helper()
+	q, err := s.Embed(context.Background(), scope, fmt.Sprint(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set(q, []byte(fmt.Sprint(n)))
+	return q
+}
+
+func TestSemanticThreshold(t *testing.T) {
+	s := NewSemantic(vectorEmbedder{
+		"What is the capital of France?": {1, 0, 0},
+		"Tell me France's capital":       {0.95, 0.3, 0},
+		"How do magnets work?":           {0.2, 0, 1},
+	}, SemanticOptions{Threshold: 0.9, TTL: time.Hour})
+	ctx := context.Background()
+
+	q, err := s.Embed(ctx, "llama3.2", "What is the capital of France?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set(q, []byte("Paris"))
+
+	similar, _ := s.Embed(ctx, "llama3.2", "Tell me France's capital")
+	value, similarity, ok := s.Get(similar)
+	if !ok || string(value) != "Paris" || similarity < 0.9 || similarity > 1 {
+		t.Errorf("paraphrase: Get = %q, %.3f, %v, want Paris above the threshold", value, similarity, ok)
+	}
+
+	unrelated, _ := s.Embed(ctx, "llama3.2", "How do magnets work?")
+	if _, similarity, ok := s.Get(unrelated); ok {
+		t.Errorf("unrelated prompt hit with similarity %.3f", similarity)
+	}
+}
+
+func TestSemanticScopes(t *testing.T) {
+	s := NewSemantic(axisEmbedder{}, SemanticOptions{Threshold: 0.9, TTL: time.Hour})
+	store(t, s, "a", 1)
+
+	q, _ := s.Embed(context.Background(), "b", "1")
+	if _, _, ok := s.Get(q); ok {
+		t.Error("an entry of another scope was returned")
+	}
+}
+
+func TestSemanticExpiry(t *testing.T) {
+	s := NewSemantic(axisEmbedder{}, SemanticOptions{Threshold: 0.9, TTL: time.Millisecond})
+	q := store(t, s, "a", 1)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, _, ok := s.Get(q); ok {
+		t.Error("expired entry was returned")
+	}
+}
+
+func TestSemanticZeroVector(t *testing.T) {
+	s := NewSemantic(vectorEmbedder{"": {0, 0}}, SemanticOptions{Threshold: 0.9, TTL: time.Hour})
+	if _, err := s.Embed(context.Background(), "a", ""); err == nil {
+		t.Error("a zero vector was accepted")
+	}
+}
+
+func TestSemanticMaxEntriesPerScope(t *testing.T) {
+	s := NewSemantic(axisEmbedder{}, SemanticOptions{Threshold: 0.9, TTL: time.Hour, MaxEntries: 2})
+	first := store(t, s, "a", 1)
+	store(t, s, "a", 2)
+	store(t, s, "a", 3)
+	store(t, s, "b", 4)
+
+	if _, _, ok := s.Get(first); ok {
+		t.Error("oldest entry of a full scope was not evicted")
+	}
+	if got := len(s.scopes["a"]); got != 2 {
+		t.Errorf("scope a holds %d entries, want 2", got)
+	}
+}
+
+func TestSemanticMaxTotal(t *testing.T) {
+	s := NewSemantic(axisEmbedder{}, SemanticOptions{Threshold: 0.9, TTL: time.Hour, MaxEntries: 10, MaxTotal: 3})
+	for i := 0; i < 5; i++ {
+		store(t, s, fmt.Sprint("scope-", i), i)
+	}
+
+	if got := s.order.Len(); got != 3 {
+		t.Errorf("cache holds %d entries, want 3", got)
+	}
+	if got := len(s.scopes); got != 3 {
+		t.Errorf("cache holds %d scopes, want 3 as emptied scopes are dropped", got)
+	}
+	q, _ := s.Embed(context.Background(), "scope-4", "4")
+	if value, _, ok := s.Get(q); !ok || string(value) != "4" {
+		t.Errorf("newest entry: got %q, %v", value, ok)
+	}
+}
+
+func TestSemanticExpiredScopesDropped(t *testing.T) {
+	s := NewSemantic(axisEmbedder{}, SemanticOptions{Threshold: 0.9, TTL: time.Millisecond})
+	store(t, s, "old", 1)
+	time.Sleep(5 * time.Millisecond)
+	store(t, s, "new", 2)
+
+	if _, ok := s.scopes["old"]; ok {
+		t.Error("scope with only expired entries was kept")
+	}
+	if got := s.order.Len(); got != 1 {
+		t.Errorf("cache holds %d entries, want 1", got)
+	}
+}
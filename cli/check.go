@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"openai-compatible/server"
+)
+
+func checkConfig(args []string) error {
+	fs, path := newFlagSet("check-config", " [file]")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		*path = fs.Arg(0)
+	default:
+		fs.Usage()
+		return errUsage
+	}
+
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		return err
+	}
+	// Building the providers checks what config.Load doesn't, such as the
+	// load balancing strategy, the routes and the mock script.
+	if _, err := server.NewRegistry(cfg); err != nil {
+		return err
+	}
+
+	source := cfg.File
+	if source == "" {
+		source = "environment"
+	}
+	scheme := "http"
+	if cfg.TLSCertFile != "" {
+		scheme = "https"
+	}
+	keys := len(cfg.APIKeys)
+	if cfg.APIKey != "" {
+		keys++
+	}
+	backends := strings.Join(cfg.OllamaURLs, ", ")
+	if cfg.MockProvider {
+		backends = "mock provider"
+	}
+
+	fmt.Printf("%s: configuration is valid\n", source)
+	fmt.Printf("  listen     %s on port %s\n", scheme, cfg.Port)
+	fmt.Printf("  api keys   %d\n", keys)
+	fmt.Printf("  backends   %s\n", backends)
+	fmt.Printf("  upstreams  %d OpenAI compatible, %d llama.cpp\n", len(cfg.OpenAIUpstreams), len(cfg.LlamaCppServers))
+	fmt.Printf("  models     %s by default, %d aliases, %d routes\n", cfg.OllamaModel, len(cfg.ModelAliases), len(cfg.ModelRoutes))
+	return nil
+}
@@ -0,0 +1,121 @@
+// Package cli implements the command line of the gateway binary: serve
+// and the tools around it.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"openai-compatible/config"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "Start the gateway (the default)", serve},
+	{"check-config", "Validate the configuration and exit", checkConfig},
+	{"models", "List the models of the configured backends", listModels},
+	{"keys", "Generate, list and revoke API keys in the keys file", keys},
+	{"version", "Print the version", version},
+}
+
+// errUsage reports wrong arguments, after the usage was printed.
+var errUsage = errors.New("usage")
+
+// Run runs the command named by args[0], serve if args is empty or starts
+// with a flag, and returns the exit code.
+func Run(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" || name == "-h" || name == "--help" {
+		usage(os.Stdout)
+		return 0
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		switch err := cmd.run(args); {
+		case err == nil, errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return 2
+		default:
+			for _, err := range splitErrors(err) {
+				fmt.Fprintln(os.Stderr, "error:", err)
+			}
+			return 1
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage(os.Stderr)
+	return 2
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: openai-compatible [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "openai-compatible <command> -h" for the flags of a command.`)
+}
+
+// newFlagSet creates the flags of a command, with the --config flag every
+// command has.
+func newFlagSet(name, args string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: openai-compatible %s [flags]%s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	path := fs.String("config", "", "YAML or TOML configuration file (default $CONFIG_FILE)")
+	return fs, path
+}
+
+// parseFlags parses args into fs. The flag package prints its own errors
+// and the usage, so they are reported as errUsage.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		return errUsage
+	}
+	return err
+}
+
+// loadConfig loads the configuration for a command other than serve, which
+// logs only errors.
+func loadConfig(path string) (*config.Config, error) {
+	logErrorsOnly()
+	return config.Load(path)
+}
+
+// logErrorsOnly sets the default logger of a command other than serve.
+func logErrorsOnly() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})))
+}
+
+// splitErrors returns the errors joined in err.
+func splitErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"openai-compatible/config"
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/middleware"
+)
+
+var keysCommands = []command{
+	{"generate", "Add a new random key to the keys file", generateKey},
+	{"list", "List the configured keys, masked", listKeys},
+	{"revoke", "Remove keys from the keys file by ID or key", revokeKeys},
+}
+
+func keys(args []string) error {
+	if len(args) > 0 {
+		for _, cmd := range keysCommands {
+			if cmd.name == args[0] {
+				return cmd.run(args[1:])
+			}
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: openai-compatible keys <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range keysCommands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "A running server reloads the keys file when it changes.")
+	return errUsage
+}
+
+// keysFlagSet adds --file, which names the keys file instead of the
+// configuration.
+func keysFlagSet(name, args string) (*flag.FlagSet, *string, *string) {
+	fs, path := newFlagSet("keys "+name, args)
+	file := fs.String("file", "", "keys file (default the configured API_KEYS_FILE)")
+	return fs, path, file
+}
+
+// keysFile returns the keys file to change: file if set, the configured
+// one otherwise. The rest of the configuration isn't validated, so the
+// first key can be generated before any is configured.
+func keysFile(file, configPath string) (string, error) {
+	if file != "" {
+		return file, nil
+	}
+	logErrorsOnly()
+	path, err := config.KeysFile(configPath)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", errors.New("no keys file is configured, set API_KEYS_FILE or auth.keys_file, or pass --file")
+	}
+	return path, nil
+}
+
+func generateKey(args []string) error {
+	fs, path, file := keysFlagSet("generate", "")
+	priority := fs.String("priority", "", "queue priority of the key: low, normal or high")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+	if *priority != "" {
+		if _, err := limiter.ParsePriority(*priority); err != nil {
+			return err
+		}
+	}
+	target, err := keysFile(*file, *path)
+	if err != nil {
+		return err
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	key := config.APIKey{Key: "sk-" + hex.EncodeToString(secret), Priority: *priority}
+	if err := config.AddKey(target, key); err != nil {
+		return err
+	}
+
+	fmt.Println(key.Key)
+	fmt.Fprintf(os.Stderr, "added %s to %s, it won't be shown again\n", middleware.KeyID(key.Key), target)
+	return nil
+}
+
+func listKeys(args []string) error {
+	fs, path, file := keysFlagSet("list", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	type entry struct {
+		key    config.APIKey
+		source string
+	}
+	var entries []entry
+	if *file != "" {
+		keys, err := config.ReadKeysFile(*file)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			entries = append(entries, entry{key, *file})
+		}
+	} else {
+		cfg, err := loadConfig(*path)
+		if err != nil {
+			return err
+		}
+		if cfg.APIKey != "" {
+			entries = append(entries, entry{config.APIKey{Key: cfg.APIKey}, "API_KEY"})
+		}
+		// Load appends the keys of the keys file to API_KEYS
+		fromFile := 0
+		if cfg.APIKeysFile != "" {
+			keys, err := config.ReadKeysFile(cfg.APIKeysFile)
+			if err != nil {
+				return err
+			}
+			fromFile = len(keys)
+		}
+		for i, key := range cfg.APIKeys {
+			source := "API_KEYS"
+			if i >= len(cfg.APIKeys)-fromFile {
+				source = cfg.APIKeysFile
+			}
+			entries = append(entries, entry{key, source})
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKEY\tPRIORITY\tSOURCE")
+	for _, e := range entries {
+		priority := e.key.Priority
+		if priority == "" {
+			priority = "normal"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", middleware.KeyID(e.key.Key), logging.MaskSecret(e.key.Key), priority, e.source)
+	}
+	return w.Flush()
+}
+
+func revokeKeys(args []string) error {
+	fs, path, file := keysFlagSet("revoke", " <id|key>...")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	target, err := keysFile(*file, *path)
+	if err != nil {
+		return err
+	}
+
+	revoke := make(map[string]bool)
+	for _, arg := range fs.Args() {
+		revoke[arg] = true
+	}
+	removed, err := config.RemoveKeys(target, func(key config.APIKey) bool {
+		return revoke[key.Key] || revoke[middleware.KeyID(key.Key)]
+	})
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("no matching key in %s", target)
+	}
+	fmt.Fprintf(os.Stderr, "revoked %d key(s) in %s\n", removed, target)
+	return nil
+}
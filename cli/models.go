@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"openai-compatible/server"
+)
+
+func listModels(args []string) error {
+	fs, path := newFlagSet("models", "")
+	asJSON := fs.Bool("json", false, "print the /v1/models response as JSON")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for the backends")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		return err
+	}
+	registry, err := server.NewRegistry(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	resp, err := registry.GetModels(ctx)
+	if err != nil {
+		return fmt.Errorf("listing models: %w", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tOWNED BY")
+	for _, m := range resp.Data {
+		fmt.Fprintf(w, "%s\t%s\n", m.ID, m.OwnedBy)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,198 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"openai-compatible/config"
+	"openai-compatible/logging"
+	"openai-compatible/server"
+	"openai-compatible/tracing"
+)
+
+// shutdownGrace is how long /readyz fails before the listeners close, so
+// load balancers see it, and how long cancelled streams get to write their
+// final error event once SHUTDOWN_TIMEOUT has passed.
+const shutdownGrace = 5 * time.Second
+
+// envFlag is a serve flag standing for an environment variable. Setting it
+// sets the variable, so flags override the environment and the config file.
+type envFlag struct {
+	env     string
+	boolean bool
+}
+
+func (f envFlag) String() string     { return "" }
+func (f envFlag) Set(v string) error { return os.Setenv(f.env, v) }
+func (f envFlag) IsBoolFlag() bool   { return f.boolean }
+
+var serveFlags = []struct {
+	name, env, usage string
+	boolean          bool
+}{
+	{"port", "PORT", "port to listen on", false},
+	{"ollama-url", "OLLAMA_URL", "Ollama server URL", false},
+	{"model", "OLLAMA_MODEL", "default model", false},
+	{"log-level", "LOG_LEVEL", "log level: debug, info, warn or error", false},
+	{"tls-cert", "TLS_CERT_FILE", "TLS certificate file, serves HTTPS with --tls-key", false},
+	{"tls-key", "TLS_KEY_FILE", "TLS private key file", false},
+	{"keys-file", "API_KEYS_FILE", "file of API keys, one key[:priority] per line", false},
+	{"mock", "MOCK_PROVIDER", "serve from the mock provider instead of Ollama", true},
+	{"allow-insecure-api-key", "ALLOW_INSECURE_API_KEY", "start with the placeholder API key, or without any key", true},
+}
+
+func serve(args []string) error {
+	fs, path := newFlagSet("serve", "")
+	for _, f := range serveFlags {
+		fs.Var(envFlag{env: f.env, boolean: f.boolean}, f.name, fmt.Sprintf("%s ($%s)", f.usage, f.env))
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// Load configuration
+	cfg, err := config.Load(*path)
+	if err != nil {
+		return err
+	}
+
+	if err := logging.Setup(os.Stdout, cfg.LogLevel); err != nil {
+		return err
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracingExporter, cfg.ServiceName)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("failed to flush traces", "error", err)
+		}
+	}()
+
+	srv, err := server.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+
+	// Start server
+	slog.Info("starting server",
+		"version", server.Version,
+		"port", cfg.Port,
+		"config_file", cfg.File,
+		"tls", cfg.TLSCertFile != "",
+		"api_key", logging.MaskSecret(cfg.APIKey),
+		"extra_api_keys", len(cfg.APIKeys),
+		"ollama_urls", cfg.OllamaURLs,
+		"lb_strategy", cfg.LoadBalancing,
+		"max_parallel_per_model", cfg.MaxParallelPerModel,
+		"max_parallel_per_backend", cfg.MaxParallelPerBackend,
+		"ollama_model", cfg.OllamaModel,
+		"tracing_exporter", cfg.TracingExporter,
+		"cache_backend", cfg.CacheBackend,
+		"openai_upstreams", len(cfg.OpenAIUpstreams),
+		"llamacpp_servers", len(cfg.LlamaCppServers),
+		"mock_provider", cfg.MockProvider,
+		"semantic_cache_model", cfg.SemanticCacheModel,
+		"coalesce_requests", cfg.CoalesceRequests,
+		"coalesce_streams", cfg.CoalesceRequests && cfg.CoalesceStreams,
+	)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if cfg.TLSCertFile != "" {
+			serverErr <- srv.App.ListenTLS(":"+cfg.Port, cfg.TLSCertFile, cfg.TLSKeyFile)
+			return
+		}
+		serverErr <- srv.App.Listen(":" + cfg.Port)
+	}()
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	// Reload the configuration on SIGHUP and when its files change
+	reloads := make(chan struct{}, 1)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			select {
+			case reloads <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	if cfg.File != "" || cfg.APIKeysFile != "" {
+		if err := config.Watch(signals, []string{cfg.File, cfg.APIKeysFile}, reloads); err != nil {
+			slog.Warn("not watching the config file, reload it with SIGHUP", "error", err)
+		}
+	}
+	go func() {
+		for range reloads {
+			reload(srv, cfg.File)
+		}
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil {
+			return fmt.Errorf("failed to start server: %w", err)
+		}
+		return nil
+	case <-signals.Done():
+	}
+
+	slog.Info("shutting down, draining in-flight requests", "timeout", cfg.ShutdownTimeout)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelDrain()
+
+	// Fail /readyz while still listening, so load balancers stop sending
+	// requests before the connections are refused.
+	srv.Drainer.StartDrain()
+	select {
+	case <-time.After(shutdownGrace):
+	case <-drainCtx.Done():
+	}
+
+	// Stop accepting connections. Fiber waits for open connections,
+	// including active streams, before this returns.
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.App.Shutdown()
+	}()
+
+	if err := srv.Drainer.Drain(drainCtx, shutdownGrace); err != nil {
+		slog.Warn("drain deadline exceeded, cancelled remaining requests", "error", err)
+	}
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			slog.Error("server shutdown failed", "error", err)
+		}
+	case <-time.After(shutdownGrace):
+		slog.Warn("server did not close all connections in time")
+	}
+
+	slog.Info("server stopped")
+	return nil
+}
+
+// reload loads the configuration again and applies it to srv. An invalid
+// configuration is logged and the running one kept.
+func reload(srv *server.Server, path string) {
+	slog.Info("reloading configuration", "file", path)
+	cfg, err := config.Load(path)
+	if err == nil {
+		err = srv.Reload(cfg)
+	}
+	for _, err := range splitErrors(err) {
+		slog.Error("invalid configuration, keeping the current one", "error", err)
+	}
+}
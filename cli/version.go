@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"openai-compatible/server"
+)
+
+func version(args []string) error {
+	if len(args) > 0 {
+		fmt.Println("Usage: openai-compatible version")
+		return errUsage
+	}
+
+	fmt.Printf("openai-compatible %s\n", server.Version)
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+	settings := make(map[string]string)
+	for _, s := range info.Settings {
+		settings[s.Key] = s.Value
+	}
+	if revision := settings["vcs.revision"]; revision != "" {
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		if settings["vcs.modified"] == "true" {
+			revision += " (modified)"
+		}
+		fmt.Printf("commit %s %s\n", revision, settings["vcs.time"])
+	}
+	fmt.Printf("%s %s/%s\n", info.GoVersion, runtime.GOOS, runtime.GOARCH)
+	return nil
+}
@@ -0,0 +1,87 @@
+package coalesce
+
+import (
+	"context"
+	"sync"
+)
+
+// Group runs one call per key at a time; concurrent callers with the same
+// key wait for that call and share its result.
+//
+// The call runs on a context detached from any single caller, keeping its
+// values (request ID, trace span, ...). It is cancelled only once every
+// caller waiting for it has given up.
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+type call[T any] struct {
+	done    chan struct{}
+	val     T
+	err     error
+	waiters int
+	cancel  context.CancelCauseFunc
+}
+
+func NewGroup[T any]() *Group[T] {
+	return &Group[T]{calls: make(map[string]*call[T])}
+}
+
+// Do runs fn for key, or waits for the call already running for key. shared
+// reports whether the result came from another caller's call.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (val T, shared bool, err error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		g.mu.Unlock()
+		return g.wait(ctx, key, c, true)
+	}
+
+	callCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	c := &call[T]{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	go func() {
+		c.val, c.err = fn(callCtx)
+		cancel(nil)
+		g.forget(key, c)
+		close(c.done)
+	}()
+
+	return g.wait(ctx, key, c, false)
+}
+
+func (g *Group[T]) wait(ctx context.Context, key string, c *call[T], shared bool) (T, bool, error) {
+	select {
+	case <-c.done:
+		return c.val, shared, c.err
+	case <-ctx.Done():
+	}
+
+	// Forget the call in the same critical section, so nobody joins it
+	// while it's being cancelled
+	g.mu.Lock()
+	c.waiters--
+	last := c.waiters == 0
+	if last && g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+	if last {
+		c.cancel(context.Cause(ctx))
+	}
+
+	var zero T
+	return zero, shared, ctx.Err()
+}
+
+// forget removes c so later callers start a new call.
+func (g *Group[T]) forget(key string, c *call[T]) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
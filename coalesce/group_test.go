@@ -0,0 +1,148 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupShares(t *testing.T) {
+	g := NewGroup[string]()
+	release := make(chan struct{})
+	var calls atomic.Int32
+	fn := func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		<-release
+		return "ok", nil
+	}
+
+	var wg sync.WaitGroup
+	shared := make([]bool, 3)
+	for i := range shared {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val, s, err := g.Do(context.Background(), "key", fn)
+			if err != nil || val != "ok" {
+				t.Errorf("Do = %q, %v", val, err)
+			}
+			shared[i] = s
+		}(i)
+	}
+	for {
+		g.mu.Lock()
+		waiters := 0
+		if c := g.calls["key"]; c != nil {
+			waiters = c.waiters
+		}
+		g.mu.Unlock()
+		if waiters == len(shared) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fn ran %d times, want 1", n)
+	}
+	leaders := 0
+	for _, s := range shared {
+		if !s {
+			leaders++
+		}
+	}
+	if leaders != 1 {
+		t.Errorf("%d callers ran the call, want 1", leaders)
+	}
+}
+
+func TestGroupCancelsWhenEveryoneLeft(t *testing.T) {
+	g := NewGroup[string]()
+	cancelled := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := g.Do(ctx, "key", func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return "", ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do = %v, want context.Canceled", err)
+	}
+	if err := <-cancelled; err == nil {
+		t.Error("the call wasn't cancelled")
+	}
+}
+
+// leavingContext runs onLeave the first time a value is looked up after
+// it's done, as the group does when its last caller leaves.
+type leavingContext struct {
+	context.Context
+	once    sync.Once
+	onLeave func()
+}
+
+func (c *leavingContext) Value(key any) any {
+	if c.Err() != nil {
+		c.once.Do(c.onLeave)
+	}
+	return c.Context.Value(key)
+}
+
+// A caller joining while the last waiter leaves must not get the
+// cancellation meant for the departing call.
+func TestGroupJoinWhileLastWaiterLeaves(t *testing.T) {
+	g := NewGroup[string]()
+	var calls atomic.Int32
+	started := make(chan struct{})
+	fn := func(ctx context.Context) (string, error) {
+		if calls.Add(1) > 1 {
+			return "ok", nil
+		}
+		close(started)
+		<-ctx.Done()
+		return "", context.Cause(ctx)
+	}
+
+	joined := make(chan error, 1)
+	parent, cancel := context.WithCancel(context.Background())
+	ctx := &leavingContext{Context: parent}
+	ctx.onLeave = func() {
+		g.mu.Lock()
+		c := g.calls["key"]
+		g.mu.Unlock()
+		go func() {
+			_, _, err := g.Do(context.Background(), "key", fn)
+			joined <- err
+		}()
+		// Wait until the new caller joined c or finished its own call
+		for {
+			g.mu.Lock()
+			waiting := c != nil && c.waiters > 0
+			g.mu.Unlock()
+			if waiting || len(joined) > 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		g.Do(ctx, "key", fn)
+	}()
+	<-started
+	cancel()
+	<-left
+
+	if err := <-joined; err != nil {
+		t.Errorf("joining caller got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package coalesce
+
+import (
+	"context"
+	"sync"
+)
+
+// StreamGroup shares one stream per key between concurrent subscribers.
+// Every event is buffered for the lifetime of the stream, so subscribers
+// that join late still receive it from the start. Like Group, the stream is
+// cancelled only once every subscriber has left.
+type StreamGroup[E any] struct {
+	mu      sync.Mutex
+	flights map[string]*flight[E]
+}
+
+type flight[E any] struct {
+	ready  chan struct{} // closed once start returned
+	err    error         // start's error
+	cancel context.CancelCauseFunc
+
+	mu          sync.Mutex
+	events      []E
+	closed      bool
+	notify      chan struct{} // closed and replaced when events change
+	subscribers int
+}
+
+func NewStreamGroup[E any]() *StreamGroup[E] {
+	return &StreamGroup[E]{flights: make(map[string]*flight[E])}
+}
+
+// Subscribe returns the events of the stream for key, calling start if no
+// stream is running for it. shared reports whether another subscriber
+// started the stream.
+func (g *StreamGroup[E]) Subscribe(ctx context.Context, key string, start func(ctx context.Context) (<-chan E, error)) (events <-chan E, shared bool, err error) {
+	g.mu.Lock()
+	f, shared := g.flights[key]
+	if shared {
+		f.mu.Lock()
+		f.subscribers++
+		f.mu.Unlock()
+	} else {
+		streamCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+		f = &flight[E]{
+			ready:       make(chan struct{}),
+			cancel:      cancel,
+			notify:      make(chan struct{}),
+			subscribers: 1,
+		}
+		g.flights[key] = f
+		g.mu.Unlock()
+
+		source, err := start(streamCtx)
+		if err != nil {
+			f.err = err
+			cancel(nil)
+			g.forget(key, f)
+			close(f.ready)
+			return nil, false, err
+		}
+		close(f.ready)
+		go g.pump(key, f, source)
+		return g.subscribe(ctx, key, f), false, nil
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		g.leave(ctx, key, f)
+		return nil, true, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, true, f.err
+	}
+	return g.subscribe(ctx, key, f), true, nil
+}
+
+// pump buffers the source events and wakes up the subscribers.
+func (g *StreamGroup[E]) pump(key string, f *flight[E], source <-chan E) {
+	for event := range source {
+		f.mu.Lock()
+		f.events = append(f.events, event)
+		close(f.notify)
+		f.notify = make(chan struct{})
+		f.mu.Unlock()
+	}
+
+	f.mu.Lock()
+	f.closed = true
+	close(f.notify)
+	f.mu.Unlock()
+
+	f.cancel(nil)
+	g.forget(key, f)
+}
+
+func (g *StreamGroup[E]) subscribe(ctx context.Context, key string, f *flight[E]) <-chan E {
+	out := make(chan E)
+	go func() {
+		defer close(out)
+		for i := 0; ; {
+			f.mu.Lock()
+			if i < len(f.events) {
+				event := f.events[i]
+				f.mu.Unlock()
+				select {
+				case out <- event:
+					i++
+					continue
+				case <-ctx.Done():
+					g.leave(ctx, key, f)
+					return
+				}
+			}
+			if f.closed {
+				f.subscribers--
+				f.mu.Unlock()
+				return
+			}
+			notify := f.notify
+			f.mu.Unlock()
+
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				g.leave(ctx, key, f)
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// leave unsubscribes, cancelling the stream if nobody is left.
+// The flight is forgotten under g.mu, which Subscribe holds to join it, so
+// nobody joins a stream that is being cancelled.
+func (g *StreamGroup[E]) leave(ctx context.Context, key string, f *flight[E]) {
+	g.mu.Lock()
+	f.mu.Lock()
+	f.subscribers--
+	last := f.subscribers == 0 && !f.closed
+	f.mu.Unlock()
+	if last && g.flights[key] == f {
+		delete(g.flights, key)
+	}
+	g.mu.Unlock()
+	if last {
+		f.cancel(context.Cause(ctx))
+	}
+}
+
+func (g *StreamGroup[E]) forget(key string, f *flight[E]) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
@@ -0,0 +1,107 @@
+package coalesce
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// source returns a stream of events, closed afterwards.
+func source(events ...string) <-chan string {
+	ch := make(chan string, len(events))
+	for _, e := range events {
+		ch <- e
+	}
+	close(ch)
+	return ch
+}
+
+func collect(ch <-chan string) []string {
+	var events []string
+	for e := range ch {
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestStreamGroupLateSubscriber(t *testing.T) {
+	g := NewStreamGroup[string]()
+	release := make(chan struct{})
+	start := func(ctx context.Context) (<-chan string, error) {
+		ch := make(chan string)
+		go func() {
+			defer close(ch)
+			ch <- "a"
+			<-release
+			ch <- "b"
+		}()
+		return ch, nil
+	}
+
+	first, shared, err := g.Subscribe(context.Background(), "key", start)
+	if err != nil || shared {
+		t.Fatalf("Subscribe = %v, shared %v", err, shared)
+	}
+	if e := <-first; e != "a" {
+		t.Fatalf("first event %q, want a", e)
+	}
+	late, shared, err := g.Subscribe(context.Background(), "key", func(context.Context) (<-chan string, error) {
+		t.Error("a second stream was started")
+		return source(), nil
+	})
+	if err != nil || !shared {
+		t.Fatalf("late Subscribe = %v, shared %v", err, shared)
+	}
+	close(release)
+
+	if got := collect(late); fmt.Sprint(got) != "[a b]" {
+		t.Errorf("late subscriber got %v, want [a b]", got)
+	}
+	if got := collect(first); fmt.Sprint(got) != "[b]" {
+		t.Errorf("first subscriber got %v after a, want [b]", got)
+	}
+}
+
+// A subscriber joining while the last one leaves must not get the
+// cancelled stream.
+func TestStreamGroupJoinWhileLastSubscriberLeaves(t *testing.T) {
+	g := NewStreamGroup[string]()
+	var starts atomic.Int32
+	start := func(ctx context.Context) (<-chan string, error) {
+		if starts.Add(1) > 1 {
+			return source("ok"), nil
+		}
+		ch := make(chan string)
+		go func() {
+			<-ctx.Done()
+			close(ch)
+		}()
+		return ch, nil
+	}
+
+	var joined <-chan string
+	parent, cancel := context.WithCancel(context.Background())
+	ctx := &leavingContext{Context: parent}
+	ctx.onLeave = func() {
+		var err error
+		if joined, _, err = g.Subscribe(context.Background(), "key", start); err != nil {
+			t.Errorf("joining subscriber got %v", err)
+		}
+	}
+
+	first, _, err := g.Subscribe(ctx, "key", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for range first {
+	}
+
+	if joined == nil {
+		t.Fatal("the subscriber didn't leave")
+	}
+	if got := collect(joined); fmt.Sprint(got) != "[ok]" {
+		t.Errorf("joining subscriber got %v, want [ok]", got)
+	}
+}
@@ -1,37 +1,463 @@
 package config
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// PlaceholderAPIKey is the example key of .env.example. The server refuses
+// to start with it unless ALLOW_INSECURE_API_KEY is set.
+const PlaceholderAPIKey = "sk-your-secret-api-key-here"
+
+// Upstream is a server of a non-Ollama provider that models starting with
+// Prefix are forwarded to.
+type Upstream struct {
+	Name    string
+	BaseURL string // including the version for OpenAI compatible servers, e.g. http://vllm:8000/v1
+	APIKey  string
+	Prefix  string
+}
+
+// APIKey is an accepted API key and the queue priority of its requests
+// (low, normal or high).
+type APIKey struct {
+	Key      string
+	Priority string
+}
+
 type Config struct {
-	Port        string
-	APIKey      string
-	OllamaURL   string
-	OllamaModel string
+	// File is the config file the settings were read from, if any.
+	File string
+
+	Port            string
+	APIKey          string
+	APIKeys         []APIKey
+	APIKeysFile     string // one key[:priority] per line, added to APIKeys
+	OllamaURL       string
+	OllamaModel     string
+	ShutdownTimeout time.Duration
+
+	// Allows starting with the placeholder API key, or without any key
+	AllowInsecureAPIKey bool
+
+	// TLS, the server speaks plain HTTP unless both files are set
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Ollama backends. OllamaURLs always has at least one entry, falling
+	// back to OllamaURL when OLLAMA_URLS is not set.
+	OllamaURLs          []string
+	LoadBalancing       string
+	HealthCheckInterval time.Duration
+
+	// Retries and failover
+	RetryMaxAttempts    int
+	RetryBaseDelay      time.Duration
+	RetryMaxDelay       time.Duration
+	FallbackModels      []string
+	BreakerThreshold    int
+	BreakerOpenDuration time.Duration
+
+	// Streaming
+	StreamIdleTimeout time.Duration
+
+	// Response cache
+	CacheBackend    string
+	CacheTTL        time.Duration
+	CacheMaxEntries int
+	CacheDir        string
+
+	// Routing: model ID -> provider name, from MODEL_ROUTES entries
+	// "model=provider". Other models go to Ollama.
+	ModelRoutes map[string]string
+
+	// Model aliases: alias -> model ID, from MODEL_ALIASES entries
+	// "alias=model". Aliases are resolved before routing.
+	ModelAliases map[string]string
+
+	// OpenAI compatible upstreams, from OPENAI_UPSTREAMS and the
+	// OPENAI_UPSTREAM_<NAME>_* variables
+	OpenAIUpstreams []Upstream
+
+	// Native llama.cpp servers, from LLAMACPP_SERVERS and the
+	// LLAMACPP_SERVER_<NAME>_* variables
+	LlamaCppServers []Upstream
+
+	// Mock provider, replaces Ollama as the default provider when enabled
+	MockProvider   bool
+	MockScript     string // JSON file of scripted responses
+	MockLatency    time.Duration
+	MockTokenDelay time.Duration
+
+	// Record or replay the traffic to Ollama, disabled unless CassetteMode
+	// is "record" or "replay"
+	CassetteMode   string
+	CassetteDir    string
+	CassetteTiming bool // replay with the recorded latency and stream timing
+
+	// Semantic cache, disabled without an embedding model
+	SemanticCacheModel      string
+	SemanticCacheThreshold  float64
+	SemanticCacheTTL        time.Duration
+	SemanticCacheMaxEntries int
+	SemanticCacheMaxTotal   int
+
+	// Request coalescing
+	CoalesceRequests bool
+	CoalesceStreams  bool
+
+	// Concurrency limits, per backend
+	MaxParallelPerModel   int
+	MaxParallelPerBackend int
+	QueueSize             int
+	QueueTimeout          time.Duration
+
+	// Readiness
+	RequiredModels    []string
+	ReadinessCacheTTL time.Duration
+
+	// Logging
+	LogLevel       string
+	LogPrivacy     string
+	LogPromptChars int
+
+	// Tracing
+	TracingExporter string
+	ServiceName     string
+}
+
+var dotenv sync.Once
+
+// Load reads the configuration. Each setting comes from its environment
+// variable (.env included) or, if that's not set, from the config file at
+// path, or CONFIG_FILE if path is empty. The returned error lists every
+// invalid setting. Calling Load again re-reads the config file and
+// API_KEYS_FILE, but not .env.
+func Load(path string) (*Config, error) {
+	l, path, err := newLoader(path)
+	if err != nil {
+		return nil, err
+	}
+	if l.file != nil {
+		l.errs = append(l.errs, l.file.errs...)
+	}
+
+	cfg := &Config{
+		File:        path,
+		Port:        l.getEnv("PORT", "8080"),
+		APIKey:      l.getEnv("API_KEY", ""),
+		APIKeysFile: l.getEnv("API_KEYS_FILE", ""),
+		OllamaURL:   l.getEnv("OLLAMA_URL", "http://localhost:11434"),
+		OllamaModel: l.getEnv("OLLAMA_MODEL", "llama3.2:latest"),
+
+		ShutdownTimeout: l.getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		AllowInsecureAPIKey: l.getEnvBool("ALLOW_INSECURE_API_KEY", false),
+
+		TLSCertFile: l.getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:  l.getEnv("TLS_KEY_FILE", ""),
+
+		OllamaURLs:          l.getEnvList("OLLAMA_URLS"),
+		LoadBalancing:       l.getEnv("LB_STRATEGY", "round_robin"),
+		HealthCheckInterval: l.getEnvDuration("HEALTH_CHECK_INTERVAL", 10*time.Second),
+
+		RetryMaxAttempts:    l.getEnvInt("RETRY_MAX_ATTEMPTS", 3),
+		RetryBaseDelay:      l.getEnvDuration("RETRY_BASE_DELAY", 200*time.Millisecond),
+		RetryMaxDelay:       l.getEnvDuration("RETRY_MAX_DELAY", 2*time.Second),
+		FallbackModels:      l.getEnvList("FALLBACK_MODELS"),
+		BreakerThreshold:    l.getEnvInt("CB_FAILURE_THRESHOLD", 5),
+		BreakerOpenDuration: l.getEnvDuration("CB_OPEN_DURATION", 30*time.Second),
+
+		StreamIdleTimeout: l.getEnvDuration("STREAM_IDLE_TIMEOUT", 60*time.Second),
+
+		CacheBackend:    l.getEnv("CACHE_BACKEND", "none"),
+		CacheTTL:        l.getEnvDuration("CACHE_TTL", time.Hour),
+		CacheMaxEntries: l.getEnvInt("CACHE_MAX_ENTRIES", 1000),
+		CacheDir:        l.getEnv("CACHE_DIR", ".cache/responses"),
+
+		ModelRoutes:  l.getEnvMap("MODEL_ROUTES"),
+		ModelAliases: l.getEnvMap("MODEL_ALIASES"),
+
+		OpenAIUpstreams: l.getEnvUpstreams("OPENAI_UPSTREAMS", "OPENAI_UPSTREAM_"),
+		LlamaCppServers: l.getEnvUpstreams("LLAMACPP_SERVERS", "LLAMACPP_SERVER_"),
+
+		CassetteMode:   l.getEnv("CASSETTE_MODE", ""),
+		CassetteDir:    l.getEnv("CASSETTE_DIR", "cassettes"),
+		CassetteTiming: l.getEnvBool("CASSETTE_REPLAY_TIMING", true),
+
+		SemanticCacheModel:      l.getEnv("SEMANTIC_CACHE_MODEL", ""),
+		SemanticCacheThreshold:  l.getEnvFloat("SEMANTIC_CACHE_THRESHOLD", 0.95),
+		SemanticCacheTTL:        l.getEnvDuration("SEMANTIC_CACHE_TTL", time.Hour),
+		SemanticCacheMaxEntries: l.getEnvInt("SEMANTIC_CACHE_MAX_ENTRIES", 1000),
+		SemanticCacheMaxTotal:   l.getEnvInt("SEMANTIC_CACHE_MAX_TOTAL_ENTRIES", 10000),
+
+		MockProvider:   l.getEnvBool("MOCK_PROVIDER", false),
+		MockScript:     l.getEnv("MOCK_SCRIPT", ""),
+		MockLatency:    l.getEnvDuration("MOCK_LATENCY", 0),
+		MockTokenDelay: l.getEnvDuration("MOCK_TOKEN_DELAY", 20*time.Millisecond),
+
+		CoalesceRequests: l.getEnvBool("COALESCE_REQUESTS", false),
+		CoalesceStreams:  l.getEnvBool("COALESCE_STREAMS", false),
+
+		MaxParallelPerModel:   l.getEnvInt("MAX_PARALLEL_PER_MODEL", 4),
+		MaxParallelPerBackend: l.getEnvInt("MAX_PARALLEL_PER_BACKEND", 0),
+		QueueSize:             l.getEnvInt("QUEUE_SIZE", 64),
+		QueueTimeout:          l.getEnvDuration("QUEUE_TIMEOUT", 30*time.Second),
+
+		RequiredModels:    l.getEnvList("REQUIRED_MODELS"),
+		ReadinessCacheTTL: l.getEnvDuration("READINESS_CACHE_TTL", 5*time.Second),
+
+		LogLevel:       l.getEnv("LOG_LEVEL", "info"),
+		LogPrivacy:     l.getEnv("LOG_PRIVACY", "redact"),
+		LogPromptChars: l.getEnvInt("LOG_PROMPT_CHARS", 64),
+
+		TracingExporter: l.getEnv("TRACING_EXPORTER", "none"),
+		ServiceName:     l.getEnv("OTEL_SERVICE_NAME", "openai-compatible"),
+	}
+
+	cfg.APIKeys = l.getEnvAPIKeys("API_KEYS")
+	if cfg.APIKeysFile != "" {
+		keys, err := ReadKeysFile(cfg.APIKeysFile)
+		if err != nil {
+			l.fail("API_KEYS_FILE", "%v", err)
+		}
+		cfg.APIKeys = append(cfg.APIKeys, keys...)
+	}
+
+	if len(cfg.OllamaURLs) == 0 {
+		cfg.OllamaURLs = []string{cfg.OllamaURL}
+	}
+	if cfg.RetryMaxAttempts < 1 {
+		cfg.RetryMaxAttempts = 1
+	}
+
+	l.validate(cfg)
+	if len(l.errs) > 0 {
+		return nil, errors.Join(l.errs...)
+	}
+
+	if cfg.AllowInsecureAPIKey && cfg.APIKey == "" && len(cfg.APIKeys) == 0 {
+		cfg.APIKey = PlaceholderAPIKey
+	}
+	if cfg.AllowInsecureAPIKey && cfg.hasPlaceholderKey() {
+		slog.Warn("ALLOW_INSECURE_API_KEY is set, the placeholder API key is accepted", "api_key", PlaceholderAPIKey)
+	}
+	return cfg, nil
 }
 
-func Load() *Config {
-	// Load .env file
-	err := godotenv.Load()
+// KeysFile returns the configured API_KEYS_FILE, from the environment or
+// the config file at path, without loading and validating the rest of the
+// configuration.
+func KeysFile(path string) (string, error) {
+	l, _, err := newLoader(path)
 	if err != nil {
-		log.Println("Warning: .env file not found, using environment variables or defaults")
+		return "", err
 	}
+	return l.getEnv("API_KEYS_FILE", ""), nil
+}
+
+// newLoader loads .env, once, and reads the config file at path, or
+// CONFIG_FILE if path is empty. It returns the config file path used.
+func newLoader(path string) (*loader, string, error) {
+	// Load .env file, once: its variables stay in the environment
+	dotenv.Do(func() {
+		if err := godotenv.Load(); err != nil {
+			slog.Warn(".env file not found, using environment variables, the config file or defaults")
+		}
+	})
 
-	return &Config{
-		Port:        getEnv("PORT", "8080"),
-		APIKey:      getEnv("API_KEY", "sk-your-secret-api-key-here"),
-		OllamaURL:   getEnv("OLLAMA_URL", "http://localhost:11434"),
-		OllamaModel: getEnv("OLLAMA_MODEL", "llama3.2:latest"),
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	l := &loader{}
+	if path != "" {
+		var err error
+		if l.file, err = readFile(path); err != nil {
+			return nil, "", err
+		}
 	}
+	return l, path, nil
 }
 
-func getEnv(key, defaultValue string) string {
+// loader reads settings from the environment and the config file, and
+// collects the errors of invalid ones.
+type loader struct {
+	file *fileValues
+	errs []error
+}
+
+// lookup returns the environment variable key, or the config file setting
+// standing for it.
+func (l *loader) lookup(key string) (string, bool) {
 	if value := os.Getenv(key); value != "" {
+		return value, true
+	}
+	if l.file != nil {
+		if value := l.file.values[key]; value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// fail records an invalid setting, naming the environment variable or the
+// config file setting it came from.
+func (l *loader) fail(key, format string, args ...interface{}) {
+	source := key
+	if os.Getenv(key) == "" && l.file != nil {
+		if setting, ok := l.file.settings[key]; ok {
+			source = l.file.path + ": " + setting
+		}
+	}
+	l.errs = append(l.errs, fmt.Errorf("%s: %s", source, fmt.Sprintf(format, args...)))
+}
+
+func (l *loader) getEnv(key, defaultValue string) string {
+	if value, ok := l.lookup(key); ok {
 		return value
 	}
 	return defaultValue
 }
+
+func (l *loader) getEnvInt(key string, defaultValue int) int {
+	value, ok := l.lookup(key)
+	if !ok {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	switch {
+	case err != nil:
+		l.fail(key, "invalid integer %q", value)
+	case n < 0:
+		l.fail(key, "must not be negative, got %d", n)
+	default:
+		return n
+	}
+	return defaultValue
+}
+
+func (l *loader) getEnvFloat(key string, defaultValue float64) float64 {
+	value, ok := l.lookup(key)
+	if !ok {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		l.fail(key, "invalid number %q", value)
+		return defaultValue
+	}
+	return f
+}
+
+func (l *loader) getEnvBool(key string, defaultValue bool) bool {
+	value, ok := l.lookup(key)
+	if !ok {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		l.fail(key, "invalid boolean %q (want true or false)", value)
+		return defaultValue
+	}
+	return b
+}
+
+func (l *loader) getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, ok := l.lookup(key)
+	if !ok {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	switch {
+	case err != nil:
+		l.fail(key, "invalid duration %q (want a number with a unit, e.g. 500ms, 10s or 5m)", value)
+	case d < 0:
+		l.fail(key, "must not be negative, got %s", d)
+	default:
+		return d
+	}
+	return defaultValue
+}
+
+// getEnvList splits a comma separated setting, dropping empty entries.
+func (l *loader) getEnvList(key string) []string {
+	value, _ := l.lookup(key)
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvMap reads a list of "key=value" entries.
+func (l *loader) getEnvMap(key string) map[string]string {
+	m := make(map[string]string)
+	for _, entry := range l.getEnvList(key) {
+		k, v, ok := strings.Cut(entry, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			l.fail(key, "invalid entry %q (want name=value)", entry)
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// getEnvAPIKeys reads a list of "key" or "key:priority" entries.
+func (l *loader) getEnvAPIKeys(key string) []APIKey {
+	var keys []APIKey
+	for _, entry := range l.getEnvList(key) {
+		keys = append(keys, parseAPIKey(entry))
+	}
+	return keys
+}
+
+// parseAPIKey splits an entry at its first ":". Keys can't contain one, see
+// validateAPIKeys, so a key is never cut short into a priority.
+func parseAPIKey(entry string) APIKey {
+	key, priority, _ := strings.Cut(entry, ":")
+	return APIKey{Key: key, Priority: priority}
+}
+
+// getEnvUpstreams reads the upstreams named in listKey. Each one is
+// configured by <prefix><NAME>_URL, _API_KEY and _PREFIX, with the name
+// upper-cased and "-" replaced by "_".
+func (l *loader) getEnvUpstreams(listKey, prefix string) []Upstream {
+	var upstreams []Upstream
+	for _, name := range l.getEnvList(listKey) {
+		env := upstreamEnv(prefix, name)
+		upstreams = append(upstreams, Upstream{
+			Name:    name,
+			BaseURL: l.getEnv(env+"URL", ""),
+			APIKey:  l.getEnv(env+"API_KEY", ""),
+			Prefix:  l.getEnv(env+"PREFIX", name+"/"),
+		})
+	}
+	return upstreams
+}
+
+func upstreamEnv(prefix, name string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// sortedKeys returns the keys of m in order, for stable error messages.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
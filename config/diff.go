@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"openai-compatible/logging"
+)
+
+// Change is a setting that differs between two configurations, by its
+// Config field name. Old and New are printable, with API keys masked.
+type Change struct {
+	Setting string
+	Old     string
+	New     string
+}
+
+// Diff lists the settings that differ between old and new, in the order of
+// the Config fields.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	o, n := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := 0; i < o.NumField(); i++ {
+		name := o.Type().Field(i).Name
+		if reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			continue
+		}
+		changes = append(changes, Change{
+			Setting: name,
+			Old:     display(name, o.Field(i).Interface()),
+			New:     display(name, n.Field(i).Interface()),
+		})
+	}
+	return changes
+}
+
+// display formats a setting for the log, masking API keys.
+func display(name string, value interface{}) string {
+	switch v := value.(type) {
+	case []APIKey:
+		keys := make([]string, len(v))
+		for i, key := range v {
+			keys[i] = logging.MaskSecret(key.Key)
+			if key.Priority != "" {
+				keys[i] += ":" + key.Priority
+			}
+		}
+		return "[" + strings.Join(keys, " ") + "]"
+	case []Upstream:
+		upstreams := make([]string, len(v))
+		for i, u := range v {
+			upstreams[i] = fmt.Sprintf("%s=%s", u.Name, u.BaseURL)
+			if u.APIKey != "" {
+				upstreams[i] += " (key " + logging.MaskSecret(u.APIKey) + ")"
+			}
+		}
+		return "[" + strings.Join(upstreams, " ") + "]"
+	case string:
+		if name == "APIKey" {
+			return logging.MaskSecret(v)
+		}
+	}
+	return fmt.Sprint(value)
+}
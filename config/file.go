@@ -0,0 +1,384 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of config file settings.
+const (
+	scalar = iota
+	list   // a list of values, or a comma separated string
+	table  // name: value pairs, read like "name=value" entries
+)
+
+type setting struct {
+	env  string
+	kind int
+}
+
+// settings maps the config file settings to the environment variables
+// they stand for. auth.api_keys and the upstreams are decoded separately.
+var settings = map[string]setting{
+	"server.port":             {"PORT", scalar},
+	"server.shutdown_timeout": {"SHUTDOWN_TIMEOUT", scalar},
+	"server.tls.cert_file":    {"TLS_CERT_FILE", scalar},
+	"server.tls.key_file":     {"TLS_KEY_FILE", scalar},
+
+	"auth.api_key":                {"API_KEY", scalar},
+	"auth.api_keys":               {"API_KEYS", list},
+	"auth.keys_file":              {"API_KEYS_FILE", scalar},
+	"auth.allow_insecure_api_key": {"ALLOW_INSECURE_API_KEY", scalar},
+
+	"ollama.url":                   {"OLLAMA_URL", scalar},
+	"ollama.urls":                  {"OLLAMA_URLS", list},
+	"ollama.lb_strategy":           {"LB_STRATEGY", scalar},
+	"ollama.health_check_interval": {"HEALTH_CHECK_INTERVAL", scalar},
+	"ollama.stream_idle_timeout":   {"STREAM_IDLE_TIMEOUT", scalar},
+
+	"models.default":   {"OLLAMA_MODEL", scalar},
+	"models.aliases":   {"MODEL_ALIASES", table},
+	"models.routes":    {"MODEL_ROUTES", table},
+	"models.fallbacks": {"FALLBACK_MODELS", list},
+	"models.required":  {"REQUIRED_MODELS", list},
+
+	"upstreams.openai":   {"OPENAI_UPSTREAMS", list},
+	"upstreams.llamacpp": {"LLAMACPP_SERVERS", list},
+
+	"retries.max_attempts": {"RETRY_MAX_ATTEMPTS", scalar},
+	"retries.base_delay":   {"RETRY_BASE_DELAY", scalar},
+	"retries.max_delay":    {"RETRY_MAX_DELAY", scalar},
+
+	"circuit_breaker.failure_threshold": {"CB_FAILURE_THRESHOLD", scalar},
+	"circuit_breaker.open_duration":     {"CB_OPEN_DURATION", scalar},
+
+	"limits.max_parallel_per_model":   {"MAX_PARALLEL_PER_MODEL", scalar},
+	"limits.max_parallel_per_backend": {"MAX_PARALLEL_PER_BACKEND", scalar},
+	"limits.queue_size":               {"QUEUE_SIZE", scalar},
+	"limits.queue_timeout":            {"QUEUE_TIMEOUT", scalar},
+
+	"cache.backend":     {"CACHE_BACKEND", scalar},
+	"cache.ttl":         {"CACHE_TTL", scalar},
+	"cache.max_entries": {"CACHE_MAX_ENTRIES", scalar},
+	"cache.dir":         {"CACHE_DIR", scalar},
+
+	"semantic_cache.model":             {"SEMANTIC_CACHE_MODEL", scalar},
+	"semantic_cache.threshold":         {"SEMANTIC_CACHE_THRESHOLD", scalar},
+	"semantic_cache.ttl":               {"SEMANTIC_CACHE_TTL", scalar},
+	"semantic_cache.max_entries":       {"SEMANTIC_CACHE_MAX_ENTRIES", scalar},
+	"semantic_cache.max_total_entries": {"SEMANTIC_CACHE_MAX_TOTAL_ENTRIES", scalar},
+
+	"coalescing.requests": {"COALESCE_REQUESTS", scalar},
+	"coalescing.streams":  {"COALESCE_STREAMS", scalar},
+
+	"mock.enabled":     {"MOCK_PROVIDER", scalar},
+	"mock.script":      {"MOCK_SCRIPT", scalar},
+	"mock.latency":     {"MOCK_LATENCY", scalar},
+	"mock.token_delay": {"MOCK_TOKEN_DELAY", scalar},
+
+	"cassettes.mode":          {"CASSETTE_MODE", scalar},
+	"cassettes.dir":           {"CASSETTE_DIR", scalar},
+	"cassettes.replay_timing": {"CASSETTE_REPLAY_TIMING", scalar},
+
+	"readiness.cache_ttl": {"READINESS_CACHE_TTL", scalar},
+
+	"logging.level":        {"LOG_LEVEL", scalar},
+	"logging.privacy":      {"LOG_PRIVACY", scalar},
+	"logging.prompt_chars": {"LOG_PROMPT_CHARS", scalar},
+
+	"tracing.exporter":     {"TRACING_EXPORTER", scalar},
+	"tracing.service_name": {"OTEL_SERVICE_NAME", scalar},
+}
+
+// upstreamSettings are the fields of an entry of upstreams.openai and
+// upstreams.llamacpp, by the suffix of their environment variable.
+var upstreamSettings = map[string]string{
+	"name":    "",
+	"url":     "URL",
+	"api_key": "API_KEY",
+	"prefix":  "PREFIX",
+}
+
+// fileValues holds the settings of a config file as the values of the
+// environment variables they stand for.
+type fileValues struct {
+	path     string
+	values   map[string]string // environment variable -> value
+	settings map[string]string // environment variable -> setting, for errors
+	errs     []error
+}
+
+// readFile reads a YAML (.yaml, .yml) or TOML (.toml) config file. The
+// error is only set if the file can't be read or parsed; unknown settings
+// and values of the wrong shape are collected in errs.
+func readFile(path string) (*fileValues, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var doc map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("config file %s: unknown format %q, want .yaml, .yml or .toml", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	f := &fileValues{
+		path:     path,
+		values:   make(map[string]string),
+		settings: make(map[string]string),
+	}
+	f.walk("", doc)
+	return f, nil
+}
+
+func (f *fileValues) fail(name, format string, args ...interface{}) {
+	f.errs = append(f.errs, fmt.Errorf("%s: %s: %s", f.path, name, fmt.Sprintf(format, args...)))
+}
+
+func (f *fileValues) set(env, name, value string) {
+	f.values[env] = value
+	f.settings[env] = name
+}
+
+// walk decodes the settings of the section at prefix.
+func (f *fileValues) walk(prefix string, section map[string]interface{}) {
+	for _, key := range sortedKeys(section) {
+		name := prefix + key
+		value := section[key]
+		s, ok := settings[name]
+		switch {
+		case ok && name == "auth.api_keys":
+			f.apiKeys(name, value)
+		case ok && strings.HasPrefix(name, "upstreams."):
+			f.upstreams(name, s.env, value)
+		case ok:
+			f.setting(name, s, value)
+		case isSection(name):
+			sub, isMap := value.(map[string]interface{})
+			if !isMap {
+				f.fail(name, "is a section, want the settings %s", strings.Join(sectionKeys(name), ", "))
+				continue
+			}
+			f.walk(name+".", sub)
+		default:
+			f.fail(name, "unknown setting, valid ones are %s", strings.Join(sectionKeys(strings.TrimSuffix(prefix, ".")), ", "))
+		}
+	}
+}
+
+func (f *fileValues) setting(name string, s setting, value interface{}) {
+	switch s.kind {
+	case list:
+		if items, ok := value.([]interface{}); ok {
+			values := make([]string, 0, len(items))
+			for i, item := range items {
+				if v, ok := f.scalar(fmt.Sprintf("%s[%d]", name, i), item); ok {
+					values = append(values, v)
+				}
+			}
+			f.set(s.env, name, strings.Join(values, ","))
+			return
+		}
+	case table:
+		if m, ok := value.(map[string]interface{}); ok {
+			entries := make([]string, 0, len(m))
+			for _, k := range sortedKeys(m) {
+				if v, ok := f.scalar(name+"."+k, m[k]); ok {
+					entries = append(entries, k+"="+v)
+				}
+			}
+			f.set(s.env, name, strings.Join(entries, ","))
+			return
+		}
+		if value != nil {
+			f.fail(name, "is a %s, want name: value pairs", typeName(value))
+			return
+		}
+	}
+	if v, ok := f.scalar(name, value); ok {
+		f.set(s.env, name, v)
+	}
+}
+
+// apiKeys decodes auth.api_keys, a list of keys or of {key, priority}.
+func (f *fileValues) apiKeys(name string, value interface{}) {
+	items, ok := value.([]interface{})
+	if !ok {
+		f.setting(name, settings[name], value)
+		return
+	}
+	var entries []string
+	for i, item := range items {
+		itemName := fmt.Sprintf("%s[%d]", name, i)
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			if v, ok := f.scalar(itemName, item); ok {
+				entries = append(entries, v)
+			}
+			continue
+		}
+		var key, priority string
+		for _, k := range sortedKeys(m) {
+			v, ok := f.scalar(itemName+"."+k, m[k])
+			switch {
+			case !ok:
+			case k == "key":
+				key = v
+			case k == "priority":
+				priority = v
+			default:
+				f.fail(itemName+"."+k, "unknown setting, valid ones are key, priority")
+			}
+		}
+		if key == "" {
+			f.fail(itemName, "key is required")
+			continue
+		}
+		if priority != "" {
+			key += ":" + priority
+		}
+		entries = append(entries, key)
+	}
+	f.set("API_KEYS", name, strings.Join(entries, ","))
+}
+
+// upstreams decodes upstreams.openai or upstreams.llamacpp, a list of
+// {name, url, api_key, prefix}, into the variables read by getEnvUpstreams.
+func (f *fileValues) upstreams(name, listEnv string, value interface{}) {
+	items, ok := value.([]interface{})
+	if !ok {
+		f.fail(name, "is a %s, want a list of {name, url, api_key, prefix}", typeName(value))
+		return
+	}
+	prefix := "OPENAI_UPSTREAM_"
+	if listEnv == "LLAMACPP_SERVERS" {
+		prefix = "LLAMACPP_SERVER_"
+	}
+
+	var names []string
+	for i, item := range items {
+		itemName := fmt.Sprintf("%s[%d]", name, i)
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			f.fail(itemName, "is a %s, want {name, url, api_key, prefix}", typeName(item))
+			continue
+		}
+		upstreamName, _ := f.scalar(itemName+".name", m["name"])
+		if upstreamName == "" {
+			f.fail(itemName, "name is required")
+			continue
+		}
+		names = append(names, upstreamName)
+		env := upstreamEnv(prefix, upstreamName)
+		for _, k := range sortedKeys(m) {
+			suffix, known := upstreamSettings[k]
+			switch {
+			case !known:
+				f.fail(itemName+"."+k, "unknown setting, valid ones are %s", strings.Join(sortedKeys(upstreamSettings), ", "))
+			case suffix != "":
+				if v, ok := f.scalar(itemName+"."+k, m[k]); ok {
+					f.set(env+suffix, itemName+"."+k, v)
+				}
+			}
+		}
+	}
+	f.set(listEnv, name, strings.Join(names, ","))
+}
+
+// scalar converts a single value to the string its environment variable
+// would hold, expanding ${VAR} references in strings.
+func (f *fileValues) scalar(name string, value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return f.expand(name, v)
+	case map[string]interface{}, []interface{}:
+		f.fail(name, "is a %s, want a single value", typeName(value))
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// expand replaces ${VAR} and $VAR with the environment variable VAR, and
+// ${VAR:-default} with default if VAR is unset or empty. $$ is a literal $.
+// Referencing an unset variable without a default is an error.
+func (f *fileValues) expand(name, s string) (string, bool) {
+	var missing []string
+	expanded := os.Expand(s, func(ref string) string {
+		if ref == "$" {
+			return "$"
+		}
+		if v, def, ok := strings.Cut(ref, ":-"); ok {
+			if value := os.Getenv(v); value != "" {
+				return value
+			}
+			return def
+		}
+		value, ok := os.LookupEnv(ref)
+		if !ok {
+			missing = append(missing, ref)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		f.fail(name, "environment variable %s is not set (use ${%s:-default} for a default)", strings.Join(missing, ", "), missing[0])
+		return "", false
+	}
+	return expanded, true
+}
+
+// isSection reports whether name is a section of settings, like server.tls.
+func isSection(name string) bool {
+	for setting := range settings {
+		if strings.HasPrefix(setting, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionKeys lists the keys valid in a section, or at the top level if
+// section is empty.
+func sectionKeys(section string) []string {
+	prefix := ""
+	if section != "" {
+		prefix = section + "."
+	}
+	seen := make(map[string]bool)
+	for setting := range settings {
+		if rest, ok := strings.CutPrefix(setting, prefix); ok {
+			key, _, _ := strings.Cut(rest, ".")
+			seen[key] = true
+		}
+	}
+	return sortedKeys(seen)
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "section"
+	case []interface{}:
+		return "list"
+	case string:
+		return "string"
+	case nil:
+		return "null"
+	}
+	return "single value"
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadKeysFile reads API keys, one "key" or "key:priority" per line. Blank
+// lines and lines starting with # are skipped.
+func ReadKeysFile(path string) ([]APIKey, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	for _, line := range lines {
+		if key, ok := keyLine(line); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// AddKey appends key to the keys file at path, creating the file if it
+// doesn't exist. The file is only readable by its owner.
+func AddKey(path string, key APIKey) error {
+	lines, err := readLines(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entry := key.Key
+	if key.Priority != "" {
+		entry += ":" + key.Priority
+	}
+	return writeLines(path, append(lines, entry))
+}
+
+// RemoveKeys removes the keys matching match from the keys file at path,
+// keeping comments and the other keys, and returns how many were removed.
+func RemoveKeys(path string, match func(APIKey) bool) (int, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return 0, err
+	}
+	kept := lines[:0]
+	for _, line := range lines {
+		if key, ok := keyLine(line); ok && match(key) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	removed := len(lines) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, writeLines(path, kept)
+}
+
+func keyLine(line string) (APIKey, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return APIKey{}, false
+	}
+	return parseAPIKey(line), true
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// writeLines replaces the file at path by renaming a new file over it, so
+// a running server watching it never reads a partial file.
+func writeLines(path string, lines []string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	var content string
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("replacing keys file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"openai-compatible/cache"
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/tracing"
+)
+
+// validate checks the settings that parse but can't work. The load
+// balancing strategy and the cassette mode are checked by the services
+// using them.
+func (l *loader) validate(cfg *Config) {
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		l.fail("PORT", "invalid port %q (want 1-65535)", cfg.Port)
+	}
+
+	l.validateAPIKeys(cfg)
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		l.fail("TLS_CERT_FILE", "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	for _, key := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE"} {
+		if file := l.getEnv(key, ""); file != "" {
+			if _, err := os.Stat(file); err != nil {
+				l.fail(key, "%v", err)
+			}
+		}
+	}
+
+	l.validateURL("OLLAMA_URL", cfg.OllamaURL)
+	if _, ok := l.lookup("OLLAMA_URLS"); ok {
+		for _, u := range cfg.OllamaURLs {
+			l.validateURL("OLLAMA_URLS", u)
+		}
+	}
+	for _, u := range cfg.OpenAIUpstreams {
+		l.validateURL(upstreamEnv("OPENAI_UPSTREAM_", u.Name)+"URL", u.BaseURL)
+	}
+	for _, u := range cfg.LlamaCppServers {
+		l.validateURL(upstreamEnv("LLAMACPP_SERVER_", u.Name)+"URL", u.BaseURL)
+	}
+
+	for _, alias := range sortedKeys(cfg.ModelAliases) {
+		target := cfg.ModelAliases[alias]
+		switch {
+		case target == alias:
+			l.fail("MODEL_ALIASES", "alias %q points to itself", alias)
+		case cfg.ModelAliases[target] != "":
+			l.fail("MODEL_ALIASES", "alias %q points to the alias %q, aliases must name a model", alias, target)
+		}
+	}
+
+	// Zero can't work for these: a ticker would panic, a timeout would fire
+	// at once and a TTL would expire every entry as it is written.
+	positive := []struct {
+		key string
+		d   time.Duration
+		on  bool
+	}{
+		{"HEALTH_CHECK_INTERVAL", cfg.HealthCheckInterval, true},
+		{"QUEUE_TIMEOUT", cfg.QueueTimeout, true},
+		{"SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout, true},
+		{"CB_OPEN_DURATION", cfg.BreakerOpenDuration, cfg.BreakerThreshold > 0},
+		{"CACHE_TTL", cfg.CacheTTL, cfg.CacheBackend != cache.BackendNone},
+		{"SEMANTIC_CACHE_TTL", cfg.SemanticCacheTTL, cfg.SemanticCacheModel != ""},
+	}
+	for _, setting := range positive {
+		if setting.on && setting.d == 0 {
+			l.fail(setting.key, "must be positive, got 0s")
+		}
+	}
+
+	if _, err := logging.ParseLevel(cfg.LogLevel); err != nil {
+		l.fail("LOG_LEVEL", "%v", err)
+	}
+	if _, err := logging.ParsePrivacyLevel(cfg.LogPrivacy); err != nil {
+		l.fail("LOG_PRIVACY", "%v", err)
+	}
+
+	switch cfg.CacheBackend {
+	case cache.BackendNone, cache.BackendMemory, cache.BackendDisk:
+	default:
+		l.fail("CACHE_BACKEND", "unknown cache backend %q (want none, memory or disk)", cfg.CacheBackend)
+	}
+	if cfg.SemanticCacheModel != "" && (cfg.SemanticCacheThreshold <= 0 || cfg.SemanticCacheThreshold > 1) {
+		l.fail("SEMANTIC_CACHE_THRESHOLD", "must be in (0, 1], got %v", cfg.SemanticCacheThreshold)
+	}
+
+	switch cfg.TracingExporter {
+	case tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout:
+	default:
+		l.fail("TRACING_EXPORTER", "unknown exporter %q (want none, otlp or stdout)", cfg.TracingExporter)
+	}
+}
+
+// validateAPIKeys refuses the placeholder key and starting without any key,
+// unless ALLOW_INSECURE_API_KEY is set, and checks the keys and their
+// priorities. A ":" separates the priority in API_KEYS and the keys file, so
+// keys can't contain one.
+func (l *loader) validateAPIKeys(cfg *Config) {
+	if !cfg.AllowInsecureAPIKey {
+		if cfg.APIKey == "" && len(cfg.APIKeys) == 0 {
+			l.fail("API_KEY", "no API key is configured, set API_KEY, API_KEYS or API_KEYS_FILE (or ALLOW_INSECURE_API_KEY=true for local testing)")
+		}
+		if cfg.hasPlaceholderKey() {
+			l.fail("API_KEY", "the placeholder key %s must be replaced with a secret key (or set ALLOW_INSECURE_API_KEY=true for local testing)", PlaceholderAPIKey)
+		}
+	}
+	for _, key := range cfg.APIKeys {
+		if strings.Contains(key.Key, ":") || strings.Contains(key.Priority, ":") {
+			l.fail("API_KEYS", "entry %s: API keys can't contain \":\", which separates the priority", logging.MaskSecret(key.Key))
+			continue
+		}
+		if _, err := limiter.ParsePriority(key.Priority); err != nil {
+			l.fail("API_KEYS", "entry %s: %v", logging.MaskSecret(key.Key), err)
+		}
+	}
+}
+
+func (cfg *Config) hasPlaceholderKey() bool {
+	if cfg.APIKey == PlaceholderAPIKey {
+		return true
+	}
+	for _, key := range cfg.APIKeys {
+		if key.Key == PlaceholderAPIKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *loader) validateURL(key, value string) {
+	if value == "" {
+		l.fail(key, "a URL is required")
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		l.fail(key, "invalid URL %q (want http:// or https:// and a host)", value)
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRejectsZeroDurations(t *testing.T) {
+	t.Setenv("API_KEY", "sk-test-key-123456")
+	t.Setenv("HEALTH_CHECK_INTERVAL", "")
+	t.Setenv("QUEUE_TIMEOUT", "")
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	data := "ollama:\n  health_check_interval: 0s\nlimits:\n  queue_timeout: 0s\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("Load accepted a zero health check interval and queue timeout")
+	}
+	for _, want := range []string{
+		path + ": ollama.health_check_interval: must be positive",
+		path + ": limits.queue_timeout: must be positive",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't contain %q", err, want)
+		}
+	}
+}
+
+func TestLoadZeroDurationsOfDisabledFeatures(t *testing.T) {
+	t.Setenv("API_KEY", "sk-test-key-123456")
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("CACHE_BACKEND", "none")
+	t.Setenv("CACHE_TTL", "0s")
+	t.Setenv("STREAM_IDLE_TIMEOUT", "0s")
+
+	if _, err := Load(""); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+}
+
+func TestKeysFileWithoutKeys(t *testing.T) {
+	t.Setenv("API_KEY", "")
+	t.Setenv("API_KEYS", "")
+	t.Setenv("API_KEYS_FILE", "")
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	if err := os.WriteFile(path, []byte("auth:\n  keys_file: keys.txt\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(path); err == nil {
+		t.Fatal("Load accepted a configuration without keys")
+	}
+	file, err := KeysFile(path)
+	if err != nil {
+		t.Fatalf("KeysFile: %v", err)
+	}
+	if file != "keys.txt" {
+		t.Errorf("KeysFile = %q, want keys.txt", file)
+	}
+
+	t.Setenv("API_KEYS_FILE", "other.txt")
+	if file, _ := KeysFile(path); file != "other.txt" {
+		t.Errorf("KeysFile = %q, want the environment's other.txt", file)
+	}
+}
+
+func TestLoadRejectsKeysWithColons(t *testing.T) {
+	t.Setenv("API_KEY", "")
+	t.Setenv("API_KEYS_FILE", "")
+	t.Setenv("CONFIG_FILE", "")
+
+	t.Setenv("API_KEYS", "sk-batch-jobs:low,sk-chat:frontend:high")
+	_, err := Load("")
+	if err == nil || !strings.Contains(err.Error(), `can't contain ":"`) {
+		t.Fatalf("Load = %v, want the key with a colon rejected", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	data := "auth:\n  api_keys:\n    - key: \"sk-chat:frontend\"\n      priority: high\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("API_KEYS", "")
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), `can't contain ":"`) {
+		t.Fatalf("Load = %v, want the key with a colon in the file rejected", err)
+	}
+
+	t.Setenv("API_KEYS", "sk-batch-jobs:low,sk-chat-frontend:high,sk-plain")
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []APIKey{{"sk-batch-jobs", "low"}, {"sk-chat-frontend", "high"}, {"sk-plain", ""}}
+	if len(cfg.APIKeys) != len(want) {
+		t.Fatalf("keys = %+v, want %+v", cfg.APIKeys, want)
+	}
+	for i := range want {
+		if cfg.APIKeys[i] != want[i] {
+			t.Errorf("key %d = %+v, want %+v", i, cfg.APIKeys[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDelay is how long Watch waits for further changes before reporting
+// one. Editors often write a file in several steps, or replace it.
+const watchDelay = 250 * time.Millisecond
+
+// Watch sends on changed whenever one of files is written, created or
+// replaced, until ctx is done. The directories of the files are watched, so
+// files that are replaced by renaming, as editors and Kubernetes do, stay
+// watched. Empty paths are skipped.
+func Watch(ctx context.Context, files []string, changed chan<- struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	watched := make(map[string]bool)
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		path, err := filepath.Abs(file)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		watched[path] = true
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		timer := time.NewTimer(watchDelay)
+		timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case event := <-watcher.Events:
+				// Kubernetes swaps the ..data symlink of mounted ConfigMaps
+				if watched[filepath.Clean(event.Name)] || filepath.Base(event.Name) == "..data" {
+					timer.Reset(watchDelay)
+				}
+			case err := <-watcher.Errors:
+				slog.Warn("watching the config file failed", "error", err)
+			case <-timer.C:
+				select {
+				case changed <- struct{}{}:
+				default: // a reload is already pending
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,382 @@
+package conformance_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"openai-compatible/conformance"
+	"openai-compatible/gatewaytest"
+	"openai-compatible/ollamatest"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var update = flag.Bool("update", false, "rewrite REPORT.md")
+
+const reportFile = "REPORT.md"
+
+func TestMain(m *testing.M) {
+	gatewaytest.Main(m)
+}
+
+// newGateway starts a gateway in front of a fake Ollama, or of the mock
+// provider if mock is set.
+func newGateway(t *testing.T, mock bool) (*fiber.App, *ollamatest.Server) {
+	t.Helper()
+	srv, ollama := gatewaytest.New(t, map[string]string{
+		"RETRY_MAX_ATTEMPTS": "1",
+		"MOCK_PROVIDER":      fmt.Sprint(mock),
+	})
+	return srv.App, ollama
+}
+
+func marshal(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func chat(content string, extra map[string]any) map[string]any {
+	req := map[string]any{
+		"model":    gatewaytest.Model,
+		"messages": []any{map[string]any{"role": "user", "content": content}},
+	}
+	for key, value := range extra {
+		req[key] = value
+	}
+	return req
+}
+
+func completion(prompt any, extra map[string]any) map[string]any {
+	req := map[string]any{"model": gatewaytest.Model, "prompt": prompt}
+	for key, value := range extra {
+		req[key] = value
+	}
+	return req
+}
+
+var weatherTool = []any{map[string]any{
+	"type": "function",
+	"function": map[string]any{
+		"name":       "get_weather",
+		"parameters": map[string]any{"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}},
+	},
+}}
+
+// scenario is one request and the schema its response must follow. A
+// stream scenario validates every chunk against schema.
+type scenario struct {
+	name   string
+	mock   bool
+	method string
+	path   string
+	key    string
+	body   any
+	status int
+	schema string
+	stream bool
+	setup  func(*ollamatest.Server)
+}
+
+var scenarios = []scenario{
+	{name: "chat completion", body: chat("hello there", nil), schema: "CreateChatCompletionResponse"},
+	{name: "chat completion with content parts", body: chat("", map[string]any{
+		"messages": []any{map[string]any{"role": "user", "content": []any{map[string]any{"type": "text", "text": "hello"}}}},
+	}), schema: "CreateChatCompletionResponse"},
+	{name: "chat completion stream", body: chat("stream this", map[string]any{"stream": true}), schema: "CreateChatCompletionStreamResponse", stream: true},
+	{name: "chat completion stream failing upstream", body: chat("stream this", map[string]any{"stream": true}), schema: "CreateChatCompletionStreamResponse", stream: true,
+		setup: func(s *ollamatest.Server) {
+			s.Fail(gatewaytest.Model, ollamatest.Failure{Message: "model runner crashed", AfterChunks: 2})
+		}},
+	{name: "tool call", mock: true, body: chat("weather in Paris?", map[string]any{"tools": weatherTool, "tool_choice": "required"}), schema: "CreateChatCompletionResponse"},
+	{name: "tool call stream", mock: true, body: chat("weather in Paris?", map[string]any{"tools": weatherTool, "tool_choice": "required", "stream": true}), schema: "CreateChatCompletionStreamResponse", stream: true},
+	{name: "chat completion cut by max_tokens", mock: true, body: chat("one two three four five", map[string]any{"max_tokens": 2}), schema: "CreateChatCompletionResponse"},
+	{name: "chat completion stream cut by max_tokens", mock: true, body: chat("one two three four five", map[string]any{"max_tokens": 2, "stream": true}), schema: "CreateChatCompletionStreamResponse", stream: true},
+	{name: "completion", path: "/v1/completions", body: completion("once upon a time", nil), schema: "CreateCompletionResponse"},
+	{name: "completion with prompt array", path: "/v1/completions", body: completion([]string{"once upon", "a time"}, nil), schema: "CreateCompletionResponse"},
+	{name: "completion stream", path: "/v1/completions", body: completion("once upon a time", map[string]any{"stream": true}), schema: "CreateCompletionResponse", stream: true},
+	{name: "list models", method: http.MethodGet, path: "/v1/models", schema: "ListModelsResponse"},
+	{name: "list models (mock)", mock: true, method: http.MethodGet, path: "/v1/models", schema: "ListModelsResponse"},
+	{name: "error: missing API key", key: "-", body: chat("hello", nil), status: http.StatusUnauthorized, schema: "ErrorResponse"},
+	{name: "error: invalid API key", key: "sk-wrong-key-000000", body: chat("hello", nil), status: http.StatusUnauthorized, schema: "ErrorResponse"},
+	{name: "error: invalid JSON", body: "{", status: http.StatusBadRequest, schema: "ErrorResponse"},
+	{name: "error: missing model", body: map[string]any{"messages": []any{map[string]any{"role": "user", "content": "hi"}}}, status: http.StatusBadRequest, schema: "ErrorResponse"},
+	{name: "error: missing prompt", path: "/v1/completions", body: map[string]any{"model": gatewaytest.Model}, status: http.StatusBadRequest, schema: "ErrorResponse"},
+	{name: "error: unknown model", body: chat("hello", map[string]any{"model": "no-such-model"}), status: http.StatusNotFound, schema: "ErrorResponse"},
+	{name: "error: upstream failure", body: chat("hello", nil), status: http.StatusBadGateway, schema: "ErrorResponse",
+		setup: func(s *ollamatest.Server) {
+			s.Fail(gatewaytest.Model, ollamatest.Failure{Status: http.StatusInternalServerError, Message: "out of memory"})
+		}},
+}
+
+// probe is a sample value for a request parameter. with is added to both
+// the request with and without the parameter, for parameters that only
+// make sense together with another one.
+type probe struct {
+	value  any
+	with   map[string]any
+	stream bool
+}
+
+var chatProbes = map[string]probe{
+	"audio":                 {value: map[string]any{"voice": "alloy", "format": "mp3"}},
+	"frequency_penalty":     {value: 0.5},
+	"function_call":         {value: "none", with: map[string]any{"functions": []any{weatherTool[0].(map[string]any)["function"]}}},
+	"functions":             {value: []any{weatherTool[0].(map[string]any)["function"]}},
+	"logit_bias":            {value: map[string]any{"50256": -100}},
+	"logprobs":              {value: true},
+	"max_completion_tokens": {value: 5},
+	"max_tokens":            {value: 5},
+	"metadata":              {value: map[string]any{"team": "qa"}},
+	"modalities":            {value: []string{"text"}},
+	"n":                     {value: 2},
+	"parallel_tool_calls":   {value: false, with: map[string]any{"tools": weatherTool}},
+	"prediction":            {value: map[string]any{"type": "content", "content": "You said: hello"}},
+	"presence_penalty":      {value: 0.5},
+	"reasoning_effort":      {value: "low"},
+	"response_format":       {value: map[string]any{"type": "json_object"}},
+	"seed":                  {value: 42},
+	"service_tier":          {value: "auto"},
+	"stop":                  {value: []string{"\n"}},
+	"store":                 {value: true},
+	"stream_options":        {value: map[string]any{"include_usage": true}, stream: true},
+	"temperature":           {value: 0.2},
+	"tool_choice":           {value: "none", with: map[string]any{"tools": weatherTool}},
+	"tools":                 {value: weatherTool},
+	"top_logprobs":          {value: 2, with: map[string]any{"logprobs": true}},
+	"top_p":                 {value: 0.5},
+	"user":                  {value: "user-1234"},
+}
+
+var completionProbes = map[string]probe{
+	"best_of":           {value: 2},
+	"echo":              {value: true},
+	"frequency_penalty": {value: 0.5},
+	"logit_bias":        {value: map[string]any{"50256": -100}},
+	"logprobs":          {value: 2},
+	"max_tokens":        {value: 5},
+	"n":                 {value: 2},
+	"presence_penalty":  {value: 0.5},
+	"seed":              {value: 42},
+	"stop":              {value: []string{"\n"}},
+	"stream_options":    {value: map[string]any{"include_usage": true}, stream: true},
+	"suffix":            {value: "The end."},
+	"temperature":       {value: 0.2},
+	"top_p":             {value: 0.5},
+	"user":              {value: "user-1234"},
+}
+
+func TestConformance(t *testing.T) {
+	spec, err := conformance.LoadSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := conformance.NewReport(spec, "the fake Ollama server (`ollamatest`)", "the mock provider")
+
+	for _, sc := range scenarios {
+		runScenario(t, report, sc)
+	}
+	probeParameters(t, report, spec, "POST /v1/chat/completions", "CreateChatCompletionRequest", chatProbes, "/api/chat",
+		func(extra map[string]any) map[string]any { return chat("hello", extra) })
+	probeParameters(t, report, spec, "POST /v1/completions", "CreateCompletionRequest", completionProbes, "/api/generate",
+		func(extra map[string]any) map[string]any { return completion("hello", extra) })
+
+	got := report.Markdown()
+	if *update {
+		if err := os.WriteFile(reportFile, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("reading %s (run with -update to create it): %v", reportFile, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("conformance changed, review the differences and run go test ./conformance -update:\n--- got\n%s\n--- want\n%s", got, want)
+	}
+}
+
+func runScenario(t *testing.T, report *conformance.Report, sc scenario) {
+	t.Helper()
+
+	app, ollama := newGateway(t, sc.mock)
+	if sc.setup != nil {
+		sc.setup(ollama)
+	}
+	method, path, key := sc.method, sc.path, sc.key
+	if method == "" {
+		method = http.MethodPost
+	}
+	if path == "" {
+		path = "/v1/chat/completions"
+	}
+	switch key {
+	case "":
+		key = gatewaytest.Key
+	case "-":
+		key = ""
+	}
+	var body []byte
+	switch b := sc.body.(type) {
+	case nil:
+	case string:
+		body = []byte(b)
+	default:
+		body = marshal(t, b)
+	}
+	status := sc.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	resp, data := gatewaytest.Do(t, app, method, path, key, body)
+	if resp.StatusCode != status {
+		report.Add(sc.name, conformance.Deviation{
+			Kind:    conformance.Violation,
+			Path:    "HTTP status",
+			Message: fmt.Sprintf("is %d, want %d", resp.StatusCode, status),
+		})
+	}
+
+	contentType := resp.Header.Get(fiber.HeaderContentType)
+	if sc.stream && resp.StatusCode == http.StatusOK {
+		if !strings.HasPrefix(contentType, "text/event-stream") {
+			report.Add(sc.name, conformance.Deviation{Kind: conformance.Violation, Path: "Content-Type", Message: fmt.Sprintf("is %q, want text/event-stream, the response isn't streamed", contentType)})
+			return
+		}
+		checkStream(report, sc.name, sc.schema, data)
+		return
+	}
+	if !strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) {
+		report.Add(sc.name, conformance.Deviation{Kind: conformance.Violation, Path: "Content-Type", Message: fmt.Sprintf("is %q, want application/json", contentType)})
+	}
+	schema := sc.schema
+	if resp.StatusCode >= 400 {
+		schema = "ErrorResponse"
+	}
+	report.Check(sc.name, schema, data)
+}
+
+// checkStream validates the SSE framing of a stream and each of its chunks.
+// A stream ends with data: [DONE], or with an error event if it fails.
+func checkStream(report *conformance.Report, name, schema string, data []byte) {
+	framing := func(format string, args ...any) {
+		report.Add(name, conformance.Deviation{Kind: conformance.Violation, Path: "stream", Message: fmt.Sprintf(format, args...)})
+	}
+
+	events := strings.Split(strings.TrimSuffix(string(data), "\n\n"), "\n\n")
+	for i, event := range events {
+		payload, ok := strings.CutPrefix(event, "data: ")
+		if !ok {
+			framing("event %d isn't a data event", i)
+			continue
+		}
+		last := i == len(events)-1
+		switch {
+		case payload == "[DONE]":
+			if !last {
+				framing("data: [DONE] is followed by more events")
+			}
+		case strings.HasPrefix(payload, `{"error"`):
+			report.Check(name, "ErrorResponse", []byte(payload))
+			if !last {
+				framing("error event is followed by more events")
+			}
+		default:
+			report.Check(name, schema, []byte(payload))
+			if last {
+				framing("stream doesn't end with data: [DONE]")
+			}
+		}
+	}
+}
+
+var volatile = regexp.MustCompile(`,?"(id|created|request_id)":("[^"]*"|\d+)`)
+
+// probeParameters sends each parameter of a request schema to a gateway in
+// front of the fake Ollama and records whether it was forwarded, changed
+// the response, was ignored or was rejected.
+func probeParameters(t *testing.T, report *conformance.Report, spec *conformance.Spec, endpoint, schema string, probes map[string]probe, upstreamPath string, request func(map[string]any) map[string]any) {
+	t.Helper()
+
+	app, ollama := newGateway(t, false)
+	path := strings.TrimPrefix(endpoint, "POST ")
+
+	exchange := func(extra map[string]any) (int, []byte, []byte) {
+		resp, data := gatewaytest.Do(t, app, http.MethodPost, path, gatewaytest.Key, marshal(t, request(extra)))
+		return resp.StatusCode, volatile.ReplaceAll(data, nil), ollama.LastRequest(upstreamPath)
+	}
+
+	for _, name := range spec.Parameters(schema) {
+		param := conformance.Parameter{Endpoint: endpoint, Name: name}
+		p, ok := probes[name]
+		switch {
+		case name == "model" || name == "prompt" || name == "messages":
+			param.Status, param.Detail = conformance.Supported, "required"
+		case name == "stream":
+			param.Status, param.Detail = conformance.Supported, "covered by the stream scenarios"
+		case !ok:
+			t.Errorf("%s: no probe for parameter %q", endpoint, name)
+			continue
+		default:
+			base := map[string]any{}
+			for key, value := range p.with {
+				base[key] = value
+			}
+			if p.stream {
+				base["stream"] = true
+			}
+			_, wantBody, wantUpstream := exchange(base)
+
+			with := map[string]any{name: p.value}
+			for key, value := range base {
+				with[key] = value
+			}
+			status, body, upstream := exchange(with)
+
+			switch {
+			case status != http.StatusOK:
+				param.Status, param.Detail = conformance.Rejected, fmt.Sprintf("HTTP %d: %s", status, errorMessage(body))
+			case !sameJSON(upstream, wantUpstream):
+				param.Status, param.Detail = conformance.Supported, "forwarded to Ollama"
+			case !bytes.Equal(body, wantBody):
+				param.Status, param.Detail = conformance.Supported, "handled by the gateway"
+			default:
+				param.Status, param.Detail = conformance.Ignored, "accepted but not forwarded to Ollama and no effect on the response"
+			}
+		}
+		report.AddParameter(param)
+	}
+}
+
+func sameJSON(a, b []byte) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func errorMessage(body []byte) string {
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error.Message == "" {
+		return string(body)
+	}
+	return resp.Error.Message
+}
@@ -0,0 +1,233 @@
+package conformance
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Parameter statuses, see Report.AddParameter.
+const (
+	Supported = "supported"
+	Ignored   = "ignored"
+	Rejected  = "rejected"
+)
+
+// Parameter is the outcome of sending a request parameter to the gateway.
+type Parameter struct {
+	Endpoint string
+	Name     string
+	Status   string
+	Detail   string
+}
+
+// Finding is a deviation seen while running a scenario.
+type Finding struct {
+	Scenario string
+	Schema   string
+	Deviation
+}
+
+type scenario struct {
+	name      string
+	documents int
+}
+
+// Report collects the results of a conformance run and renders them as
+// Markdown.
+type Report struct {
+	spec       *Spec
+	backends   []string
+	scenarios  []*scenario
+	findings   []Finding
+	parameters []Parameter
+}
+
+// NewReport creates an empty report validating against spec. backends
+// names the fake backends the scenarios run against.
+func NewReport(spec *Spec, backends ...string) *Report {
+	return &Report{spec: spec, backends: backends}
+}
+
+// Check validates one response body or stream chunk of a scenario and
+// records its deviations. A body that isn't JSON is a violation.
+func (r *Report) Check(scenarioName, schema string, data []byte) []Deviation {
+	r.scenario(scenarioName).documents++
+	deviations, err := r.spec.Validate(schema, data)
+	if err != nil {
+		deviations = []Deviation{{Kind: Violation, Path: "$", Message: err.Error()}}
+	}
+	for _, d := range deviations {
+		r.findings = append(r.findings, Finding{Scenario: scenarioName, Schema: schema, Deviation: d})
+	}
+	return deviations
+}
+
+// Add records a deviation found outside of schema validation, such as
+// broken SSE framing or a wrong Content-Type.
+func (r *Report) Add(scenarioName string, d Deviation) {
+	r.scenario(scenarioName)
+	r.findings = append(r.findings, Finding{Scenario: scenarioName, Deviation: d})
+}
+
+// AddParameter records whether the gateway honours a request parameter.
+func (r *Report) AddParameter(p Parameter) {
+	r.parameters = append(r.parameters, p)
+}
+
+// Violations returns the number of recorded schema violations.
+func (r *Report) Violations() int {
+	n := 0
+	for _, f := range r.findings {
+		if f.Kind == Violation {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Report) scenario(name string) *scenario {
+	for _, s := range r.scenarios {
+		if s.name == name {
+			return s
+		}
+	}
+	s := &scenario{name: name}
+	r.scenarios = append(r.scenarios, s)
+	return s
+}
+
+var indexPattern = regexp.MustCompile(`\[\d+\]`)
+
+// group is a deviation repeated across array items or stream chunks.
+type group struct {
+	Finding
+	count     int
+	scenarios []string
+}
+
+// groups merges findings of the given kind that differ only in array
+// indices. With byScenario unset, findings of all scenarios are merged.
+func (r *Report) groups(kind string, byScenario bool) []*group {
+	var groups []*group
+	index := make(map[string]*group)
+	for _, f := range r.findings {
+		if f.Kind != kind {
+			continue
+		}
+		f.Path = indexPattern.ReplaceAllString(f.Path, "[]")
+		key := f.Schema + "\x00" + f.Path + "\x00" + f.Message
+		if byScenario {
+			key = f.Scenario + "\x00" + key
+		}
+		g, ok := index[key]
+		if !ok {
+			g = &group{Finding: f}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.count++
+		if !contains(g.scenarios, f.Scenario) {
+			g.scenarios = append(g.scenarios, f.Scenario)
+		}
+	}
+	return groups
+}
+
+// Markdown renders the report. The output only depends on the results, so
+// it can be kept in version control and diffed.
+func (r *Report) Markdown() []byte {
+	var b strings.Builder
+	violations := r.groups(Violation, true)
+	undocumented := r.groups(Undocumented, false)
+
+	b.WriteString("# OpenAI Conformance Report\n\n")
+	b.WriteString("Generated by `go test ./conformance -update`. Every response and stream chunk the gateway produced in the scenarios below was validated against the OpenAI OpenAPI specification ")
+	fmt.Fprintf(&b, "%s (the subset in `conformance/openapi.json`). The scenarios run against %s.\n\n", r.spec.Version, strings.Join(r.backends, " and "))
+
+	documents := 0
+	for _, s := range r.scenarios {
+		documents += s.documents
+	}
+	counts := make(map[string]int)
+	for _, p := range r.parameters {
+		counts[p.Status]++
+	}
+	b.WriteString("## Summary\n\n")
+	fmt.Fprintf(&b, "- %d scenarios, %d documents validated\n", len(r.scenarios), documents)
+	fmt.Fprintf(&b, "- Schema violations: %d (%d distinct)\n", r.Violations(), len(violations))
+	fmt.Fprintf(&b, "- Undocumented fields: %d\n", len(undocumented))
+	fmt.Fprintf(&b, "- Request parameters: %d supported, %d ignored, %d rejected\n\n", counts[Supported], counts[Ignored], counts[Rejected])
+
+	b.WriteString("## Scenarios\n\n")
+	b.WriteString("| Scenario | Documents | Violations |\n|---|---|---|\n")
+	for _, s := range r.scenarios {
+		n := 0
+		for _, f := range r.findings {
+			if f.Scenario == s.name && f.Kind == Violation {
+				n++
+			}
+		}
+		fmt.Fprintf(&b, "| %s | %d | %d |\n", s.name, s.documents, n)
+	}
+
+	b.WriteString("\n## Schema Violations\n\n")
+	if len(violations) == 0 {
+		b.WriteString("None.\n")
+	} else {
+		b.WriteString("Deviations from the schema that may break strict clients. Paths use `[]` for any array index, Count is the number of affected documents or items.\n\n")
+		b.WriteString("| Scenario | Schema | Path | Problem | Count |\n|---|---|---|---|---|\n")
+		for _, g := range violations {
+			fmt.Fprintf(&b, "| %s | %s | `%s` | %s | %d |\n", g.Scenario, orDash(g.Schema), g.Path, escape(g.Message), g.count)
+		}
+	}
+
+	b.WriteString("\n## Undocumented Fields\n\n")
+	if len(undocumented) == 0 {
+		b.WriteString("None.\n")
+	} else {
+		b.WriteString("Fields the schema doesn't define. The OpenAI SDKs ignore them.\n\n")
+		b.WriteString("| Schema | Path | Scenarios |\n|---|---|---|\n")
+		for _, g := range undocumented {
+			fmt.Fprintf(&b, "| %s | `%s` | %s |\n", g.Schema, g.Path, strings.Join(g.scenarios, ", "))
+		}
+	}
+
+	b.WriteString("\n## Request Parameters\n\n")
+	b.WriteString("Each parameter of the request schema was sent with a sample value and compared with a request without it. ")
+	b.WriteString("Supported parameters change the upstream request or the response, ignored ones are accepted and dropped, rejected ones fail the request.\n")
+	params := append([]Parameter(nil), r.parameters...)
+	sort.SliceStable(params, func(i, j int) bool { return params[i].Endpoint < params[j].Endpoint })
+	endpoint := ""
+	for _, p := range params {
+		if p.Endpoint != endpoint {
+			endpoint = p.Endpoint
+			fmt.Fprintf(&b, "\n### %s\n\n| Parameter | Status | Notes |\n|---|---|---|\n", endpoint)
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s |\n", p.Name, p.Status, escape(p.Detail))
+	}
+	return []byte(b.String())
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escape keeps a message from breaking the Markdown table it's written in.
+func escape(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", " ")
+}
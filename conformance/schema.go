@@ -0,0 +1,239 @@
+// Package conformance checks gateway responses against the OpenAI API
+// schema. The schemas of the implemented endpoints are embedded from a
+// subset of the OpenAI OpenAPI specification.
+package conformance
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var specJSON []byte
+
+const refPrefix = "#/components/schemas/"
+
+// Schema is the part of an OpenAPI 3.0 schema object the validator
+// understands.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Nullable             bool               `json:"nullable"`
+	Enum                 []interface{}      `json:"enum"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	OneOf                []*Schema          `json:"oneOf"`
+	AnyOf                []*Schema          `json:"anyOf"`
+}
+
+// Spec holds the component schemas of the embedded specification.
+type Spec struct {
+	Version string
+	schemas map[string]*Schema
+}
+
+// LoadSpec parses the embedded OpenAI specification.
+func LoadSpec() (*Spec, error) {
+	var doc struct {
+		Info struct {
+			Version string `json:"version"`
+		} `json:"info"`
+		Components struct {
+			Schemas map[string]*Schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(specJSON, &doc); err != nil {
+		return nil, fmt.Errorf("parsing OpenAPI specification: %w", err)
+	}
+	return &Spec{Version: doc.Info.Version, schemas: doc.Components.Schemas}, nil
+}
+
+// Parameters returns the sorted property names of a request schema.
+func (s *Spec) Parameters(schema string) []string {
+	var names []string
+	if sc, ok := s.schemas[schema]; ok {
+		for name := range sc.Properties {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Deviation kinds. A violation breaks the schema, an undocumented field is
+// one the schema doesn't define, which the SDKs ignore.
+const (
+	Violation    = "violation"
+	Undocumented = "undocumented field"
+)
+
+// Deviation is a difference between a JSON document and its schema.
+type Deviation struct {
+	Kind    string
+	Path    string
+	Message string
+}
+
+// Validate checks a JSON document against the named component schema.
+func (s *Spec) Validate(schema string, data []byte) ([]Deviation, error) {
+	root, ok := s.schemas[schema]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %q", schema)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	var deviations []Deviation
+	s.check(&deviations, "$", root, value)
+	return deviations, nil
+}
+
+func (s *Spec) resolve(sc *Schema) *Schema {
+	for sc.Ref != "" {
+		ref, ok := s.schemas[strings.TrimPrefix(sc.Ref, refPrefix)]
+		if !ok {
+			panic("conformance: unresolved reference " + sc.Ref)
+		}
+		sc = ref
+	}
+	return sc
+}
+
+func (s *Spec) check(out *[]Deviation, path string, sc *Schema, value interface{}) {
+	sc = s.resolve(sc)
+	violation := func(format string, args ...interface{}) {
+		*out = append(*out, Deviation{Kind: Violation, Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if value == nil {
+		if !sc.Nullable && sc.Type != "" {
+			violation("is null, want %s", sc.Type)
+		}
+		return
+	}
+
+	if alternatives := append(append([]*Schema(nil), sc.OneOf...), sc.AnyOf...); len(alternatives) > 0 {
+		for _, alt := range alternatives {
+			var sub []Deviation
+			s.check(&sub, path, alt, value)
+			if !hasViolation(sub) {
+				*out = append(*out, sub...)
+				return
+			}
+		}
+		violation("matches none of the allowed schemas")
+		return
+	}
+
+	if sc.Type != "" && !hasType(value, sc.Type) {
+		violation("is %s, want %s", typeOf(value), sc.Type)
+		return
+	}
+
+	if len(sc.Enum) > 0 && !inEnum(value, sc.Enum) {
+		violation("is %q, want one of %s", fmt.Sprint(value), enumList(sc.Enum))
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, name := range sc.Required {
+			if _, ok := value[name]; !ok {
+				*out = append(*out, Deviation{Kind: Violation, Path: path + "." + name, Message: "required field is missing"})
+			}
+		}
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field := path + "." + name
+			switch prop, ok := sc.Properties[name]; {
+			case ok:
+				s.check(out, field, prop, value[name])
+			case sc.AdditionalProperties != nil:
+				s.check(out, field, sc.AdditionalProperties, value[name])
+			case sc.Properties != nil:
+				*out = append(*out, Deviation{Kind: Undocumented, Path: field, Message: "not defined by the schema"})
+			}
+		}
+	case []interface{}:
+		if sc.Items != nil {
+			for i, item := range value {
+				s.check(out, fmt.Sprintf("%s[%d]", path, i), sc.Items, item)
+			}
+		}
+	}
+}
+
+func hasViolation(deviations []Deviation) bool {
+	for _, d := range deviations {
+		if d.Kind == Violation {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(value interface{}, want string) bool {
+	switch want {
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	default:
+		return typeOf(value) == want
+	}
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, v := range enum {
+		if fmt.Sprint(v) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, v := range enum {
+		values[i] = fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,117 @@
+// Package gatewaytest runs the whole gateway in-process for tests, in front
+// of a fake Ollama (ollamatest), and sends requests to it over HTTP.
+package gatewaytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"openai-compatible/config"
+	"openai-compatible/logging"
+	"openai-compatible/ollamatest"
+	"openai-compatible/server"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// Key is the API key the gateway accepts.
+	Key = "sk-test-key-123456"
+	// Model is the default model. The fake Ollama also serves OtherModel.
+	Model      = "llama3.2:latest"
+	OtherModel = "qwen2.5:7b"
+)
+
+// Main runs the tests of a package with logging turned down to errors.
+// Call it from TestMain.
+func Main(m *testing.M) {
+	logging.Setup(io.Discard, "error")
+	os.Exit(m.Run())
+}
+
+// New starts a fake Ollama and a gateway in front of it. env overrides the
+// test configuration, which has no cache, no coalescing, no mock and fast
+// retries. Both are stopped when the test ends.
+func New(t testing.TB, env map[string]string) (*server.Server, *ollamatest.Server) {
+	t.Helper()
+
+	ollama := ollamatest.NewServer(Model, OtherModel)
+	t.Cleanup(ollama.Close)
+
+	defaults := map[string]string{
+		"API_KEY":               Key,
+		"OLLAMA_URL":            ollama.URL,
+		"OLLAMA_URLS":           "",
+		"OLLAMA_MODEL":          Model,
+		"RETRY_MAX_ATTEMPTS":    "3",
+		"RETRY_BASE_DELAY":      "1ms",
+		"RETRY_MAX_DELAY":       "1ms",
+		"FALLBACK_MODELS":       "",
+		"CACHE_BACKEND":         "none",
+		"SEMANTIC_CACHE_MODEL":  "",
+		"COALESCE_REQUESTS":     "false",
+		"MOCK_PROVIDER":         "false",
+		"MOCK_SCRIPT":           "",
+		"MOCK_LATENCY":          "0s",
+		"MOCK_TOKEN_DELAY":      "0s",
+		"CASSETTE_MODE":         "",
+		"HEALTH_CHECK_INTERVAL": "1h",
+	}
+	for key, value := range env {
+		defaults[key] = value
+	}
+	for key, value := range defaults {
+		t.Setenv(key, value)
+	}
+
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("config.Load: %v", err)
+	}
+	srv, err := server.New(cfg)
+	if err != nil {
+		t.Fatalf("server.New: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	return srv, ollama
+}
+
+// Do sends a request through the app and returns the response with its
+// body read. A []byte body is sent as is, anything else as JSON.
+func Do(t testing.TB, app *fiber.App, method, path, key string, body any) (*http.Response, []byte) {
+	t.Helper()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
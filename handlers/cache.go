@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"openai-compatible/cache"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
+	"openai-compatible/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// cacheHeader tells clients whether a response was served from the cache.
+const cacheHeader = "X-Cache"
+
+// cacheLookup decides how a request uses the response cache. Only
+// deterministic requests (temperature 0) are cached. Cache-Control: no-cache
+// skips the lookup but still stores the fresh response, no-store skips both.
+type cacheLookup struct {
+	key    string
+	lookup bool
+	store  bool
+}
+
+func newCacheLookup(c *fiber.Ctx, responses *cache.Cache, temperature *float64, keyParts any) cacheLookup {
+	if responses == nil || temperature == nil || *temperature != 0 {
+		return cacheLookup{}
+	}
+
+	key, err := cache.Key(keyParts)
+	if err != nil {
+		return cacheLookup{}
+	}
+
+	noCache, noStore := cacheControl(c)
+	if noCache {
+		metrics.CacheRequests.WithLabelValues("bypass").Inc()
+	}
+	return cacheLookup{key: key, lookup: !noCache, store: !noStore}
+}
+
+// cacheControl reads the request's Cache-Control header. no-store implies
+// no-cache.
+func cacheControl(c *fiber.Ctx) (noCache, noStore bool) {
+	control := strings.ToLower(c.Get(fiber.HeaderCacheControl))
+	noStore = strings.Contains(control, "no-store")
+	noCache = noStore || strings.Contains(control, "no-cache")
+	return noCache, noStore
+}
+
+// get returns the cached response, setting the X-Cache header either way.
+func (l cacheLookup) get(c *fiber.Ctx, responses *cache.Cache) ([]byte, bool) {
+	if l.key == "" {
+		return nil, false
+	}
+	if l.lookup {
+		if data, ok := responses.Get(l.key); ok {
+			metrics.CacheRequests.WithLabelValues("hit").Inc()
+			c.Set(cacheHeader, "HIT")
+			return data, true
+		}
+		metrics.CacheRequests.WithLabelValues("miss").Inc()
+	}
+	c.Set(cacheHeader, "MISS")
+	return nil, false
+}
+
+func (l cacheLookup) set(ctx context.Context, responses *cache.Cache, resp any) {
+	if l.key == "" || !l.store {
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err == nil {
+		err = responses.Set(l.key, data)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("failed to store response in cache", "error", err)
+	}
+}
+
+// chatCacheKey is the canonical form of a chat request for the cache key.
+// It has every field a provider forwards except user, which only names the
+// end user and doesn't change the answer.
+type chatCacheKey struct {
+	Endpoint         string         `json:"endpoint"`
+	Model            string         `json:"model"`
+	Messages         []cacheMessage `json:"messages"`
+	MaxTokens        *int           `json:"max_tokens"`
+	Temperature      *float64       `json:"temperature"`
+	TopP             *float64       `json:"top_p"`
+	Stop             []string       `json:"stop"`
+	PresencePenalty  *float64       `json:"presence_penalty"`
+	FrequencyPenalty *float64       `json:"frequency_penalty"`
+	N                *int           `json:"n,omitempty"`
+	LogitBias        map[string]any `json:"logit_bias,omitempty"`
+	Logprobs         *bool          `json:"logprobs,omitempty"`
+	TopLogprobs      *int           `json:"top_logprobs,omitempty"`
+	Grammar          string         `json:"grammar,omitempty"`
+	IDSlot           *int           `json:"id_slot,omitempty"`
+	Tools            []models.Tool  `json:"tools,omitempty"`
+	ToolChoice       any            `json:"tool_choice,omitempty"`
+}
+
+type cacheMessage struct {
+	Role       string            `json:"role"`
+	Content    string            `json:"content"`
+	Name       string            `json:"name"`
+	ToolCalls  []models.ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string            `json:"tool_call_id,omitempty"`
+}
+
+// newChatCacheKey keys req under model, the model it resolves to, so an
+// alias shares its entries with the model it stands for.
+func newChatCacheKey(req *models.ChatCompletionRequest, model string) chatCacheKey {
+	messages := make([]cacheMessage, len(req.Messages))
+	for i, msg := range req.Messages {
+		messages[i] = cacheMessage{
+			Role:       msg.Role,
+			Content:    msg.GetContentAsString(),
+			Name:       msg.Name,
+			ToolCalls:  msg.ToolCalls,
+			ToolCallID: msg.ToolCallID,
+		}
+	}
+	return chatCacheKey{
+		Endpoint:         "chat",
+		Model:            model,
+		Messages:         messages,
+		MaxTokens:        req.MaxTokens,
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		Stop:             normalizeStop(req.Stop),
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		N:                req.N,
+		LogitBias:        req.LogitBias,
+		Logprobs:         req.Logprobs,
+		TopLogprobs:      req.TopLogprobs,
+		Grammar:          req.Grammar,
+		IDSlot:           req.IDSlot,
+		Tools:            req.Tools,
+		ToolChoice:       req.ToolChoice,
+	}
+}
+
+// completionCacheKey is the canonical form of a text completion request,
+// with the same fields left out as chatCacheKey.
+type completionCacheKey struct {
+	Endpoint         string   `json:"endpoint"`
+	Model            string   `json:"model"`
+	Prompt           any      `json:"prompt"`
+	MaxTokens        *int     `json:"max_tokens"`
+	Temperature      *float64 `json:"temperature"`
+	TopP             *float64 `json:"top_p"`
+	Stop             []string `json:"stop"`
+	PresencePenalty  *float64 `json:"presence_penalty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty"`
+	N                *int     `json:"n,omitempty"`
+	BestOf           *int     `json:"best_of,omitempty"`
+	Echo             *bool    `json:"echo,omitempty"`
+	Logprobs         *int     `json:"logprobs,omitempty"`
+	Grammar          string   `json:"grammar,omitempty"`
+	IDSlot           *int     `json:"id_slot,omitempty"`
+}
+
+// newCompletionCacheKey keys req under model, like newChatCacheKey.
+func newCompletionCacheKey(req *models.CompletionRequest, model string) completionCacheKey {
+	return completionCacheKey{
+		Endpoint:         "completion",
+		Model:            model,
+		Prompt:           req.Prompt,
+		MaxTokens:        req.MaxTokens,
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		Stop:             normalizeStop(req.Stop),
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		N:                req.N,
+		BestOf:           req.BestOf,
+		Echo:             req.Echo,
+		Logprobs:         req.Logprobs,
+		Grammar:          req.Grammar,
+		IDSlot:           req.IDSlot,
+	}
+}
+
+// normalizeStop turns the string or array forms of "stop" into a slice.
+func normalizeStop(stop interface{}) []string {
+	switch s := stop.(type) {
+	case string:
+		return []string{s}
+	case []interface{}:
+		out := make([]string, 0, len(s))
+		for _, item := range s {
+			if str, ok := item.(string); ok {
+				out = append(out, str)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+// streamRecorder rebuilds a chat completion from the SSE chunks of a stream
+// so it can be cached.
+type streamRecorder struct {
+	id           string
+	model        string
+	created      int64
+	content      strings.Builder
+	toolCalls    []models.ToolCall
+	finishReason string
+	done         bool
+	// malformed is set by chunks the recorder can't rebuild a response
+	// from, e.g. a tool call index out of order. Such streams aren't cached.
+	malformed bool
+}
+
+func (r *streamRecorder) add(data string) {
+	payload := strings.TrimSpace(strings.TrimPrefix(data, "data: "))
+	if payload == "[DONE]" {
+		r.done = true
+		return
+	}
+
+	var chunk models.ChatCompletionStreamResponse
+	if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+		return
+	}
+	r.id, r.model, r.created = chunk.ID, chunk.Model, chunk.Created
+	for _, choice := range chunk.Choices {
+		r.content.WriteString(choice.Delta.Content)
+		for _, call := range choice.Delta.ToolCalls {
+			if !r.addToolCall(call) {
+				r.malformed = true
+			}
+		}
+		if choice.FinishReason != nil {
+			r.finishReason = *choice.FinishReason
+		}
+	}
+}
+
+// addToolCall merges a tool call delta: the first delta of a call carries
+// its ID and name, later ones more of its arguments. Calls are indexed in
+// order, so it returns false for an index that is negative or skips ahead.
+func (r *streamRecorder) addToolCall(delta models.ToolCall) bool {
+	i := len(r.toolCalls)
+	if delta.Index != nil {
+		i = *delta.Index
+	}
+	if i < 0 || i > len(r.toolCalls) {
+		return false
+	}
+	if i == len(r.toolCalls) {
+		r.toolCalls = append(r.toolCalls, models.ToolCall{Type: "function"})
+	}
+	call := &r.toolCalls[i]
+	if delta.ID != "" {
+		call.ID = delta.ID
+	}
+	if delta.Type != "" {
+		call.Type = delta.Type
+	}
+	if delta.Function.Name != "" {
+		call.Function.Name = delta.Function.Name
+	}
+	call.Function.Arguments += delta.Function.Arguments
+	return true
+}
+
+func (r *streamRecorder) response(req *models.ChatCompletionRequest) *models.ChatCompletionResponse {
+	content := r.content.String()
+	var prompt strings.Builder
+	for _, msg := range req.Messages {
+		prompt.WriteString(msg.Role + ": " + msg.GetContentAsString() + "\n")
+	}
+
+	message := models.ChatMessage{Role: "assistant", Content: content, ToolCalls: r.toolCalls}
+	if content == "" && len(r.toolCalls) > 0 {
+		message.Content = nil
+	}
+
+	// Same rough estimate OllamaService uses, streams carry no usage.
+	promptTokens, completionTokens := prompt.Len()/4, len(content)/4
+	return &models.ChatCompletionResponse{
+		ID:      r.id,
+		Object:  "chat.completion",
+		Created: r.created,
+		Model:   r.model,
+		Choices: []models.ChatCompletionChoice{
+			{
+				Index:        0,
+				Message:      message,
+				FinishReason: r.finishReason,
+			},
+		},
+		Usage: models.ChatCompletionUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}
+}
+
+// replayStream writes a cached chat completion as SSE chunks, one per word.
+func replayStream(w *bufio.Writer, resp *models.ChatCompletionResponse) error {
+	write := func(chunk any) error {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := w.WriteString("data: " + string(data) + "\n\n"); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	chunk := func(content string, finishReason *string) models.ChatCompletionStreamResponse {
+		return models.ChatCompletionStreamResponse{
+			ID:      resp.ID,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   resp.Model,
+			Choices: []models.ChatCompletionStreamChoice{
+				{Index: 0, Delta: models.ChatCompletionStreamDelta{Content: content}, FinishReason: finishReason},
+			},
+		}
+	}
+
+	var content, finishReason string
+	var toolCalls []models.ToolCall
+	if len(resp.Choices) > 0 {
+		content = resp.Choices[0].Message.GetContentAsString()
+		toolCalls = resp.Choices[0].Message.ToolCalls
+		finishReason = resp.Choices[0].FinishReason
+	}
+	for _, word := range strings.SplitAfter(content, " ") {
+		if word == "" {
+			continue
+		}
+		if err := write(chunk(word, nil)); err != nil {
+			return err
+		}
+	}
+	if len(toolCalls) > 0 {
+		calls := chunk("", nil)
+		for i, call := range toolCalls {
+			index := i
+			call.Index = &index
+			calls.Choices[0].Delta.ToolCalls = append(calls.Choices[0].Delta.ToolCalls, call)
+		}
+		if err := write(calls); err != nil {
+			return err
+		}
+	}
+	if err := write(chunk("", &finishReason)); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("data: [DONE]\n\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"openai-compatible/cache"
+	"openai-compatible/models"
+)
+
+func TestStreamRecorderToolCalls(t *testing.T) {
+	var r streamRecorder
+	r.add(`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"weather","arguments":"{\"city\":"}}]}}]}`)
+	r.add(`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Oslo\"}"}}]}}]}`)
+	r.add(`data: {"choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_2","function":{"name":"time","arguments":"{}"}}]}}]}`)
+	r.add("data: [DONE]")
+
+	if r.malformed || len(r.toolCalls) != 2 {
+		t.Fatalf("malformed = %v, tool calls = %+v, want two calls", r.malformed, r.toolCalls)
+	}
+	if call := r.toolCalls[0]; call.ID != "call_1" || call.Function.Arguments != `{"city":"Oslo"}` {
+		t.Errorf("first call = %+v", call)
+	}
+}
+
+func TestStreamRecorderBadToolCallIndex(t *testing.T) {
+	for _, index := range []string{"-1", "1", "1000000000"} {
+		var r streamRecorder
+		r.add(`data: {"choices":[{"delta":{"tool_calls":[{"index":` + index + `,"id":"call_1","function":{"name":"weather"}}]}}]}`)
+		if !r.malformed || len(r.toolCalls) != 0 {
+			t.Errorf("index %s: malformed = %v, tool calls = %+v, want the call rejected", index, r.malformed, r.toolCalls)
+		}
+	}
+}
+
+// keyedFields returns the JSON names of the fields of a request type.
+func keyedFields(t *testing.T, req any) []string {
+	t.Helper()
+	var names []string
+	typ := reflect.TypeOf(req)
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		names = append(names, name)
+	}
+	return names
+}
+
+// Every request field but stream and user changes the cache key, so
+// requests differing only in a forwarded field don't share an answer.
+func TestCacheKeysCoverForwardedFields(t *testing.T) {
+	samples := map[string]string{
+		"model":             `"other"`,
+		"messages":          `[{"role":"user","content":"bye"}]`,
+		"prompt":            `"bye"`,
+		"max_tokens":        `5`,
+		"temperature":       `0.5`,
+		"top_p":             `0.5`,
+		"n":                 `2`,
+		"stop":              `["\n"]`,
+		"presence_penalty":  `0.5`,
+		"frequency_penalty": `0.5`,
+		"logit_bias":        `{"50256":-100}`,
+		"logprobs":          `true`,
+		"top_logprobs":      `2`,
+		"tools":             `[{"type":"function","function":{"name":"weather"}}]`,
+		"tool_choice":       `"required"`,
+		"grammar":           `"root ::= \"yes\""`,
+		"id_slot":           `1`,
+		"echo":              `true`,
+		"best_of":           `2`,
+	}
+	unkeyed := map[string]bool{"stream": true, "user": true}
+
+	tests := []struct {
+		name string
+		req  any
+		base string
+		key  func(data []byte) (string, error)
+	}{
+		{"chat", models.ChatCompletionRequest{}, `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, func(data []byte) (string, error) {
+			var req models.ChatCompletionRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				return "", err
+			}
+			return cache.Key(newChatCacheKey(&req, req.Model))
+		}},
+		{"completion", models.CompletionRequest{}, `{"model":"m","prompt":"hi"}`, func(data []byte) (string, error) {
+			var req models.CompletionRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				return "", err
+			}
+			return cache.Key(newCompletionCacheKey(&req, req.Model))
+		}},
+	}
+	for _, tt := range tests {
+		base, err := tt.key([]byte(tt.base))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range keyedFields(t, tt.req) {
+			if unkeyed[field] {
+				continue
+			}
+			sample, ok := samples[field]
+			if !ok {
+				t.Errorf("%s: no sample for %q, add one or leave it out of the key on purpose", tt.name, field)
+				continue
+			}
+			if field == "logprobs" && tt.name == "completion" {
+				sample = `2`
+			}
+			var req map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tt.base), &req); err != nil {
+				t.Fatal(err)
+			}
+			req[field] = json.RawMessage(sample)
+			data, _ := json.Marshal(req)
+			key, err := tt.key(data)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tt.name, field, err)
+			}
+			if key == base {
+				t.Errorf("%s: %s doesn't change the cache key", tt.name, field)
+			}
+		}
+	}
+}
+
+func chatKey(t *testing.T, req *models.ChatCompletionRequest) string {
+	t.Helper()
+	key, err := cache.Key(newChatCacheKey(req, req.Model))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestChatCacheKey(t *testing.T) {
+	zero, half, yes := 0.0, 0.5, true
+	base := func() *models.ChatCompletionRequest {
+		return &models.ChatCompletionRequest{
+			Model:       "llama3.2",
+			Messages:    []models.ChatMessage{{Role: "user", Content: "hi"}},
+			Temperature: &zero,
+			Stop:        "\n",
+		}
+	}
+	key := chatKey(t, base())
+
+	same := base()
+	same.User, same.Stream = "alice", &yes
+	same.Stop = []interface{}{"\n"}
+	same.Messages[0].Content = []interface{}{map[string]interface{}{"type": "text", "text": "hi"}}
+	if chatKey(t, same) != key {
+		t.Error("user, stream or the form of stop and content changed the key")
+	}
+
+	other := base()
+	other.TopP = &half
+	if chatKey(t, other) == key {
+		t.Error("top_p didn't change the key")
+	}
+	other = base()
+	other.Model = "qwen2.5"
+	if chatKey(t, other) == key {
+		t.Error("the model didn't change the key")
+	}
+}
+
+// A stream replayed from the cache records to the response it came from.
+func TestReplayStreamRoundTrip(t *testing.T) {
+	resp := &models.ChatCompletionResponse{
+		ID:      "chatcmpl-1",
+		Model:   "llama3.2",
+		Choices: []models.ChatCompletionChoice{{Message: models.ChatMessage{Role: "assistant", Content: "Hello there, friend"}, FinishReason: "length"}},
+	}
+	var buf bytes.Buffer
+	if err := replayStream(bufio.NewWriter(&buf), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	var recorder streamRecorder
+	for _, event := range strings.SplitAfter(buf.String(), "\n\n") {
+		if event != "" {
+			recorder.add(event)
+		}
+	}
+	if !recorder.done {
+		t.Fatalf("stream %q has no [DONE]", buf.String())
+	}
+	got := recorder.response(&models.ChatCompletionRequest{Messages: []models.ChatMessage{{Role: "user", Content: "hi"}}})
+	if got.ID != resp.ID || got.Model != resp.Model || got.Choices[0].Message.Content != "Hello there, friend" || got.Choices[0].FinishReason != "length" {
+		t.Errorf("recorded %+v, want %+v", got, resp)
+	}
+}
@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
-	"log"
 
+	"openai-compatible/cache"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
 	"openai-compatible/models"
 	"openai-compatible/services"
 
@@ -12,79 +15,84 @@ import (
 )
 
 type ChatHandler struct {
-	ollamaService *services.OllamaService
+	provider services.Provider
+	cache    *cache.Cache
+	semantic *cache.Semantic
+	flights  *Flights
 }
 
-func NewChatHandler(ollamaService *services.OllamaService) *ChatHandler {
+// NewChatHandler creates the chat handler. responses, semantic and flights
+// may be nil to disable the response cache, the semantic cache and request
+// coalescing.
+func NewChatHandler(provider services.Provider, responses *cache.Cache, semantic *cache.Semantic, flights *Flights) *ChatHandler {
 	return &ChatHandler{
-		ollamaService: ollamaService,
+		provider: provider,
+		cache:    responses,
+		semantic: semantic,
+		flights:  flights,
 	}
 }
 
 func (h *ChatHandler) ChatCompletions(c *fiber.Ctx) error {
-	// Log the raw request body for debugging
-	body := c.Body()
-	log.Printf("Received request body: %s", string(body))
-	log.Printf("Content-Type: %s", c.Get("Content-Type"))
-	log.Printf("Authorization: %s", c.Get("Authorization"))
+	logger := logging.FromContext(c.UserContext())
 
 	var req models.ChatCompletionRequest
 	if err := c.BodyParser(&req); err != nil {
-		log.Printf("JSON parsing error: %v", err)
-		return c.Status(400).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: fmt.Sprintf("Invalid request body: %v", err),
-				Type:    "invalid_request_error",
-				Code:    "invalid_json",
-			},
-		})
+		logger.Warn("invalid chat completion request", "error", err)
+		return sendError(c, 400, fmt.Sprintf("Invalid request body: %v", err), "invalid_request_error", "invalid_json")
 	}
 
-	log.Printf("Parsed request: Model=%s, Messages=%d", req.Model, len(req.Messages))
+	logger.Debug("parsed chat completion request", "model", req.Model, "messages", len(req.Messages))
+	model := services.ResolveModel(h.provider, req.Model)
+	metrics.SetModel(c, model)
 
 	// Validate required fields
 	if req.Model == "" {
-		return c.Status(400).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: "Model is required",
-				Type:    "invalid_request_error",
-				Code:    "missing_model",
-			},
-		})
+		return sendParamError(c, 400, "Model is required", "invalid_request_error", "missing_model", "model")
 	}
 
 	if len(req.Messages) == 0 {
-		return c.Status(400).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: "Messages are required",
-				Type:    "invalid_request_error",
-				Code:    "missing_messages",
-			},
-		})
+		return sendParamError(c, 400, "Messages are required", "invalid_request_error", "missing_messages", "messages")
 	}
 
+	key := newChatCacheKey(&req, model)
+	cached := newCacheLookup(c, h.cache, req.Temperature, key)
+
 	// Check if streaming is requested
 	if req.Stream != nil && *req.Stream {
-		return h.handleStreamingChat(c, &req)
+		return h.handleStreamingChat(c, &req, key, cached)
+	}
+
+	if data, ok := cached.get(c, h.cache); ok {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(data)
+	}
+
+	similar := newSemanticLookup(c, h.semantic, &req, key)
+	if data, ok := similar.get(c, h.semantic); ok {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(data)
 	}
 
 	// Handle non-streaming request
-	resp, err := h.ollamaService.ChatCompletion(&req)
+	ctx, done := requestContext(c)
+	defer done()
+
+	resp, err := h.flights.chatCompletion(ctx, c, h.provider, &req, key)
 	if err != nil {
-		log.Printf("Error in chat completion: %v", err)
-		return c.Status(500).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: "Internal server error",
-				Type:    "internal_error",
-				Code:    "ollama_error",
-			},
-		})
+		if shuttingDown(ctx) {
+			return sendShutdownError(c)
+		}
+		logger.Error("chat completion failed", "model", req.Model, "error", err)
+		return sendServiceError(c, err)
 	}
 
+	cached.set(ctx, h.cache, resp)
+	similar.set(ctx, h.semantic, resp)
 	return c.JSON(resp)
 }
 
-func (h *ChatHandler) handleStreamingChat(c *fiber.Ctx, req *models.ChatCompletionRequest) error {
+func (h *ChatHandler) handleStreamingChat(c *fiber.Ctx, req *models.ChatCompletionRequest, key chatCacheKey, cached cacheLookup) error {
 	// Set headers for Server-Sent Events
 	c.Set("Content-Type", "text/event-stream")
 	c.Set("Cache-Control", "no-cache")
@@ -92,36 +100,91 @@ func (h *ChatHandler) handleStreamingChat(c *fiber.Ctx, req *models.ChatCompleti
 	c.Set("Access-Control-Allow-Origin", "*")
 	c.Set("Access-Control-Allow-Headers", "Cache-Control")
 
-	streamChan, err := h.ollamaService.ChatCompletionStream(req)
+	if data, ok := cached.get(c, h.cache); ok && sendCachedStream(c, data) {
+		return nil
+	}
+	similar := newSemanticLookup(c, h.semantic, req, key)
+	if data, ok := similar.get(c, h.semantic); ok && sendCachedStream(c, data) {
+		return nil
+	}
+
+	// The stream writer runs after this handler returns, so capture the
+	// request scoped context now. Calling done aborts the Ollama request.
+	ctx, done := requestContext(c)
+	logger := logging.FromContext(ctx)
+
+	events, err := h.flights.chatCompletionStream(ctx, c, h.provider, req, key)
 	if err != nil {
-		log.Printf("Error in streaming chat completion: %v", err)
-		return c.Status(500).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: "Internal server error",
-				Type:    "internal_error",
-				Code:    "ollama_stream_error",
-			},
-		})
+		done()
+		logger.Error("streaming chat completion failed", "model", req.Model, "error", err)
+		return sendServiceError(c, err)
 	}
 
+	metrics.InflightStreams.Inc()
 	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer metrics.InflightStreams.Dec()
+		// Stops the producer and the upstream request if we bail out early,
+		// e.g. because the client hung up.
+		defer done()
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("Recovered from panic in stream writer: %v", r)
+				logger.Error("recovered from panic in stream writer", "panic", r)
 			}
 		}()
 
-		for data := range streamChan {
-			if _, err := w.WriteString(data); err != nil {
-				log.Printf("Error writing stream data: %v", err)
-				break
+		var recorder streamRecorder
+		for event := range events {
+			if event.Err != nil {
+				writeSSEError(w, serviceErrorDetail(ctx, event.Err))
+				return
+			}
+			if cached.store || similar.store {
+				recorder.add(event.Data)
+			}
+			if _, err := w.WriteString(event.Data); err != nil {
+				logger.Warn("error writing stream data", "error", err)
+				return
 			}
 			if err := w.Flush(); err != nil {
-				log.Printf("Error flushing stream: %v", err)
-				break
+				logger.Warn("error flushing stream", "error", err)
+				return
 			}
 		}
+
+		if recorder.done && !recorder.malformed {
+			resp := recorder.response(req)
+			cached.set(ctx, h.cache, resp)
+			similar.set(ctx, h.semantic, resp)
+		}
+
+		if shuttingDown(ctx) {
+			writeSSEError(w, models.ErrorDetail{
+				Message:   "The server is shutting down, please retry the request",
+				Type:      "server_error",
+				Code:      "server_shutdown",
+				RequestID: logging.RequestID(ctx),
+			})
+		}
 	})
 
 	return nil
 }
+
+// sendCachedStream replays a cached chat completion as a stream. It returns
+// false if the cached response can't be decoded.
+func sendCachedStream(c *fiber.Ctx, data []byte) bool {
+	var resp models.ChatCompletionResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		c.Set(cacheHeader, "MISS")
+		c.Context().Response.Header.Del(similarityHeader)
+		return false
+	}
+
+	logger := logging.FromContext(c.UserContext())
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := replayStream(w, &resp); err != nil {
+			logger.Warn("error replaying cached stream", "error", err)
+		}
+	})
+	return true
+}
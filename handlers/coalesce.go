@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"openai-compatible/cache"
+	"openai-compatible/coalesce"
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
+	"openai-compatible/models"
+	"openai-compatible/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// coalescedHeader marks responses that were shared with an identical
+// request already in flight.
+const coalescedHeader = "X-Coalesced"
+
+// Flights deduplicates identical requests that run at the same time, so only
+// one of them reaches Ollama and every caller gets its result. A nil *Flights
+// disables coalescing.
+//
+// The shared call is admitted by the limiter under the API key of the caller
+// that started it. Only callers of the same priority share a call, and when
+// the limiter rejected it the others ask for a slot of their own instead of
+// failing with a rejection that wasn't theirs.
+type Flights struct {
+	chat        *coalesce.Group[*models.ChatCompletionResponse]
+	chatStreams *coalesce.StreamGroup[services.StreamEvent] // nil unless streams are coalesced
+	completions *coalesce.Group[*models.CompletionResponse]
+}
+
+// NewFlights coalesces non-streaming requests, and streaming chat requests
+// too if streams is set.
+func NewFlights(streams bool) *Flights {
+	f := &Flights{
+		chat:        coalesce.NewGroup[*models.ChatCompletionResponse](),
+		completions: coalesce.NewGroup[*models.CompletionResponse](),
+	}
+	if streams {
+		f.chatStreams = coalesce.NewStreamGroup[services.StreamEvent]()
+	}
+	return f
+}
+
+// flightKey identifies identical requests of the same priority. Requests we
+// can't key aren't coalesced.
+func flightKey(ctx context.Context, keyParts any) (string, bool) {
+	key, err := cache.Key(struct {
+		Priority limiter.Priority `json:"priority"`
+		Request  any              `json:"request"`
+	}{limiter.ClientFromContext(ctx).Priority, keyParts})
+	if err != nil {
+		logging.FromContext(ctx).Warn("cannot coalesce request", "error", err)
+		return "", false
+	}
+	return key, true
+}
+
+// rejectedForOther reports whether a shared call failed because the limiter
+// turned away the caller that started it.
+func rejectedForOther(shared bool, err error) bool {
+	var rejected *limiter.RejectedError
+	return shared && errors.As(err, &rejected)
+}
+
+func markCoalesced(c *fiber.Ctx, endpoint string, shared bool) {
+	if shared {
+		c.Set(coalescedHeader, "true")
+		metrics.CoalescedRequests.WithLabelValues(endpoint).Inc()
+	}
+}
+
+func (f *Flights) chatCompletion(ctx context.Context, c *fiber.Ctx, svc services.Provider, req *models.ChatCompletionRequest, keyParts chatCacheKey) (*models.ChatCompletionResponse, error) {
+	if f == nil {
+		return svc.ChatCompletion(ctx, req)
+	}
+	key, ok := flightKey(ctx, keyParts)
+	if !ok {
+		return svc.ChatCompletion(ctx, req)
+	}
+	resp, shared, err := f.chat.Do(ctx, key, func(ctx context.Context) (*models.ChatCompletionResponse, error) {
+		return svc.ChatCompletion(ctx, req)
+	})
+	if rejectedForOther(shared, err) {
+		return svc.ChatCompletion(ctx, req)
+	}
+	markCoalesced(c, "chat", shared)
+	return resp, err
+}
+
+func (f *Flights) chatCompletionStream(ctx context.Context, c *fiber.Ctx, svc services.Provider, req *models.ChatCompletionRequest, keyParts chatCacheKey) (<-chan services.StreamEvent, error) {
+	if f == nil || f.chatStreams == nil {
+		return svc.ChatCompletionStream(ctx, req)
+	}
+	key, ok := flightKey(ctx, keyParts)
+	if !ok {
+		return svc.ChatCompletionStream(ctx, req)
+	}
+	events, shared, err := f.chatStreams.Subscribe(ctx, key, func(ctx context.Context) (<-chan services.StreamEvent, error) {
+		return svc.ChatCompletionStream(ctx, req)
+	})
+	if rejectedForOther(shared, err) {
+		return svc.ChatCompletionStream(ctx, req)
+	}
+	markCoalesced(c, "chat_stream", shared)
+	return events, err
+}
+
+func (f *Flights) completion(ctx context.Context, c *fiber.Ctx, svc services.Provider, req *models.CompletionRequest, keyParts completionCacheKey) (*models.CompletionResponse, error) {
+	if f == nil {
+		return svc.Completion(ctx, req)
+	}
+	key, ok := flightKey(ctx, keyParts)
+	if !ok {
+		return svc.Completion(ctx, req)
+	}
+	resp, shared, err := f.completions.Do(ctx, key, func(ctx context.Context) (*models.CompletionResponse, error) {
+		return svc.Completion(ctx, req)
+	})
+	if rejectedForOther(shared, err) {
+		return svc.Completion(ctx, req)
+	}
+	markCoalesced(c, "completions", shared)
+	return resp, err
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/models"
+	"openai-compatible/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// chatProvider serves chat completions with chat. Other methods aren't used.
+type chatProvider struct {
+	services.Provider
+	calls atomic.Int32
+	chat  func(ctx context.Context, call int32) (*models.ChatCompletionResponse, error)
+}
+
+func (p *chatProvider) ChatCompletion(ctx context.Context, req *models.ChatCompletionRequest) (*models.ChatCompletionResponse, error) {
+	return p.chat(ctx, p.calls.Add(1))
+}
+
+// newCoalescingApp serves chat completions through p with coalescing on.
+// The X-Client and X-Priority headers set the limiter client.
+func newCoalescingApp(p services.Provider) *fiber.App {
+	logging.Setup(io.Discard, "error")
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		priority, _ := limiter.ParsePriority(c.Get("X-Priority"))
+		client := limiter.Client{ID: c.Get("X-Client"), Priority: priority}
+		c.SetUserContext(limiter.WithClient(c.UserContext(), client))
+		return c.Next()
+	})
+	app.Post("/v1/chat/completions", NewChatHandler(p, nil, nil, NewFlights(false)).ChatCompletions)
+	return app
+}
+
+// post sends the same chat request as client, returning the status code.
+func post(t *testing.T, app *fiber.App, client, priority string) int {
+	t.Helper()
+	body := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Client", client)
+	req.Header.Set("X-Priority", priority)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func chatResponse() *models.ChatCompletionResponse {
+	return &models.ChatCompletionResponse{ID: "chatcmpl-1", Object: "chat.completion", Model: "m"}
+}
+
+func TestCoalescedFollowerAdmittedOnItsOwn(t *testing.T) {
+	release := make(chan struct{})
+	p := &chatProvider{chat: func(ctx context.Context, call int32) (*models.ChatCompletionResponse, error) {
+		if call == 1 {
+			<-release
+			return nil, &limiter.RejectedError{Err: limiter.ErrQueueTimeout, RetryAfter: time.Second}
+		}
+		return chatResponse(), nil
+	}}
+	app := newCoalescingApp(p)
+
+	var wg sync.WaitGroup
+	var leader, follower int
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		leader = post(t, app, "a", "normal")
+	}()
+	waitCalls(t, p, 1)
+	go func() {
+		defer wg.Done()
+		follower = post(t, app, "b", "normal")
+	}()
+	// Give the follower time to join the call before it fails.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if leader != http.StatusServiceUnavailable {
+		t.Errorf("leader: status = %d, want 503", leader)
+	}
+	if follower != http.StatusOK {
+		t.Errorf("follower: status = %d, want 200 from its own call", follower)
+	}
+	if n := p.calls.Load(); n != 2 {
+		t.Errorf("provider got %d calls, want 2", n)
+	}
+}
+
+func TestCoalescingKeepsPrioritiesApart(t *testing.T) {
+	release := make(chan struct{})
+	p := &chatProvider{chat: func(ctx context.Context, call int32) (*models.ChatCompletionResponse, error) {
+		<-release
+		return chatResponse(), nil
+	}}
+	app := newCoalescingApp(p)
+
+	var wg sync.WaitGroup
+	for _, priority := range []string{"low", "high"} {
+		wg.Add(1)
+		go func(priority string) {
+			defer wg.Done()
+			if status := post(t, app, priority, priority); status != http.StatusOK {
+				t.Errorf("%s priority: status = %d, want 200", priority, status)
+			}
+		}(priority)
+	}
+	// Both requests reach the provider while the first is still running.
+	waitCalls(t, p, 2)
+	close(release)
+	wg.Wait()
+}
+
+// waitCalls blocks until the provider was called n times.
+func waitCalls(t *testing.T, p *chatProvider, n int32) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for p.calls.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("provider got %d calls, want %d", p.calls.Load(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
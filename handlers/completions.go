@@ -1,8 +1,9 @@
 package handlers
 
 import (
-	"log"
-
+	"openai-compatible/cache"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
 	"openai-compatible/models"
 	"openai-compatible/services"
 
@@ -10,60 +11,59 @@ import (
 )
 
 type CompletionsHandler struct {
-	ollamaService *services.OllamaService
+	provider services.Provider
+	cache    *cache.Cache
+	flights  *Flights
 }
 
-func NewCompletionsHandler(ollamaService *services.OllamaService) *CompletionsHandler {
+// NewCompletionsHandler creates the completions handler. responses and
+// flights may be nil to disable the response cache and request coalescing.
+func NewCompletionsHandler(provider services.Provider, responses *cache.Cache, flights *Flights) *CompletionsHandler {
 	return &CompletionsHandler{
-		ollamaService: ollamaService,
+		provider: provider,
+		cache:    responses,
+		flights:  flights,
 	}
 }
 
 func (h *CompletionsHandler) Completions(c *fiber.Ctx) error {
 	var req models.CompletionRequest
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: "Invalid request body",
-				Type:    "invalid_request_error",
-				Code:    "invalid_json",
-			},
-		})
+		return sendError(c, 400, "Invalid request body", "invalid_request_error", "invalid_json")
 	}
 
 	// Validate required fields
 	if req.Model == "" {
-		return c.Status(400).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: "Model is required",
-				Type:    "invalid_request_error",
-				Code:    "missing_model",
-			},
-		})
+		return sendParamError(c, 400, "Model is required", "invalid_request_error", "missing_model", "model")
 	}
 
+	model := services.ResolveModel(h.provider, req.Model)
+	metrics.SetModel(c, model)
+
 	if req.Prompt == nil {
-		return c.Status(400).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: "Prompt is required",
-				Type:    "invalid_request_error",
-				Code:    "missing_prompt",
-			},
-		})
+		return sendParamError(c, 400, "Prompt is required", "invalid_request_error", "missing_prompt", "prompt")
+	}
+
+	key := newCompletionCacheKey(&req, model)
+	cached := newCacheLookup(c, h.cache, req.Temperature, key)
+	if data, ok := cached.get(c, h.cache); ok {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Send(data)
 	}
 
 	// Handle request
-	resp, err := h.ollamaService.Completion(&req)
+	ctx, done := requestContext(c)
+	defer done()
+
+	resp, err := h.flights.completion(ctx, c, h.provider, &req, key)
 	if err != nil {
-		log.Printf("Error in completion: %v", err)
-		return c.Status(500).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: "Internal server error",
-				Type:    "internal_error",
-				Code:    "ollama_error",
-			},
-		})
+		if shuttingDown(ctx) {
+			return sendShutdownError(c)
+		}
+		logging.FromContext(c.UserContext()).Error("completion failed", "model", req.Model, "error", err)
+		return sendServiceError(c, err)
 	}
 
+	cached.set(ctx, h.cache, resp)
 	return c.JSON(resp)
 }
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"openai-compatible/lifecycle"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requestContext returns the context to pass to the provider for this
+// request. It carries the request ID and trace span from the user context,
+// keeps graceful shutdown waiting until done is called, and is cancelled with
+// lifecycle.ErrShutdown if the request outlives the drain deadline. fasthttp
+// doesn't report client disconnects while a handler runs, so streaming
+// handlers additionally call done as soon as writing to the client fails.
+func requestContext(c *fiber.Ctx) (ctx context.Context, done func()) {
+	return lifecycle.Track(c.UserContext())
+}
+
+// shuttingDown reports whether ctx was cancelled by a graceful shutdown.
+func shuttingDown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), lifecycle.ErrShutdown)
+}
+
+func sendShutdownError(c *fiber.Ctx) error {
+	return sendError(c, fiber.StatusServiceUnavailable, "The server is shutting down, please retry the request", "server_error", "server_shutdown")
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"openai-compatible/logging"
+	"openai-compatible/models"
+	"openai-compatible/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// sendError writes an OpenAI style error body tagged with the request ID so
+// users can quote it when reporting a problem.
+func sendError(c *fiber.Ctx, status int, message, errType, code string) error {
+	return sendParamError(c, status, message, errType, code, "")
+}
+
+// sendParamError is sendError for errors caused by a specific request
+// parameter.
+func sendParamError(c *fiber.Ctx, status int, message, errType, code, param string) error {
+	return c.Status(status).JSON(models.ErrorResponse{
+		Error: models.ErrorDetail{
+			Message:   message,
+			Type:      errType,
+			Param:     paramPtr(param),
+			Code:      code,
+			RequestID: logging.RequestID(c.UserContext()),
+		},
+	})
+}
+
+// sendServiceError renders an error returned by a provider with the status
+// and error type it was classified as.
+func sendServiceError(c *fiber.Ctx, err error) error {
+	e := services.Classify(err)
+	if e.RetryAfter > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	return sendParamError(c, e.Status, e.Message, e.Type, e.Code, e.Param)
+}
+
+// serviceErrorDetail is the error body for err, used to abort a stream
+// after the response headers were sent.
+func serviceErrorDetail(ctx context.Context, err error) models.ErrorDetail {
+	e := services.Classify(err)
+	return models.ErrorDetail{
+		Message:   e.Message,
+		Type:      e.Type,
+		Param:     paramPtr(e.Param),
+		Code:      e.Code,
+		RequestID: logging.RequestID(ctx),
+	}
+}
+
+func paramPtr(param string) *string {
+	if param == "" {
+		return nil
+	}
+	return &param
+}
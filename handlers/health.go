@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"openai-compatible/lifecycle"
+	"openai-compatible/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type HealthHandler struct {
+	backends       services.HealthChecker
+	drainer        *lifecycle.Drainer
+	requiredModels []string
+	cacheTTL       time.Duration
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	statuses  []services.BackendStatus
+}
+
+type ReadinessResponse struct {
+	Status    string                   `json:"status"`
+	CheckedAt time.Time                `json:"checked_at"`
+	Backends  []services.BackendStatus `json:"backends"`
+}
+
+func NewHealthHandler(backends services.HealthChecker, drainer *lifecycle.Drainer, requiredModels []string, cacheTTL time.Duration) *HealthHandler {
+	return &HealthHandler{
+		backends:       backends,
+		drainer:        drainer,
+		requiredModels: requiredModels,
+		cacheTTL:       cacheTTL,
+	}
+}
+
+// Livez only reports that the process is serving requests. It never checks
+// Ollama, so a slow backend doesn't get the gateway restarted.
+func (h *HealthHandler) Livez(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "ok",
+	})
+}
+
+// Readyz reports whether requests can currently be served: the server must
+// not be shutting down and at least one backend must be reachable and have
+// the required models. Unhealthy backends are listed but don't fail the
+// check, the load balancer routes around them.
+func (h *HealthHandler) Readyz(c *fiber.Ctx) error {
+	if h.drainer.Draining() {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(ReadinessResponse{
+			Status:    "draining",
+			CheckedAt: time.Now(),
+			Backends:  []services.BackendStatus{},
+		})
+	}
+
+	backends, checkedAt := h.check(c)
+
+	resp := ReadinessResponse{
+		Status:    "not_ready",
+		CheckedAt: checkedAt,
+		Backends:  backends,
+	}
+	for _, b := range backends {
+		if b.Healthy() {
+			resp.Status = "ready"
+		}
+	}
+
+	if resp.Status != "ready" {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(resp)
+	}
+	return c.JSON(resp)
+}
+
+// check returns the cached probe result, refreshing it once it is older than
+// cacheTTL. Concurrent callers wait for a single probe instead of all
+// hitting Ollama.
+func (h *HealthHandler) check(c *fiber.Ctx) ([]services.BackendStatus, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.statuses != nil && time.Since(h.checkedAt) < h.cacheTTL {
+		return h.statuses, h.checkedAt
+	}
+
+	h.statuses = h.backends.CheckHealth(c.UserContext(), h.requiredModels)
+	h.checkedAt = time.Now()
+
+	return h.statuses, h.checkedAt
+}
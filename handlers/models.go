@@ -1,35 +1,27 @@
 package handlers
 
 import (
-	"log"
-
-	"openai-compatible/models"
+	"openai-compatible/logging"
 	"openai-compatible/services"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 type ModelsHandler struct {
-	ollamaService *services.OllamaService
+	provider services.Provider
 }
 
-func NewModelsHandler(ollamaService *services.OllamaService) *ModelsHandler {
+func NewModelsHandler(provider services.Provider) *ModelsHandler {
 	return &ModelsHandler{
-		ollamaService: ollamaService,
+		provider: provider,
 	}
 }
 
 func (h *ModelsHandler) GetModels(c *fiber.Ctx) error {
-	resp, err := h.ollamaService.GetModels()
+	resp, err := h.provider.GetModels(c.UserContext())
 	if err != nil {
-		log.Printf("Error getting models: %v", err)
-		return c.Status(500).JSON(models.ErrorResponse{
-			Error: models.ErrorDetail{
-				Message: "Internal server error",
-				Type:    "internal_error",
-				Code:    "ollama_error",
-			},
-		})
+		logging.FromContext(c.UserContext()).Error("listing models failed", "error", err)
+		return sendServiceError(c, err)
 	}
 
 	return c.JSON(resp)
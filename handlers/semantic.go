@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"openai-compatible/cache"
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
+	"openai-compatible/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// similarityHeader carries the cosine similarity between the request and the
+// prompt of a semantic cache hit.
+const similarityHeader = "X-Cache-Similarity"
+
+// semanticLookup is the semantic cache counterpart of cacheLookup. The last
+// message, which must come from the user, is embedded. Everything else (the
+// model, the API key, earlier messages and sampling options) has to match
+// exactly, so it goes into the scope.
+type semanticLookup struct {
+	query  *cache.Query
+	lookup bool
+	store  bool
+}
+
+func newSemanticLookup(c *fiber.Ctx, semantic *cache.Semantic, req *models.ChatCompletionRequest, key chatCacheKey) semanticLookup {
+	if semantic == nil {
+		return semanticLookup{}
+	}
+	last := req.Messages[len(req.Messages)-1]
+	prompt := last.GetContentAsString()
+	if last.Role != "user" || prompt == "" {
+		return semanticLookup{}
+	}
+
+	noCache, noStore := cacheControl(c)
+	if noStore {
+		metrics.SemanticCacheRequests.WithLabelValues("bypass").Inc()
+		return semanticLookup{}
+	}
+
+	ctx := c.UserContext()
+	rest := key
+	rest.Messages = rest.Messages[:len(rest.Messages)-1]
+	scope, err := cache.Key(struct {
+		Client  string       `json:"client"`
+		Request chatCacheKey `json:"request"`
+	}{limiter.ClientFromContext(ctx).ID, rest})
+	if err != nil {
+		return semanticLookup{}
+	}
+
+	query, err := semantic.Embed(ctx, scope, prompt)
+	if err != nil {
+		metrics.SemanticCacheRequests.WithLabelValues("error").Inc()
+		logging.FromContext(ctx).Warn("failed to embed prompt for the semantic cache", "error", err)
+		return semanticLookup{}
+	}
+	if noCache {
+		metrics.SemanticCacheRequests.WithLabelValues("bypass").Inc()
+	}
+	return semanticLookup{query: query, lookup: !noCache, store: true}
+}
+
+// get returns the response cached for a similar prompt, setting the X-Cache
+// and X-Cache-Similarity headers on a hit.
+func (l semanticLookup) get(c *fiber.Ctx, semantic *cache.Semantic) ([]byte, bool) {
+	if l.query == nil || !l.lookup {
+		return nil, false
+	}
+	data, similarity, ok := semantic.Get(l.query)
+	if !ok {
+		metrics.SemanticCacheRequests.WithLabelValues("miss").Inc()
+		c.Set(cacheHeader, "MISS")
+		return nil, false
+	}
+	metrics.SemanticCacheRequests.WithLabelValues("hit").Inc()
+	c.Set(cacheHeader, "HIT")
+	c.Set(similarityHeader, strconv.FormatFloat(similarity, 'f', 4, 64))
+	return data, true
+}
+
+func (l semanticLookup) set(ctx context.Context, semantic *cache.Semantic, resp any) {
+	if l.query == nil || !l.store {
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		logging.FromContext(ctx).Warn("failed to store response in semantic cache", "error", err)
+		return
+	}
+	semantic.Set(l.query, data)
+}
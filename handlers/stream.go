@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+
+	"openai-compatible/models"
+)
+
+// writeSSEError writes an OpenAI style error event, which is how the OpenAI
+// SDKs expect a stream to be aborted.
+func writeSSEError(w *bufio.Writer, detail models.ErrorDetail) {
+	data, err := json.Marshal(models.ErrorResponse{Error: detail})
+	if err != nil {
+		return
+	}
+	_, _ = w.WriteString("data: " + string(data) + "\n\n")
+	_ = w.Flush()
+}
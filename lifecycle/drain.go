@@ -0,0 +1,128 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openai-compatible/logging"
+	"openai-compatible/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ErrShutdown is the cancellation cause of requests that were still running
+// when the drain deadline passed.
+var ErrShutdown = errors.New("server is shutting down")
+
+type contextKey struct{}
+
+// Drainer keeps track of in-flight completions so a shutdown can wait for
+// them, and cancels whatever is left once the drain deadline passes.
+type Drainer struct {
+	wg       sync.WaitGroup
+	draining atomic.Bool
+
+	// root is cancelled with ErrShutdown when draining times out. Every
+	// tracked request context is cancelled along with it.
+	root   context.Context
+	cancel context.CancelCauseFunc
+}
+
+func NewDrainer() *Drainer {
+	root, cancel := context.WithCancelCause(context.Background())
+	return &Drainer{
+		root:   root,
+		cancel: cancel,
+	}
+}
+
+// Draining reports whether a shutdown has started.
+func (d *Drainer) Draining() bool {
+	return d.draining.Load()
+}
+
+// Middleware rejects new requests once draining has started and makes the
+// drainer available to Track through the user context.
+func (d *Drainer) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if d.Draining() {
+			c.Set(fiber.HeaderConnection, "close")
+			return c.Status(fiber.StatusServiceUnavailable).JSON(models.ErrorResponse{
+				Error: models.ErrorDetail{
+					Message:   "The server is shutting down, please retry the request",
+					Type:      "server_error",
+					Code:      "server_shutdown",
+					RequestID: logging.RequestID(c.UserContext()),
+				},
+			})
+		}
+
+		c.SetUserContext(context.WithValue(c.UserContext(), contextKey{}, d))
+		return c.Next()
+	}
+}
+
+// Track registers an in-flight request and returns a context that is
+// cancelled with ErrShutdown if the request outlives the drain deadline.
+// done must be called when the request is completely finished, for streams
+// that is after the last event was written. Without a drainer in ctx, Track
+// only adds a cancel function.
+func Track(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	d, ok := ctx.Value(contextKey{}).(*Drainer)
+	if !ok {
+		return ctx, func() { cancel(context.Canceled) }
+	}
+
+	d.wg.Add(1)
+	stop := context.AfterFunc(d.root, func() {
+		cancel(context.Cause(d.root))
+	})
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			stop()
+			cancel(context.Canceled)
+			d.wg.Done()
+		})
+	}
+}
+
+// StartDrain marks the server as shutting down: /readyz fails and new
+// requests are refused, while running ones go on. Drain calls it too.
+func (d *Drainer) StartDrain() {
+	d.draining.Store(true)
+}
+
+// Drain stops accepting new requests and waits for tracked ones to finish.
+// If ctx expires first the remaining requests are cancelled with
+// ErrShutdown, and Drain gives them up to grace to write their final events.
+func (d *Drainer) Drain(ctx context.Context, grace time.Duration) error {
+	d.StartDrain()
+
+	finished := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+
+	d.cancel(ErrShutdown)
+
+	select {
+	case <-finished:
+		return ErrShutdown
+	case <-time.After(grace):
+		return ErrShutdown
+	}
+}
@@ -0,0 +1,70 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestStartDrainRefusesNewRequests(t *testing.T) {
+	d := NewDrainer()
+	app := fiber.New()
+	app.Use(d.Middleware())
+	app.Get("/", func(c *fiber.Ctx) error { return c.SendString("ok") })
+
+	get := func() int {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	if status := get(); status != http.StatusOK {
+		t.Fatalf("status before draining = %d", status)
+	}
+	d.StartDrain()
+	if !d.Draining() {
+		t.Error("not draining after StartDrain")
+	}
+	if status := get(); status != http.StatusServiceUnavailable {
+		t.Errorf("status while draining = %d, want 503", status)
+	}
+}
+
+func TestDrainWaitsForTrackedRequests(t *testing.T) {
+	d := NewDrainer()
+	ctx := context.WithValue(context.Background(), contextKey{}, d)
+	reqCtx, done := Track(ctx)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		done()
+	}()
+	if err := d.Drain(context.Background(), time.Second); err != nil {
+		t.Errorf("Drain = %v", err)
+	}
+	if reqCtx.Err() == nil {
+		t.Error("request context not cancelled once done")
+	}
+}
+
+func TestDrainCancelsAfterDeadline(t *testing.T) {
+	d := NewDrainer()
+	ctx := context.WithValue(context.Background(), contextKey{}, d)
+	reqCtx, done := Track(ctx)
+	context.AfterFunc(reqCtx, done)
+
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.Drain(deadline, time.Second); !errors.Is(err, ErrShutdown) {
+		t.Errorf("Drain = %v, want ErrShutdown", err)
+	}
+	if cause := context.Cause(reqCtx); !errors.Is(cause, ErrShutdown) {
+		t.Errorf("request cancelled with %v, want ErrShutdown", cause)
+	}
+}
@@ -0,0 +1,66 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Priority levels for API keys. Higher priorities are served first when
+// requests are queued.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = int(PriorityHigh) + 1
+)
+
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf("unknown priority %q (want low, normal or high)", s)
+	}
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// Client identifies who a request is for, so the queue can be fair across
+// API keys.
+type Client struct {
+	ID       string
+	Priority Priority
+}
+
+type contextKey struct{}
+
+// WithClient stores the authenticated client in ctx.
+func WithClient(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, contextKey{}, client)
+}
+
+// ClientFromContext returns the client stored in ctx, or an anonymous client
+// with normal priority.
+func ClientFromContext(ctx context.Context) Client {
+	if client, ok := ctx.Value(contextKey{}).(Client); ok {
+		return client
+	}
+	return Client{Priority: PriorityNormal}
+}
@@ -0,0 +1,326 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"openai-compatible/metrics"
+)
+
+var (
+	// ErrQueueFull rejects a request because too many are already waiting.
+	ErrQueueFull = errors.New("too many requests are waiting for the upstream")
+
+	// ErrQueueTimeout rejects a request that waited longer than the queue
+	// timeout without getting a slot.
+	ErrQueueTimeout = errors.New("timed out waiting for a free upstream slot")
+)
+
+// RejectedError is returned by Acquire when a request didn't get a slot. It
+// wraps ErrQueueFull or ErrQueueTimeout.
+type RejectedError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// Config sets the limits. Slot limits apply to each backend on its own;
+// 0 means unlimited.
+type Config struct {
+	PerModel     int
+	PerBackend   int
+	QueueSize    int
+	QueueTimeout time.Duration
+}
+
+// Backends lets the limiter see which backends take traffic, so it can
+// admit a request against the backend that will serve it.
+type Backends interface {
+	// Available names the backends currently taking traffic.
+	Available() []string
+	// Pick chooses the backend for model out of candidates, which all have
+	// a free slot.
+	Pick(model string, candidates []string) string
+}
+
+// Limiter hands out slots for requests to the backends of a provider. Requests that don't fit
+// wait in a bounded queue. Waiters are served by priority, and round-robin
+// across clients within a priority, so one busy API key can't starve the
+// others.
+type Limiter struct {
+	cfg      Config
+	backends Backends
+
+	mu       sync.Mutex
+	inflight int
+	backend  map[string]*usage
+	queues   [numPriorities]*queue
+	queued   int
+	avgHold  time.Duration
+}
+
+// usage counts the slots held on one backend.
+type usage struct {
+	inflight int
+	perModel map[string]int
+}
+
+// New creates a limiter for backends.
+func New(cfg Config, backends Backends) *Limiter {
+	l := &Limiter{
+		cfg:      cfg,
+		backends: backends,
+		backend:  make(map[string]*usage),
+	}
+	for i := range l.queues {
+		l.queues[i] = newQueue()
+	}
+	return l
+}
+
+// SetConfig changes the limits. Waiting requests that fit the new limits
+// get their slot right away; requests over a lowered limit keep running and
+// new ones wait until enough of them are done.
+func (l *Limiter) SetConfig(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+	l.dispatch()
+}
+
+type waiter struct {
+	client string
+	model  string
+	ready  chan struct{}
+	slot   *Slot
+}
+
+// Slot is a request's place on one backend, held until Release.
+type Slot struct {
+	l       *Limiter
+	backend string
+	model   string
+	start   time.Time
+	once    sync.Once
+}
+
+// Backend names the backend the slot was admitted to. It is empty when no
+// backend was taking traffic; the request then finds out for itself.
+func (s *Slot) Backend() string {
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+	return s.backend
+}
+
+// Move counts the slot against another backend or model, for a retry on a
+// different backend or a fallback model. It may go over that backend's
+// limits, as the request was already admitted.
+func (s *Slot) Move(backend, model string) {
+	l := s.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if backend == s.backend && model == s.model {
+		return
+	}
+	l.put(s.backend, s.model)
+	s.backend, s.model = backend, model
+	l.take(backend, model)
+	l.dispatch()
+}
+
+// Release gives the slot back. Calling it more than once is a no-op.
+func (s *Slot) Release() {
+	s.once.Do(func() {
+		l := s.l
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.observeHold(time.Since(s.start))
+		l.put(s.backend, s.model)
+		l.dispatch()
+	})
+}
+
+// Acquire waits for a slot for model. The caller must release it once the
+// request to the backend is done, including streams.
+func (l *Limiter) Acquire(ctx context.Context, model string) (*Slot, error) {
+	client := ClientFromContext(ctx)
+
+	l.mu.Lock()
+	l.dispatch()
+	if l.fits(model) {
+		slot := l.grant(model)
+		l.mu.Unlock()
+		return slot, nil
+	}
+
+	if l.queued >= l.cfg.QueueSize {
+		retryAfter := l.retryAfter()
+		l.mu.Unlock()
+		metrics.QueueRejections.WithLabelValues("queue_full").Inc()
+		return nil, &RejectedError{Err: ErrQueueFull, RetryAfter: retryAfter}
+	}
+
+	w := &waiter{client: client.ID, model: model, ready: make(chan struct{})}
+	l.queues[client.Priority].push(w)
+	l.queued++
+	metrics.QueueDepth.Inc()
+	timeout := l.cfg.QueueTimeout
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		metrics.QueueWait.Observe(time.Since(start).Seconds())
+		return w.slot, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = ErrQueueTimeout
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.slot != nil {
+		// Lost the race against dispatch, hand the slot to the next waiter.
+		l.put(w.slot.backend, model)
+		l.dispatch()
+	} else {
+		l.queues[client.Priority].remove(w)
+		l.queued--
+		metrics.QueueDepth.Dec()
+	}
+
+	if errors.Is(err, ErrQueueTimeout) {
+		metrics.QueueRejections.WithLabelValues("queue_timeout").Inc()
+		return nil, &RejectedError{Err: ErrQueueTimeout, RetryAfter: l.retryAfter()}
+	}
+	return nil, err
+}
+
+// available names the backends taking traffic. When there are none, a
+// single unnamed backend stands in so requests still reach OllamaService,
+// which reports unreachable backends itself.
+func (l *Limiter) available() []string {
+	if names := l.backends.Available(); len(names) > 0 {
+		return names
+	}
+	return []string{""}
+}
+
+// room lists the backends with a free slot for model.
+func (l *Limiter) room(model string) []string {
+	var names []string
+	for _, name := range l.available() {
+		u := l.backend[name]
+		if u == nil {
+			names = append(names, name)
+			continue
+		}
+		if l.cfg.PerBackend > 0 && u.inflight >= l.cfg.PerBackend {
+			continue
+		}
+		if l.cfg.PerModel > 0 && u.perModel[model] >= l.cfg.PerModel {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (l *Limiter) fits(model string) bool {
+	return len(l.room(model)) > 0
+}
+
+// grant takes a slot for model on one of the backends with room. The caller
+// must have checked that model fits.
+func (l *Limiter) grant(model string) *Slot {
+	room := l.room(model)
+	backend := room[0]
+	if len(room) > 1 {
+		backend = l.backends.Pick(model, room)
+	}
+	l.take(backend, model)
+	return &Slot{l: l, backend: backend, model: model, start: time.Now()}
+}
+
+func (l *Limiter) take(backend, model string) {
+	u := l.backend[backend]
+	if u == nil {
+		u = &usage{perModel: make(map[string]int)}
+		l.backend[backend] = u
+	}
+	u.inflight++
+	u.perModel[model]++
+	l.inflight++
+	metrics.QueueInflight.Inc()
+}
+
+func (l *Limiter) put(backend, model string) {
+	u := l.backend[backend]
+	if u == nil {
+		return
+	}
+	u.inflight--
+	if u.perModel[model]--; u.perModel[model] <= 0 {
+		delete(u.perModel, model)
+	}
+	if u.inflight <= 0 {
+		delete(l.backend, backend)
+	}
+	l.inflight--
+	metrics.QueueInflight.Dec()
+}
+
+// dispatch grants slots to waiting requests, highest priority first.
+func (l *Limiter) dispatch() {
+	for l.queued > 0 {
+		var w *waiter
+		for p := numPriorities - 1; p >= 0 && w == nil; p-- {
+			w = l.queues[p].next(l.fits)
+		}
+		if w == nil {
+			return
+		}
+		w.slot = l.grant(w.model)
+		l.queued--
+		metrics.QueueDepth.Dec()
+		close(w.ready)
+	}
+}
+
+// observeHold keeps a moving average of how long slots are held, used to
+// estimate Retry-After.
+func (l *Limiter) observeHold(d time.Duration) {
+	if l.avgHold == 0 {
+		l.avgHold = d
+		return
+	}
+	l.avgHold = (l.avgHold*4 + d) / 5
+}
+
+// retryAfter estimates when a slot could be free for a new request.
+func (l *Limiter) retryAfter() time.Duration {
+	slots := l.cfg.PerBackend * len(l.available())
+	if slots <= 0 {
+		slots = l.inflight
+	}
+	if slots <= 0 {
+		slots = 1
+	}
+	wait := time.Duration(float64(l.avgHold) * float64(l.queued+1) / float64(slots))
+	return time.Duration(math.Max(1, math.Ceil(wait.Seconds()))) * time.Second
+}
@@ -0,0 +1,234 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// backends is a fixed set of backends that picks the first candidate.
+type backends []string
+
+func (b backends) Available() []string { return b }
+
+func (b backends) Pick(model string, candidates []string) string { return candidates[0] }
+
+func newLimiter(cfg Config, names ...string) *Limiter {
+	if cfg.QueueTimeout == 0 {
+		cfg.QueueTimeout = time.Second
+	}
+	return New(cfg, backends(names))
+}
+
+func acquire(t *testing.T, l *Limiter, ctx context.Context, model string) *Slot {
+	t.Helper()
+	slot, err := l.Acquire(ctx, model)
+	if err != nil {
+		t.Fatalf("Acquire(%q): %v", model, err)
+	}
+	return slot
+}
+
+// waitQueued blocks until n requests are waiting.
+func waitQueued(t *testing.T, l *Limiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.mu.Lock()
+		queued := l.queued
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAcquirePerBackend(t *testing.T) {
+	l := newLimiter(Config{PerBackend: 1, QueueSize: 0}, "a", "b")
+	ctx := context.Background()
+
+	first := acquire(t, l, ctx, "m")
+	second := acquire(t, l, ctx, "m")
+	if first.Backend() != "a" || second.Backend() != "b" {
+		t.Fatalf("slots on %q and %q, want a and b", first.Backend(), second.Backend())
+	}
+
+	if _, err := l.Acquire(ctx, "m"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("third request: err = %v, want ErrQueueFull", err)
+	}
+
+	first.Release()
+	third := acquire(t, l, ctx, "m")
+	if third.Backend() != "a" {
+		t.Fatalf("slot on %q after a was released, want a", third.Backend())
+	}
+}
+
+func TestAcquirePerModelPerBackend(t *testing.T) {
+	l := newLimiter(Config{PerModel: 1, QueueSize: 0}, "a")
+	ctx := context.Background()
+
+	acquire(t, l, ctx, "m1")
+	acquire(t, l, ctx, "m2")
+	if _, err := l.Acquire(ctx, "m1"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("second m1 request: err = %v, want ErrQueueFull", err)
+	}
+}
+
+func TestAcquireWithoutBackends(t *testing.T) {
+	l := newLimiter(Config{PerBackend: 1, QueueSize: 0})
+	ctx := context.Background()
+
+	slot := acquire(t, l, ctx, "m")
+	if slot.Backend() != "" {
+		t.Fatalf("slot on %q, want the unnamed backend", slot.Backend())
+	}
+	if _, err := l.Acquire(ctx, "m"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("second request: err = %v, want ErrQueueFull", err)
+	}
+}
+
+func TestSlotMove(t *testing.T) {
+	l := newLimiter(Config{PerBackend: 1, QueueSize: 1}, "a", "b")
+	ctx := context.Background()
+
+	slot := acquire(t, l, ctx, "m")
+	slot.Move("b", "m")
+	if slot.Backend() != "b" {
+		t.Fatalf("slot on %q after Move, want b", slot.Backend())
+	}
+
+	// a is free again, b is full.
+	other := acquire(t, l, ctx, "m")
+	if other.Backend() != "a" {
+		t.Fatalf("slot on %q, want a", other.Backend())
+	}
+
+	slot.Release()
+	slot.Release()
+	l.mu.Lock()
+	inflight := l.inflight
+	l.mu.Unlock()
+	if inflight != 1 {
+		t.Fatalf("inflight = %d after releasing twice, want 1", inflight)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	l := newLimiter(Config{PerBackend: 1, QueueSize: 1, QueueTimeout: 10 * time.Millisecond}, "a")
+	ctx := context.Background()
+
+	acquire(t, l, ctx, "m")
+	_, err := l.Acquire(ctx, "m")
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("err = %v, want a RejectedError with ErrQueueTimeout", err)
+	}
+	if rejected.RetryAfter < time.Second {
+		t.Errorf("RetryAfter = %s, want at least 1s", rejected.RetryAfter)
+	}
+	waitQueued(t, l, 0)
+}
+
+func TestQueueCancelled(t *testing.T) {
+	l := newLimiter(Config{PerBackend: 1, QueueSize: 1}, "a")
+
+	acquire(t, l, context.Background(), "m")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx, "m"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	waitQueued(t, l, 0)
+}
+
+// order queues one request per client and releases the only slot until
+// every waiter got it, returning the clients in the order they were served.
+func order(t *testing.T, clients []Client) []string {
+	t.Helper()
+	l := newLimiter(Config{PerBackend: 1, QueueSize: len(clients)}, "a")
+	held := acquire(t, l, context.Background(), "m")
+
+	var (
+		mu     sync.Mutex
+		served []string
+		wg     sync.WaitGroup
+	)
+	for i, client := range clients {
+		wg.Add(1)
+		go func(client Client) {
+			defer wg.Done()
+			slot, err := l.Acquire(WithClient(context.Background(), client), "m")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			served = append(served, client.ID)
+			mu.Unlock()
+			slot.Release()
+		}(client)
+		// Queue them one after the other so the order within a client is
+		// known.
+		waitQueued(t, l, i+1)
+	}
+
+	held.Release()
+	wg.Wait()
+	if len(served) != len(clients) {
+		t.Fatalf("served %v, want %d clients", served, len(clients))
+	}
+	return served
+}
+
+func TestQueuePriority(t *testing.T) {
+	served := order(t, []Client{
+		{ID: "low", Priority: PriorityLow},
+		{ID: "normal", Priority: PriorityNormal},
+		{ID: "high", Priority: PriorityHigh},
+	})
+	want := []string{"high", "normal", "low"}
+	for i := range want {
+		if served[i] != want[i] {
+			t.Fatalf("served %v, want %v", served, want)
+		}
+	}
+}
+
+func TestQueueRoundRobin(t *testing.T) {
+	served := order(t, []Client{
+		{ID: "busy", Priority: PriorityNormal},
+		{ID: "busy", Priority: PriorityNormal},
+		{ID: "busy", Priority: PriorityNormal},
+		{ID: "other", Priority: PriorityNormal},
+	})
+	want := []string{"busy", "other", "busy", "busy"}
+	for i := range want {
+		if served[i] != want[i] {
+			t.Fatalf("served %v, want %v", served, want)
+		}
+	}
+}
+
+func TestSetConfigGrantsWaiters(t *testing.T) {
+	l := newLimiter(Config{PerBackend: 1, QueueSize: 1}, "a")
+	acquire(t, l, context.Background(), "m")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(context.Background(), "m")
+		done <- err
+	}()
+	waitQueued(t, l, 1)
+
+	l.SetConfig(Config{PerBackend: 2, QueueSize: 1, QueueTimeout: time.Second})
+	if err := <-done; err != nil {
+		t.Fatalf("waiter after raising the limit: %v", err)
+	}
+}
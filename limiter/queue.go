@@ -0,0 +1,74 @@
+package limiter
+
+// queue holds the waiters of one priority level, one FIFO per client. next
+// walks the clients round-robin.
+type queue struct {
+	clients []string
+	waiters map[string][]*waiter
+	cursor  int
+}
+
+func newQueue() *queue {
+	return &queue{waiters: make(map[string][]*waiter)}
+}
+
+func (q *queue) push(w *waiter) {
+	if _, ok := q.waiters[w.client]; !ok {
+		q.clients = append(q.clients, w.client)
+	}
+	q.waiters[w.client] = append(q.waiters[w.client], w)
+}
+
+// next removes and returns the first waiter whose model fits, starting with
+// the client after the one served last.
+func (q *queue) next(fits func(model string) bool) *waiter {
+	for i := 0; i < len(q.clients); i++ {
+		idx := (q.cursor + i) % len(q.clients)
+		client := q.clients[idx]
+		for j, w := range q.waiters[client] {
+			if !fits(w.model) {
+				continue
+			}
+			q.removeAt(client, j)
+			switch {
+			case len(q.clients) == 0:
+				q.cursor = 0
+			case q.waiters[client] != nil:
+				q.cursor = (idx + 1) % len(q.clients)
+			default:
+				// The client was dropped, so idx already is the next one.
+				q.cursor = idx % len(q.clients)
+			}
+			return w
+		}
+	}
+	return nil
+}
+
+func (q *queue) remove(w *waiter) {
+	for i, other := range q.waiters[w.client] {
+		if other == w {
+			q.removeAt(w.client, i)
+			return
+		}
+	}
+}
+
+func (q *queue) removeAt(client string, i int) {
+	waiters := append(q.waiters[client][:i], q.waiters[client][i+1:]...)
+	if len(waiters) > 0 {
+		q.waiters[client] = waiters
+		return
+	}
+
+	delete(q.waiters, client)
+	for idx, c := range q.clients {
+		if c == client {
+			q.clients = append(q.clients[:idx], q.clients[idx+1:]...)
+			if q.cursor > idx {
+				q.cursor--
+			}
+			break
+		}
+	}
+}
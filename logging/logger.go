@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+type contextKey struct{}
+
+// level is the level of the logger installed by Setup, changed by SetLevel.
+var level slog.LevelVar
+
+// Setup installs a JSON slog handler as the process-wide default logger.
+func Setup(w io.Writer, lvl string) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: &level})))
+	return nil
+}
+
+// SetLevel changes the level of the logger installed by Setup.
+func SetLevel(lvl string) error {
+	l, err := ParseLevel(lvl)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// ParseLevel parses a LOG_LEVEL value, "" meaning info.
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", level)
+	}
+}
+
+// WithRequestID stores the request ID in ctx so that FromContext can attach
+// it to every log line written while handling the request.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, requestID)
+}
+
+// RequestID returns the request ID stored in ctx, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// FromContext returns the default logger, tagged with the request ID if ctx
+// carries one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
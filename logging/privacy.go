@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PrivacyLevel controls how much of a prompt or completion ends up in logs.
+type PrivacyLevel string
+
+const (
+	// PrivacyRedact replaces content with its length only. This is the default.
+	PrivacyRedact PrivacyLevel = "redact"
+	// PrivacyHash replaces content with a short SHA-256 prefix so identical
+	// prompts can be correlated without being readable.
+	PrivacyHash PrivacyLevel = "hash"
+	// PrivacyTruncate keeps the first few characters of content.
+	PrivacyTruncate PrivacyLevel = "truncate"
+	// PrivacyFull logs request bodies verbatim. Credentials are still masked.
+	// Only meant for local debugging and must be enabled explicitly.
+	PrivacyFull PrivacyLevel = "full"
+)
+
+// ParsePrivacyLevel parses a LOG_PRIVACY value.
+func ParsePrivacyLevel(s string) (PrivacyLevel, error) {
+	switch level := PrivacyLevel(strings.ToLower(strings.TrimSpace(s))); level {
+	case PrivacyRedact, PrivacyHash, PrivacyTruncate, PrivacyFull:
+		return level, nil
+	case "":
+		return PrivacyRedact, nil
+	default:
+		return PrivacyRedact, fmt.Errorf("unknown log privacy level %q (want redact, hash, truncate or full)", s)
+	}
+}
@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Headers that carry credentials and are never logged in clear text.
+var sensitiveHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"api-key":             true,
+	"x-api-key":           true,
+	"cookie":              true,
+	"set-cookie":          true,
+}
+
+// Redactor turns request data into something that is safe to log.
+type Redactor struct {
+	level    PrivacyLevel
+	maxChars int
+}
+
+func NewRedactor(level PrivacyLevel, maxChars int) *Redactor {
+	if maxChars <= 0 {
+		maxChars = 64
+	}
+	return &Redactor{
+		level:    level,
+		maxChars: maxChars,
+	}
+}
+
+func (r *Redactor) Level() PrivacyLevel {
+	return r.level
+}
+
+// Content applies the privacy level to a single piece of user or model text.
+func (r *Redactor) Content(s string) string {
+	switch r.level {
+	case PrivacyFull:
+		return s
+	case PrivacyTruncate:
+		runes := []rune(s)
+		if len(runes) <= r.maxChars {
+			return s
+		}
+		return fmt.Sprintf("%s…(%d chars)", string(runes[:r.maxChars]), len(runes))
+	case PrivacyHash:
+		sum := sha256.Sum256([]byte(s))
+		return fmt.Sprintf("sha256:%x (%d chars)", sum[:8], len([]rune(s)))
+	default:
+		return fmt.Sprintf("[redacted %d chars]", len([]rune(s)))
+	}
+}
+
+// Body returns a loggable version of a JSON request body. Prompt and message
+// content is passed through Content, everything else (model, sampling
+// options) is kept as is.
+func (r *Redactor) Body(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		if r.level == PrivacyFull {
+			return string(body)
+		}
+		return fmt.Sprintf("[unparseable body, %d bytes]", len(body))
+	}
+	if r.level == PrivacyFull {
+		return string(body)
+	}
+
+	if messages, ok := payload["messages"].([]interface{}); ok {
+		for _, m := range messages {
+			if msg, ok := m.(map[string]interface{}); ok {
+				msg["content"] = r.redactValue(msg["content"])
+			}
+		}
+	}
+	for _, field := range []string{"prompt", "input"} {
+		if v, ok := payload[field]; ok {
+			payload[field] = r.redactValue(v)
+		}
+	}
+
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Sprintf("[unserializable body, %d bytes]", len(body))
+	}
+	return string(out)
+}
+
+// redactValue handles the string, []string and content-part shapes that
+// OpenAI requests use for prompts and message content.
+func (r *Redactor) redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		return r.Content(value)
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, part := range value {
+			if partMap, ok := part.(map[string]interface{}); ok {
+				if text, ok := partMap["text"].(string); ok {
+					partMap["text"] = r.Content(text)
+				}
+				out[i] = partMap
+				continue
+			}
+			out[i] = r.redactValue(part)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// Headers masks credential headers. Header names are matched case-insensitively.
+func (r *Redactor) Headers(headers map[string][]string) map[string]string {
+	out := make(map[string]string, len(headers))
+	for name, values := range headers {
+		value := strings.Join(values, ", ")
+		if sensitiveHeaders[strings.ToLower(name)] {
+			out[name] = MaskSecret(strings.TrimPrefix(value, "Bearer "))
+			continue
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// MaskSecret keeps just enough of a secret to tell keys apart in logs.
+func MaskSecret(secret string) string {
+	if len(secret) < 12 {
+		return "[REDACTED]"
+	}
+	return secret[:4] + "…" + secret[len(secret)-4:]
+}
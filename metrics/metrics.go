@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gateway"
+
+// modelLocalKey is the fiber.Ctx local handlers use to report which model a
+// request was for, so Middleware can label it.
+const modelLocalKey = "metrics_model"
+
+// maxModels bounds the model label values. Clients choose the model names,
+// so only models that are configured or were served get their own series,
+// up to this many; the rest are labelled otherModel.
+const maxModels = 100
+
+const otherModel = "other"
+
+var knownModels = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+var (
+	RequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "HTTP requests handled, by route, model and status code.",
+	}, []string{"route", "model", "status"})
+
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time until the response headers were written, by route and model.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"route", "model"})
+
+	TimeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_first_token_seconds",
+		Help:      "Time from sending a streaming request to Ollama until the first content token arrived.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2, 5, 10, 30},
+	}, []string{"model"})
+
+	TokensPerSecond = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "tokens_per_second",
+		Help:      "Generation speed reported by Ollama (eval_count / eval_duration).",
+		Buckets:   []float64{1, 5, 10, 20, 40, 60, 80, 120, 200},
+	}, []string{"model"})
+
+	InflightStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inflight_streams",
+		Help:      "Streaming responses currently being written to clients.",
+	})
+
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Failed calls to Ollama, by backend, endpoint and reason.",
+	}, []string{"backend", "endpoint", "reason"})
+
+	UpstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Calls to Ollama that were retried after a transient failure, by endpoint.",
+	}, []string{"endpoint"})
+
+	ModelFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "model_fallbacks_total",
+		Help:      "Requests served by a fallback model after the requested one kept failing.",
+	}, []string{"model", "fallback"})
+
+	CircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_open",
+		Help:      "1 while the circuit breaker for the Ollama backend is open, 0 otherwise.",
+	}, []string{"backend"})
+
+	BackendHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_healthy",
+		Help:      "1 if the Ollama backend passed its last health check, 0 otherwise.",
+	}, []string{"backend"})
+
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Requests waiting for a free upstream slot.",
+	})
+
+	QueueInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_inflight",
+		Help:      "Requests holding an upstream slot.",
+	})
+
+	QueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time queued requests waited for a slot.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+
+	QueueRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_rejections_total",
+		Help:      "Requests rejected by the concurrency limiter, by reason.",
+	}, []string{"reason"})
+
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Response cache lookups for cacheable requests, by result (hit, miss, bypass).",
+	}, []string{"result"})
+
+	SemanticCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "semantic_cache_requests_total",
+		Help:      "Semantic cache lookups, by result (hit, miss, bypass, error).",
+	}, []string{"result"})
+
+	CoalescedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coalesced_requests_total",
+		Help:      "Requests served by joining an identical request already in flight, by endpoint.",
+	}, []string{"endpoint"})
+
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Rejected requests, by failure reason.",
+	}, []string{"reason"})
+)
+
+// Handler serves the Prometheus exposition format.
+func Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
+
+// Middleware counts requests and observes their latency. For streaming
+// responses the latency covers the time until the stream started; the stream
+// itself is covered by TimeToFirstToken and TokensPerSecond.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+
+		route := c.Route().Path
+		model, _ := c.Locals(modelLocalKey).(string)
+		model = modelLabel(model, status < 400)
+
+		RequestsTotal.WithLabelValues(route, model, strconv.Itoa(status)).Inc()
+		RequestDuration.WithLabelValues(route, model).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// SetModel records the model a request is for so Middleware can label it.
+func SetModel(c *fiber.Ctx, model string) {
+	c.Locals(modelLocalKey, model)
+}
+
+// AddModels gives the configured models their own label values, whether
+// or not a request for them succeeded yet.
+func AddModels(models ...string) {
+	knownModels.Lock()
+	defer knownModels.Unlock()
+	for _, model := range models {
+		if model != "" {
+			knownModels.names[model] = true
+		}
+	}
+}
+
+// modelLabel returns the label value for model. A model a backend served is
+// added to the known models while there is room.
+func modelLabel(model string, served bool) string {
+	if model == "" {
+		return ""
+	}
+	knownModels.Lock()
+	defer knownModels.Unlock()
+	if knownModels.names[model] {
+		return model
+	}
+	if served && len(knownModels.names) < maxModels {
+		knownModels.names[model] = true
+		return model
+	}
+	return otherModel
+}
+
+// ObserveFirstToken records how long a stream took to produce its first
+// token.
+func ObserveFirstToken(model string, d time.Duration) {
+	TimeToFirstToken.WithLabelValues(modelLabel(model, true)).Observe(d.Seconds())
+}
+
+// ObserveGeneration records the generation speed from Ollama's final
+// response. evalDuration is in nanoseconds as reported by Ollama.
+func ObserveGeneration(model string, evalCount int, evalDuration int64) {
+	if evalCount <= 0 || evalDuration <= 0 {
+		return
+	}
+	seconds := time.Duration(evalDuration).Seconds()
+	TokensPerSecond.WithLabelValues(modelLabel(model, true)).Observe(float64(evalCount) / seconds)
+}
+
+// SetBackendHealthy records the outcome of a backend health check.
+func SetBackendHealthy(backend string, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	BackendHealthy.WithLabelValues(backend).Set(value)
+}
+
+// SetCircuitOpen records a circuit breaker transition.
+func SetCircuitOpen(backend string, open bool) {
+	value := 0.0
+	if open {
+		value = 1
+	}
+	CircuitOpen.WithLabelValues(backend).Set(value)
+}
@@ -1,51 +1,89 @@
 package middleware
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
+	"sync/atomic"
 
 	"openai-compatible/config"
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
 	"openai-compatible/models"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func AuthMiddleware(cfg *config.Config) fiber.Handler {
+// KeySet holds the accepted API keys: API_KEY and every key in API_KEYS
+// and API_KEYS_FILE. Update swaps them while requests are being served.
+type KeySet struct {
+	clients atomic.Pointer[map[string]limiter.Client]
+}
+
+// NewKeySet creates the key set of cfg.
+func NewKeySet(cfg *config.Config) *KeySet {
+	keys := &KeySet{}
+	keys.Update(cfg)
+	return keys
+}
+
+// Update replaces the accepted keys with those of cfg.
+func (k *KeySet) Update(cfg *config.Config) {
+	clients := make(map[string]limiter.Client)
+	if cfg.APIKey != "" {
+		clients[cfg.APIKey] = limiter.Client{ID: KeyID(cfg.APIKey), Priority: limiter.PriorityNormal}
+	}
+	for _, key := range cfg.APIKeys {
+		// Priorities are validated by config.Load.
+		priority, _ := limiter.ParsePriority(key.Priority)
+		clients[key.Key] = limiter.Client{ID: KeyID(key.Key), Priority: priority}
+	}
+	k.clients.Store(&clients)
+}
+
+// AuthMiddleware accepts the keys of keys. The matching key's queue
+// priority is stored in the user context for the limiter.
+func AuthMiddleware(keys *KeySet) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Get Authorization header
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
-			return c.Status(401).JSON(models.ErrorResponse{
-				Error: models.ErrorDetail{
-					Message: "Authorization header is required",
-					Type:    "invalid_request_error",
-					Code:    "missing_authorization",
-				},
-			})
+			return unauthorized(c, "Authorization header is required", "missing_authorization")
 		}
 
 		// Check if it starts with "Bearer "
 		if !strings.HasPrefix(authHeader, "Bearer ") {
-			return c.Status(401).JSON(models.ErrorResponse{
-				Error: models.ErrorDetail{
-					Message: "Authorization header must start with 'Bearer '",
-					Type:    "invalid_request_error",
-					Code:    "invalid_authorization_format",
-				},
-			})
+			return unauthorized(c, "Authorization header must start with 'Bearer '", "invalid_authorization_format")
 		}
 
 		// Extract token
 		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token != cfg.APIKey {
-			return c.Status(401).JSON(models.ErrorResponse{
-				Error: models.ErrorDetail{
-					Message: "Invalid API key",
-					Type:    "invalid_request_error",
-					Code:    "invalid_api_key",
-				},
-			})
+		client, ok := (*keys.clients.Load())[token]
+		if !ok || token == "" {
+			return unauthorized(c, "Invalid API key", "invalid_api_key")
 		}
 
+		c.SetUserContext(limiter.WithClient(c.UserContext(), client))
 		return c.Next()
 	}
 }
+
+func unauthorized(c *fiber.Ctx, message, code string) error {
+	metrics.AuthFailures.WithLabelValues(code).Inc()
+	logging.FromContext(c.UserContext()).Warn("authentication failed", "code", code, "path", c.Path())
+	return c.Status(401).JSON(models.ErrorResponse{
+		Error: models.ErrorDetail{
+			Message:   message,
+			Type:      "invalid_request_error",
+			Code:      code,
+			RequestID: logging.RequestID(c.UserContext()),
+		},
+	})
+}
+
+// KeyID is a stable, non-secret identifier for an API key.
+func KeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
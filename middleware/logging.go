@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"log/slog"
+	"time"
+
+	"openai-compatible/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequestLogger logs one line per request. Bodies are passed through the
+// redactor so prompts and credentials never reach the logs unless full-body
+// logging was explicitly enabled. Must be registered after RequestID.
+func RequestLogger(redactor *logging.Redactor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		// Copy what we need before the handler runs, Fiber reuses the buffers.
+		attrs := []any{
+			slog.String("method", c.Method()),
+			slog.String("path", c.Path()),
+			slog.String("ip", c.IP()),
+		}
+		if body := redactor.Body(c.Body()); body != "" {
+			attrs = append(attrs, slog.String("body", body))
+		}
+		if redactor.Level() == logging.PrivacyFull {
+			attrs = append(attrs, slog.Any("headers", redactor.Headers(c.GetReqHeaders())))
+		}
+
+		chainErr := c.Next()
+		if chainErr != nil {
+			if err := c.App().ErrorHandler(c, chainErr); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		attrs = append(attrs,
+			slog.Int("status", c.Response().StatusCode()),
+			slog.Duration("latency", time.Since(start)),
+		)
+		logging.FromContext(c.UserContext()).Info("request", attrs...)
+
+		return nil
+	}
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"openai-compatible/logging"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID assigns every request an ID, reusing a well-formed X-Request-ID
+// sent by the client or a proxy in front of us. The ID is echoed in the
+// response headers and stored in the user context for logging.
+func RequestID() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+
+		c.Set(RequestIDHeader, id)
+		c.SetUserContext(logging.WithRequestID(c.UserContext(), id))
+
+		return c.Next()
+	}
+}
+
+// validRequestID only accepts short printable IDs so a client can't inject
+// arbitrary data into our logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"fmt"
+
+	"openai-compatible/logging"
+	"openai-compatible/tracing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing starts a server span for every request, continuing the trace from
+// an incoming traceparent header if there is one. Must be registered after
+// RequestID.
+func Tracing() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := tracing.Extract(c.UserContext(), fiberHeaderCarrier{c})
+
+		ctx, span := tracing.Tracer().Start(ctx, c.Method(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Method()),
+				attribute.String("url.path", c.Path()),
+				attribute.String("client.address", c.IP()),
+				attribute.String("request_id", logging.RequestID(ctx)),
+			),
+		)
+		defer span.End()
+
+		c.SetUserContext(ctx)
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if e, ok := err.(*fiber.Error); ok {
+			status = e.Code
+		} else if err != nil {
+			status = fiber.StatusInternalServerError
+		}
+
+		route := c.Route().Path
+		span.SetName(c.Method() + " " + route)
+		span.SetAttributes(
+			attribute.String("http.route", route),
+			attribute.Int("http.response.status_code", status),
+		)
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		return err
+	}
+}
+
+// fiberHeaderCarrier adapts request headers to propagation.TextMapCarrier.
+// Only the read side is used.
+type fiberHeaderCarrier struct {
+	c *fiber.Ctx
+}
+
+func (f fiberHeaderCarrier) Get(key string) string {
+	return f.c.Get(key)
+}
+
+func (f fiberHeaderCarrier) Set(key, value string) {
+	f.c.Request().Header.Set(key, value)
+}
+
+func (f fiberHeaderCarrier) Keys() []string {
+	keys := make([]string, 0)
+	f.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
@@ -0,0 +1,101 @@
+package models
+
+// llama.cpp Completion Request (/completion)
+type LlamaCppCompletionRequest struct {
+	Prompt           string   `json:"prompt"`
+	NPredict         *int     `json:"n_predict,omitempty"`
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Grammar          string   `json:"grammar,omitempty"`
+	NProbs           int      `json:"n_probs,omitempty"`
+	IDSlot           *int     `json:"id_slot,omitempty"`
+	CachePrompt      bool     `json:"cache_prompt"`
+	Stream           bool     `json:"stream,omitempty"`
+}
+
+// llama.cpp Completion Response, also the shape of each streamed chunk. The
+// statistics are only set on the final (stop) chunk.
+type LlamaCppCompletionResponse struct {
+	Content         string               `json:"content"`
+	Stop            bool                 `json:"stop"`
+	IDSlot          *int                 `json:"id_slot,omitempty"`
+	StopType        string               `json:"stop_type,omitempty"`     // eos, limit, word or none
+	StoppedLimit    bool                 `json:"stopped_limit,omitempty"` // older servers
+	TokensPredicted int                  `json:"tokens_predicted,omitempty"`
+	TokensEvaluated int                  `json:"tokens_evaluated,omitempty"`
+	Probs           []LlamaCppTokenProbs `json:"completion_probabilities,omitempty"`
+	Timings         *LlamaCppTimings     `json:"timings,omitempty"`
+	Error           interface{}          `json:"error,omitempty"` // set on a failed stream chunk
+}
+
+type LlamaCppTimings struct {
+	PredictedN  int     `json:"predicted_n"`
+	PredictedMS float64 `json:"predicted_ms"`
+}
+
+// llama.cpp token probabilities. Newer servers send log probabilities
+// (Token, Logprob, TopLogprobs), older ones plain probabilities (Content,
+// Probs).
+type LlamaCppTokenProbs struct {
+	Token       string               `json:"token,omitempty"`
+	Logprob     *float64             `json:"logprob,omitempty"`
+	Bytes       []int                `json:"bytes,omitempty"`
+	TopLogprobs []LlamaCppTopLogprob `json:"top_logprobs,omitempty"`
+
+	Content string         `json:"content,omitempty"`
+	Probs   []LlamaCppProb `json:"probs,omitempty"`
+}
+
+type LlamaCppTopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes,omitempty"`
+}
+
+type LlamaCppProb struct {
+	TokStr string  `json:"tok_str"`
+	Prob   float64 `json:"prob"`
+}
+
+// llama.cpp Tokenize Request (/tokenize)
+type LlamaCppTokenizeRequest struct {
+	Content string `json:"content"`
+}
+
+// llama.cpp Tokenize Response. Tokens are IDs, or objects when pieces are
+// requested, so they are only counted.
+type LlamaCppTokenizeResponse struct {
+	Tokens []interface{} `json:"tokens"`
+}
+
+// llama.cpp Embedding Request (/embedding)
+type LlamaCppEmbeddingRequest struct {
+	Content string `json:"content"`
+}
+
+// llama.cpp Apply Template Request (/apply-template)
+type LlamaCppApplyTemplateRequest struct {
+	Messages []ChatMessage `json:"messages"`
+}
+
+type LlamaCppApplyTemplateResponse struct {
+	Prompt string `json:"prompt"`
+}
+
+// llama.cpp server properties (/props)
+type LlamaCppProps struct {
+	ModelPath                 string `json:"model_path"`
+	TotalSlots                int    `json:"total_slots"`
+	BuildInfo                 string `json:"build_info,omitempty"`
+	DefaultGenerationSettings struct {
+		NCtx int `json:"n_ctx"`
+	} `json:"default_generation_settings"`
+}
+
+// llama.cpp Health Response (/health)
+type LlamaCppHealthResponse struct {
+	Status string `json:"status"`
+}
@@ -33,6 +33,8 @@ type OllamaChatResponse struct {
 	CreatedAt string      `json:"created_at"`
 	Message   ChatMessage `json:"message"`
 	Done      bool        `json:"done"`
+	Error     string      `json:"error,omitempty"` // set on a failed stream line
+	OllamaStats
 }
 
 // Ollama Generate Response
@@ -41,6 +43,33 @@ type OllamaGenerateResponse struct {
 	CreatedAt string `json:"created_at"`
 	Response  string `json:"response"`
 	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"` // set on a failed stream line
+	OllamaStats
+}
+
+// Ollama Embed Request
+type OllamaEmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// Ollama Embed Response
+type OllamaEmbedResponse struct {
+	Model           string      `json:"model"`
+	Embeddings      [][]float32 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count,omitempty"`
+}
+
+// Ollama generation statistics, only present on the final (done) response.
+// Durations are in nanoseconds.
+type OllamaStats struct {
+	DoneReason         string `json:"done_reason,omitempty"`
+	TotalDuration      int64  `json:"total_duration,omitempty"`
+	LoadDuration       int64  `json:"load_duration,omitempty"`
+	PromptEvalCount    int    `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64  `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int    `json:"eval_count,omitempty"`
+	EvalDuration       int64  `json:"eval_duration,omitempty"`
 }
 
 // Ollama Models Response
@@ -54,3 +83,20 @@ type OllamaModel struct {
 	Size       int64  `json:"size"`
 	Digest     string `json:"digest"`
 }
+
+// Ollama Version Response
+type OllamaVersionResponse struct {
+	Version string `json:"version"`
+}
+
+// Ollama Running Models Response (/api/ps)
+type OllamaProcessResponse struct {
+	Models []OllamaProcessModel `json:"models"`
+}
+
+type OllamaProcessModel struct {
+	Name      string `json:"name"`
+	Model     string `json:"model"`
+	ExpiresAt string `json:"expires_at"`
+	SizeVRAM  int64  `json:"size_vram"`
+}
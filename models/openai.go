@@ -19,12 +19,49 @@ type ChatCompletionRequest struct {
 	FrequencyPenalty *float64               `json:"frequency_penalty,omitempty"`
 	LogitBias        map[string]interface{} `json:"logit_bias,omitempty"`
 	User             string                 `json:"user,omitempty"`
+	Logprobs         *bool                  `json:"logprobs,omitempty"`
+	TopLogprobs      *int                   `json:"top_logprobs,omitempty"`
+	Tools            []Tool                 `json:"tools,omitempty"`
+	ToolChoice       interface{}            `json:"tool_choice,omitempty"`
+
+	// llama.cpp extensions, ignored by Ollama: a GBNF grammar constraining
+	// the output, and the server slot to run in
+	Grammar string `json:"grammar,omitempty"`
+	IDSlot  *int   `json:"id_slot,omitempty"`
 }
 
 type ChatMessage struct {
-	Role    string      `json:"role"`
-	Content interface{} `json:"content"`
-	Name    string      `json:"name,omitempty"`
+	Role       string      `json:"role"`
+	Content    interface{} `json:"content"`
+	Name       string      `json:"name,omitempty"`
+	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
+	ToolCallID string      `json:"tool_call_id,omitempty"`
+}
+
+// Tool is a function the model may call.
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+// ToolCall is a call the model made. Index is only set in stream deltas,
+// where the arguments of a call may be split across chunks.
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
 }
 
 // GetContentAsString returns content as string, handling both string and array formats
@@ -49,6 +86,8 @@ func (m *ChatMessage) GetContentAsString() string {
 		return strings.Join(parts, " ")
 	case []string:
 		return strings.Join(content, " ")
+	case nil:
+		return "" // assistant messages with only tool calls
 	default:
 		return fmt.Sprintf("%v", content)
 	}
@@ -62,12 +101,32 @@ type ChatCompletionResponse struct {
 	Model   string                 `json:"model"`
 	Choices []ChatCompletionChoice `json:"choices"`
 	Usage   ChatCompletionUsage    `json:"usage"`
+	IDSlot  *int                   `json:"id_slot,omitempty"` // llama.cpp slot that ran the request
 }
 
 type ChatCompletionChoice struct {
-	Index        int         `json:"index"`
-	Message      ChatMessage `json:"message"`
-	FinishReason string      `json:"finish_reason"`
+	Index        int           `json:"index"`
+	Message      ChatMessage   `json:"message"`
+	Logprobs     *ChatLogprobs `json:"logprobs,omitempty"`
+	FinishReason string        `json:"finish_reason"`
+}
+
+// Chat log probabilities, one entry per generated token
+type ChatLogprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
 }
 
 type ChatCompletionUsage struct {
@@ -83,17 +142,20 @@ type ChatCompletionStreamResponse struct {
 	Created int64                        `json:"created"`
 	Model   string                       `json:"model"`
 	Choices []ChatCompletionStreamChoice `json:"choices"`
+	IDSlot  *int                         `json:"id_slot,omitempty"`
 }
 
 type ChatCompletionStreamChoice struct {
 	Index        int                       `json:"index"`
 	Delta        ChatCompletionStreamDelta `json:"delta"`
+	Logprobs     *ChatLogprobs             `json:"logprobs,omitempty"`
 	FinishReason *string                   `json:"finish_reason"`
 }
 
 type ChatCompletionStreamDelta struct {
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role      string     `json:"role,omitempty"`
+	Content   string     `json:"content,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
 
 // Text Completions Request
@@ -112,6 +174,10 @@ type CompletionRequest struct {
 	FrequencyPenalty *float64    `json:"frequency_penalty,omitempty"`
 	BestOf           *int        `json:"best_of,omitempty"`
 	User             string      `json:"user,omitempty"`
+
+	// llama.cpp extensions, see ChatCompletionRequest
+	Grammar string `json:"grammar,omitempty"`
+	IDSlot  *int   `json:"id_slot,omitempty"`
 }
 
 // Text Completions Response
@@ -122,13 +188,22 @@ type CompletionResponse struct {
 	Model   string             `json:"model"`
 	Choices []CompletionChoice `json:"choices"`
 	Usage   CompletionUsage    `json:"usage"`
+	IDSlot  *int               `json:"id_slot,omitempty"`
 }
 
 type CompletionChoice struct {
-	Text         string `json:"text"`
-	Index        int    `json:"index"`
-	Logprobs     *int   `json:"logprobs"`
-	FinishReason string `json:"finish_reason"`
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *CompletionLogprobs `json:"logprobs"`
+	FinishReason string              `json:"finish_reason"`
+}
+
+// Text completion log probabilities, in the legacy parallel array format
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
 }
 
 type CompletionUsage struct {
@@ -137,6 +212,33 @@ type CompletionUsage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
+// Embeddings Request
+type EmbeddingRequest struct {
+	Model          string      `json:"model"`
+	Input          interface{} `json:"input"`
+	EncodingFormat string      `json:"encoding_format,omitempty"`
+	User           string      `json:"user,omitempty"`
+}
+
+// Embeddings Response
+type EmbeddingResponse struct {
+	Object string         `json:"object"`
+	Data   []Embedding    `json:"data"`
+	Model  string         `json:"model"`
+	Usage  EmbeddingUsage `json:"usage"`
+}
+
+type Embedding struct {
+	Object    string    `json:"object"`
+	Embedding []float32 `json:"embedding"`
+	Index     int       `json:"index"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
 // Models Response
 type ModelsResponse struct {
 	Object string  `json:"object"`
@@ -156,7 +258,9 @@ type ErrorResponse struct {
 }
 
 type ErrorDetail struct {
-	Message string `json:"message"`
-	Type    string `json:"type"`
-	Code    string `json:"code,omitempty"`
+	Message   string  `json:"message"`
+	Type      string  `json:"type"`
+	Param     *string `json:"param"`
+	Code      string  `json:"code,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
 }
@@ -0,0 +1,288 @@
+// Package ollamatest provides a fake Ollama server for tests. It answers
+// /api/chat, /api/generate, /api/embed, /api/tags, /api/ps and /api/version
+// with deterministic responses, streams NDJSON like Ollama, and can be told
+// to fail requests for a model.
+package ollamatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"openai-compatible/models"
+)
+
+// Version is reported by /api/version.
+const Version = "0.5.7-test"
+
+// createdAt is the fixed timestamp of every response.
+const createdAt = "2024-01-01T00:00:00Z"
+
+// Failure makes the requests for a model fail.
+type Failure struct {
+	// Status is the HTTP status of the error response. Zero fails a stream
+	// after AfterChunks lines with an error line instead.
+	Status      int
+	Message     string
+	AfterChunks int
+}
+
+// Server is a fake Ollama listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	models   []string
+	failures map[string]Failure
+	requests map[string]int
+	bodies   map[string][]byte
+}
+
+// NewServer starts a fake Ollama serving the named models. Requests for
+// other models fail with Ollama's "not found" error.
+func NewServer(names ...string) *Server {
+	s := &Server{
+		models:   names,
+		failures: make(map[string]Failure),
+		requests: make(map[string]int),
+		bodies:   make(map[string][]byte),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/chat", s.chat)
+	mux.HandleFunc("/api/generate", s.generate)
+	mux.HandleFunc("/api/embed", s.embed)
+	mux.HandleFunc("/api/tags", s.tags)
+	mux.HandleFunc("/api/ps", s.ps)
+	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, models.OllamaVersionResponse{Version: Version})
+	})
+	s.Server = httptest.NewServer(s.count(mux))
+	return s
+}
+
+// Fail makes every later request for model fail.
+func (s *Server) Fail(model string, f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[model] = f
+}
+
+// Requests returns how many requests were made to path.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// LastRequest returns the body of the latest request to path, or nil.
+func (s *Server) LastRequest(path string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bodies[path]
+}
+
+// Reply is the answer of the fake to a chat message or prompt.
+func Reply(text string) string {
+	return "You said: " + text
+}
+
+// Embedding is the fake embedding of text.
+func Embedding(text string) []float32 {
+	return []float32{float32(len(text) % 7), 1, 0.5}
+}
+
+func (s *Server) count(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		s.bodies[r.URL.Path] = body
+		s.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check answers requests for unknown or failing models with an error and
+// returns false. A failure mid-stream is returned for the caller to apply.
+func (s *Server) check(w http.ResponseWriter, model string) (Failure, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.failures[model]; ok {
+		if f.Status != 0 {
+			writeJSON(w, f.Status, map[string]string{"error": f.Message})
+			return f, false
+		}
+		return f, true
+	}
+	for _, m := range s.models {
+		if m == model {
+			return Failure{}, true
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{
+		"error": fmt.Sprintf("model %q not found, try pulling it first", model),
+	})
+	return Failure{}, false
+}
+
+func (s *Server) chat(w http.ResponseWriter, r *http.Request) {
+	var req models.OllamaChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	failure, ok := s.check(w, req.Model)
+	if !ok {
+		return
+	}
+
+	var prompt, last string
+	for _, msg := range req.Messages {
+		prompt += msg.GetContentAsString() + " "
+		last = msg.GetContentAsString()
+	}
+	reply := Reply(last)
+	stats := stats(prompt, reply)
+
+	if !req.Stream {
+		writeJSON(w, http.StatusOK, models.OllamaChatResponse{
+			Model:       req.Model,
+			CreatedAt:   createdAt,
+			Message:     models.ChatMessage{Role: "assistant", Content: reply},
+			Done:        true,
+			OllamaStats: stats,
+		})
+		return
+	}
+
+	stream(w, reply, failure, func(piece string, done bool) any {
+		resp := models.OllamaChatResponse{
+			Model:     req.Model,
+			CreatedAt: createdAt,
+			Message:   models.ChatMessage{Role: "assistant", Content: piece},
+			Done:      done,
+		}
+		if done {
+			resp.OllamaStats = stats
+		}
+		return resp
+	})
+}
+
+func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
+	var req models.OllamaGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	failure, ok := s.check(w, req.Model)
+	if !ok {
+		return
+	}
+
+	reply := Reply(req.Prompt)
+	stats := stats(req.Prompt, reply)
+
+	if !req.Stream {
+		writeJSON(w, http.StatusOK, models.OllamaGenerateResponse{
+			Model:       req.Model,
+			CreatedAt:   createdAt,
+			Response:    reply,
+			Done:        true,
+			OllamaStats: stats,
+		})
+		return
+	}
+
+	stream(w, reply, failure, func(piece string, done bool) any {
+		resp := models.OllamaGenerateResponse{
+			Model:     req.Model,
+			CreatedAt: createdAt,
+			Response:  piece,
+			Done:      done,
+		}
+		if done {
+			resp.OllamaStats = stats
+		}
+		return resp
+	})
+}
+
+func (s *Server) embed(w http.ResponseWriter, r *http.Request) {
+	var req models.OllamaEmbedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if _, ok := s.check(w, req.Model); !ok {
+		return
+	}
+
+	resp := models.OllamaEmbedResponse{Model: req.Model}
+	for _, text := range req.Input {
+		resp.Embeddings = append(resp.Embeddings, Embedding(text))
+		resp.PromptEvalCount += len(strings.Fields(text))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) tags(w http.ResponseWriter, r *http.Request) {
+	resp := models.OllamaModelsResponse{Models: []models.OllamaModel{}}
+	for _, name := range s.models {
+		resp.Models = append(resp.Models, models.OllamaModel{
+			Name:       name,
+			ModifiedAt: createdAt,
+			Size:       1 << 30,
+			Digest:     "sha256:" + strings.Repeat("0", 64),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) ps(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, models.OllamaProcessResponse{Models: []models.OllamaProcessModel{}})
+}
+
+// stream writes reply as NDJSON, one line per word and a final done line.
+// line builds the response object of each line.
+func stream(w http.ResponseWriter, reply string, failure Failure, line func(piece string, done bool) any) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	for i, piece := range strings.SplitAfter(reply, " ") {
+		if failure.Message != "" && i == failure.AfterChunks {
+			enc.Encode(map[string]string{"error": failure.Message})
+			return
+		}
+		enc.Encode(line(piece, false))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	enc.Encode(line("", true))
+}
+
+func stats(prompt, reply string) models.OllamaStats {
+	return models.OllamaStats{
+		DoneReason:      "stop",
+		PromptEvalCount: len(strings.Fields(prompt)),
+		EvalCount:       len(strings.Fields(reply)),
+		EvalDuration:    int64(len(strings.Fields(reply))) * 10_000_000,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
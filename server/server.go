@@ -0,0 +1,318 @@
+// Package server assembles the gateway: providers, caches, handlers and the
+// Fiber app serving them.
+package server
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync"
+
+	"openai-compatible/cache"
+	"openai-compatible/config"
+	"openai-compatible/handlers"
+	"openai-compatible/lifecycle"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
+	"openai-compatible/middleware"
+	"openai-compatible/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+)
+
+// Version is the gateway version, set at build time with
+// -ldflags "-X openai-compatible/server.Version=...".
+var Version = "1.0.0"
+
+// Server is a configured gateway. App serves the HTTP API and Drainer tracks
+// its in-flight requests for graceful shutdown.
+type Server struct {
+	App     *fiber.App
+	Drainer *lifecycle.Drainer
+
+	stopHealthChecks context.CancelFunc
+
+	mu       sync.Mutex // serializes Reload
+	cfg      *config.Config
+	keys     *middleware.KeySet
+	registry *services.Registry
+}
+
+// New builds the gateway described by cfg and starts the backend health
+// checks. It fails on invalid configuration.
+func New(cfg *config.Config) (*Server, error) {
+	privacy, err := logging.ParsePrivacyLevel(cfg.LogPrivacy)
+	if err != nil {
+		return nil, err
+	}
+	if privacy == logging.PrivacyFull {
+		slog.Warn("LOG_PRIVACY=full, request bodies will be logged verbatim")
+	}
+
+	set, err := providers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	registry := set.registry
+
+	responses, err := cache.New(cfg.CacheBackend, cache.Options{
+		TTL:        cfg.CacheTTL,
+		MaxEntries: cfg.CacheMaxEntries,
+		Dir:        cfg.CacheDir,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var semantic *cache.Semantic
+	if cfg.SemanticCacheModel != "" {
+		semantic = cache.NewSemantic(registry, cache.SemanticOptions{
+			Model:      cfg.SemanticCacheModel,
+			Threshold:  cfg.SemanticCacheThreshold,
+			TTL:        cfg.SemanticCacheTTL,
+			MaxEntries: cfg.SemanticCacheMaxEntries,
+			MaxTotal:   cfg.SemanticCacheMaxTotal,
+		})
+	}
+
+	var flights *handlers.Flights
+	if cfg.CoalesceRequests {
+		flights = handlers.NewFlights(cfg.CoalesceStreams)
+	}
+
+	drainer := lifecycle.NewDrainer()
+	keys := middleware.NewKeySet(cfg)
+	metrics.AddModels(configuredModels(cfg)...)
+
+	// Create Fiber app
+	app := fiber.New(fiber.Config{
+		ServerHeader: "OpenAI-Compatible-API",
+		AppName:      "OpenAI Compatible API v" + Version,
+	})
+
+	// Middleware
+	app.Use(recover.New())
+	app.Use(middleware.RequestID())
+	app.Use(middleware.Tracing())
+	app.Use(middleware.RequestLogger(logging.NewRedactor(privacy, cfg.LogPromptChars)))
+	app.Use(metrics.Middleware())
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:  "*",
+		AllowMethods:  "GET,POST,HEAD,PUT,DELETE,PATCH,OPTIONS",
+		AllowHeaders:  "Origin,Content-Type,Accept,Authorization,Cache-Control," + middleware.RequestIDHeader,
+		ExposeHeaders: middleware.RequestIDHeader + "," + fiber.HeaderRetryAfter + ",X-Cache,X-Cache-Similarity,X-Coalesced",
+	}))
+
+	// Initialize handlers
+	chatHandler := handlers.NewChatHandler(registry, responses, semantic, flights)
+	completionsHandler := handlers.NewCompletionsHandler(registry, responses, flights)
+	modelsHandler := handlers.NewModelsHandler(registry)
+	healthHandler := handlers.NewHealthHandler(set.backends, drainer, cfg.RequiredModels, cfg.ReadinessCacheTTL)
+
+	// Health check endpoints (no auth required)
+	app.Get("/health", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"status":  "ok",
+			"message": "OpenAI Compatible API is running",
+		})
+	})
+	app.Get("/livez", healthHandler.Livez)
+	app.Get("/readyz", healthHandler.Readyz)
+
+	// Prometheus metrics (no auth required)
+	app.Get("/metrics", metrics.Handler())
+
+	// API routes with authentication
+	api := app.Group("/v1", middleware.AuthMiddleware(keys), drainer.Middleware())
+
+	// OpenAI compatible endpoints
+	api.Post("/chat/completions", chatHandler.ChatCompletions)
+	api.Post("/completions", completionsHandler.Completions)
+	api.Get("/models", modelsHandler.GetModels)
+
+	healthChecks, stopHealthChecks := context.WithCancel(context.Background())
+	// Replayed backends can't go down, and probes that weren't recorded
+	// would take them out of rotation.
+	if set.ollama != nil && cfg.CassetteMode != services.CassetteReplay {
+		set.ollama.StartHealthChecks(healthChecks, cfg.HealthCheckInterval)
+	}
+	for _, provider := range set.llamaCpp {
+		provider.StartHealthChecks(healthChecks, cfg.HealthCheckInterval)
+	}
+
+	return &Server{
+		App:              app,
+		Drainer:          drainer,
+		stopHealthChecks: stopHealthChecks,
+		cfg:              cfg,
+		keys:             keys,
+		registry:         registry,
+	}, nil
+}
+
+// reloadable are the settings Reload applies, by Config field name.
+var reloadable = map[string]bool{
+	"APIKey":              true,
+	"APIKeys":             true,
+	"ModelAliases":        true,
+	"ModelRoutes":         true,
+	"OllamaModel":         true,
+	"FallbackModels":      true,
+	"RetryMaxAttempts":    true,
+	"RetryBaseDelay":      true,
+	"RetryMaxDelay":       true,
+	"MaxParallelPerModel": true,
+	"QueueSize":           true,
+	"QueueTimeout":        true,
+	"StreamIdleTimeout":   true,
+	"LogLevel":            true,
+}
+
+// Reload switches the running gateway to cfg, which must come from
+// config.Load. API keys, model aliases and routes, the default and fallback
+// models, the retries, limits and stream idle timeout of every provider and
+// the log level change in place; requests already running finish with the old
+// settings. Other changed settings are logged and need a restart. Nothing
+// is applied if Reload fails.
+func (s *Server) Reload(cfg *config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := config.Diff(s.cfg, cfg)
+	if len(changes) == 0 {
+		slog.Info("configuration reloaded, nothing changed")
+		return nil
+	}
+
+	// Settings that need a restart keep their running value
+	applied := *s.cfg
+	for _, change := range changes {
+		if reloadable[change.Setting] {
+			field := reflect.ValueOf(&applied).Elem().FieldByName(change.Setting)
+			field.Set(reflect.ValueOf(cfg).Elem().FieldByName(change.Setting))
+		}
+	}
+
+	if err := s.registry.Reload(applied.ModelRoutes, applied.ModelAliases); err != nil {
+		return err
+	}
+	s.registry.ReloadProviders(&applied)
+	s.keys.Update(&applied)
+	// The level was validated by config.Load
+	_ = logging.SetLevel(applied.LogLevel)
+	metrics.AddModels(configuredModels(&applied)...)
+	s.cfg = &applied
+
+	for _, change := range changes {
+		if reloadable[change.Setting] {
+			slog.Info("configuration changed", "setting", change.Setting, "old", change.Old, "new", change.New)
+		} else {
+			slog.Warn("configuration changed, restart to apply", "setting", change.Setting, "old", change.Old, "new", change.New)
+		}
+	}
+	return nil
+}
+
+// Close stops the background health checks. It doesn't stop App.
+func (s *Server) Close() {
+	s.stopHealthChecks()
+}
+
+// configuredModels lists the models cfg names, which get their own metrics
+// label values.
+func configuredModels(cfg *config.Config) []string {
+	models := []string{cfg.OllamaModel, cfg.SemanticCacheModel}
+	models = append(models, cfg.FallbackModels...)
+	models = append(models, cfg.RequiredModels...)
+	for alias, model := range cfg.ModelAliases {
+		models = append(models, alias, model)
+	}
+	for model := range cfg.ModelRoutes {
+		models = append(models, model)
+	}
+	return models
+}
+
+// NewRegistry creates the providers of cfg and the registry routing
+// requests between them. Unlike New, it starts no health checks.
+func NewRegistry(cfg *config.Config) (*services.Registry, error) {
+	set, err := providers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return set.registry, nil
+}
+
+// providerSet is what providers creates: the registry, the backends whose
+// health readiness checks, and the providers with periodic health checks.
+type providerSet struct {
+	registry *services.Registry
+	backends services.HealthCheckers
+	ollama   *services.OllamaService // nil when the mock provider replaces it
+	llamaCpp []*services.LlamaCppProvider
+}
+
+// providers creates the providers of cfg and the registry routing between
+// them.
+func providers(cfg *config.Config) (*providerSet, error) {
+	// Initialize services. The mock provider replaces Ollama entirely.
+	set := &providerSet{}
+	if cfg.MockProvider {
+		mock, err := services.NewMockProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+		set.registry, set.backends = services.NewRegistry("mock", mock), services.HealthCheckers{mock}
+	} else {
+		ollamaService, err := services.NewOllamaService(cfg)
+		if err != nil {
+			return nil, err
+		}
+		set.registry, set.backends = services.NewRegistry("ollama", ollamaService), services.HealthCheckers{ollamaService}
+		set.ollama = ollamaService
+	}
+	registry := set.registry
+
+	for _, upstream := range cfg.OpenAIUpstreams {
+		provider, err := services.NewOpenAIProvider(cfg, upstream)
+		if err != nil {
+			return nil, err
+		}
+		if err := register(registry, upstream, provider); err != nil {
+			return nil, err
+		}
+	}
+	for _, server := range cfg.LlamaCppServers {
+		provider, err := services.NewLlamaCppProvider(cfg, server)
+		if err != nil {
+			return nil, err
+		}
+		if err := register(registry, server, provider); err != nil {
+			return nil, err
+		}
+		set.backends = append(set.backends, provider)
+		set.llamaCpp = append(set.llamaCpp, provider)
+	}
+	for alias, model := range cfg.ModelAliases {
+		registry.Alias(alias, model)
+	}
+	for model, provider := range cfg.ModelRoutes {
+		if err := registry.Route(model, provider); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// register adds the provider of an upstream and routes its model prefix.
+func register(registry *services.Registry, upstream config.Upstream, provider services.Provider) error {
+	if err := registry.Register(upstream.Name, provider); err != nil {
+		return err
+	}
+	if upstream.Prefix == "" {
+		return nil
+	}
+	return registry.RoutePrefix(upstream.Prefix, upstream.Name)
+}
@@ -0,0 +1,524 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"openai-compatible/config"
+	"openai-compatible/gatewaytest"
+	"openai-compatible/models"
+	"openai-compatible/ollamatest"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestMain(m *testing.M) {
+	gatewaytest.Main(m)
+}
+
+// newGateway starts a gateway in front of a fake Ollama and returns its app.
+// env overrides the test configuration.
+func newGateway(t *testing.T, env map[string]string) (*fiber.App, *ollamatest.Server) {
+	t.Helper()
+	srv, ollama := gatewaytest.New(t, env)
+	return srv.App, ollama
+}
+
+func chatRequest(model, content string, stream bool) map[string]any {
+	return map[string]any{
+		"model":    model,
+		"messages": []map[string]string{{"role": "user", "content": content}},
+		"stream":   stream,
+	}
+}
+
+var (
+	idPattern        = regexp.MustCompile(`"id":"chatcmpl-\d+"`)
+	createdPattern   = regexp.MustCompile(`"created":\d+`)
+	requestIDPattern = regexp.MustCompile(`"request_id":"[^"]*"`)
+)
+
+// normalize replaces the parts of a response that change between runs.
+func normalize(data []byte) []byte {
+	data = idPattern.ReplaceAll(data, []byte(`"id":"chatcmpl-0"`))
+	data = createdPattern.ReplaceAll(data, []byte(`"created":0`))
+	return requestIDPattern.ReplaceAll(data, []byte(`"request_id":"req-0"`))
+}
+
+// golden compares got with testdata/name, or rewrites the file with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+	got = normalize(got)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file (run with -update to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s:\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+func decodeError(t *testing.T, data []byte) models.ErrorDetail {
+	t.Helper()
+
+	var resp models.ErrorResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("decoding error body %q: %v", data, err)
+	}
+	return resp.Error
+}
+
+func TestChatCompletion(t *testing.T) {
+	app, _ := newGateway(t, nil)
+
+	resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, chatRequest(gatewaytest.Model, "hello there", false))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+
+	var chat models.ChatCompletionResponse
+	if err := json.Unmarshal(body, &chat); err != nil {
+		t.Fatal(err)
+	}
+	if chat.Object != "chat.completion" || chat.Model != gatewaytest.Model {
+		t.Errorf("object, model = %q, %q", chat.Object, chat.Model)
+	}
+	if len(chat.Choices) != 1 {
+		t.Fatalf("got %d choices", len(chat.Choices))
+	}
+	choice := chat.Choices[0]
+	if got, want := choice.Message.GetContentAsString(), ollamatest.Reply("hello there"); got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+	if choice.Message.Role != "assistant" || choice.FinishReason != "stop" {
+		t.Errorf("role, finish reason = %q, %q", choice.Message.Role, choice.FinishReason)
+	}
+	if resp.Header.Get("X-Request-ID") == "" {
+		t.Error("missing X-Request-ID header")
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	app, _ := newGateway(t, nil)
+
+	resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, chatRequest(gatewaytest.Model, "stream this", true))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	golden(t, "chat_stream.golden", body)
+}
+
+func TestChatCompletionStreamError(t *testing.T) {
+	app, ollama := newGateway(t, nil)
+	ollama.Fail(gatewaytest.Model, ollamatest.Failure{Message: "model runner crashed", AfterChunks: 2})
+
+	resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, chatRequest(gatewaytest.Model, "stream this", true))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	golden(t, "chat_stream_error.golden", body)
+}
+
+func TestCompletion(t *testing.T) {
+	app, _ := newGateway(t, nil)
+
+	resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/completions", gatewaytest.Key, map[string]any{
+		"model":  gatewaytest.Model,
+		"prompt": []string{"once upon", "a time"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+
+	var completion models.CompletionResponse
+	if err := json.Unmarshal(body, &completion); err != nil {
+		t.Fatal(err)
+	}
+	if completion.Object != "text_completion" || len(completion.Choices) != 1 {
+		t.Fatalf("unexpected response %s", body)
+	}
+	if got, want := completion.Choices[0].Text, ollamatest.Reply("once upon\na time"); got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+}
+
+func TestModels(t *testing.T) {
+	app, _ := newGateway(t, nil)
+
+	resp, body := gatewaytest.Do(t, app, http.MethodGet, "/v1/models", gatewaytest.Key, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+
+	var list models.ModelsResponse
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.ID)
+		if m.Object != "model" || m.OwnedBy != "ollama" {
+			t.Errorf("model %+v", m)
+		}
+	}
+	if got, want := strings.Join(ids, ","), gatewaytest.Model+","+gatewaytest.OtherModel; got != want {
+		t.Errorf("models = %s, want %s", got, want)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	app, ollama := newGateway(t, nil)
+
+	tests := []struct {
+		name   string
+		header string
+		code   string
+	}{
+		{"missing header", "", "missing_authorization"},
+		{"not bearer", "Basic " + gatewaytest.Key, "invalid_authorization_format"},
+		{"wrong key", "Bearer sk-wrong", "invalid_api_key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"x","messages":[]}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("status = %d, want 401", resp.StatusCode)
+			}
+			if e := decodeError(t, body); e.Code != tt.code || e.RequestID == "" {
+				t.Errorf("error = %+v, want code %s with a request ID", e, tt.code)
+			}
+		})
+	}
+
+	if n := ollama.Requests("/api/chat"); n != 0 {
+		t.Errorf("%d unauthenticated requests reached Ollama", n)
+	}
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		failure  *ollamatest.Failure
+		status   int
+		errType  string
+		code     string
+		param    string
+		attempts int
+	}{
+		{
+			name:     "model not pulled",
+			model:    "missing:latest",
+			status:   http.StatusNotFound,
+			errType:  "invalid_request_error",
+			code:     "model_not_found",
+			param:    "model",
+			attempts: 1,
+		},
+		{
+			name:     "invalid option",
+			model:    gatewaytest.Model,
+			failure:  &ollamatest.Failure{Status: http.StatusBadRequest, Message: "invalid value for option temperature"},
+			status:   http.StatusBadRequest,
+			errType:  "invalid_request_error",
+			code:     "invalid_request",
+			param:    "temperature",
+			attempts: 1,
+		},
+		{
+			name:     "context overflow",
+			model:    gatewaytest.Model,
+			failure:  &ollamatest.Failure{Status: http.StatusBadRequest, Message: "input length exceeds the context length"},
+			status:   http.StatusBadRequest,
+			errType:  "invalid_request_error",
+			code:     "context_length_exceeded",
+			param:    "messages",
+			attempts: 1,
+		},
+		{
+			name:     "server error",
+			model:    gatewaytest.Model,
+			failure:  &ollamatest.Failure{Status: http.StatusInternalServerError, Message: "llama runner process has terminated"},
+			status:   http.StatusBadGateway,
+			errType:  "server_error",
+			code:     "upstream_error",
+			attempts: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, ollama := newGateway(t, nil)
+			if tt.failure != nil {
+				ollama.Fail(tt.model, *tt.failure)
+			}
+
+			resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, chatRequest(tt.model, "hi", false))
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d, body %s", resp.StatusCode, tt.status, body)
+			}
+			e := decodeError(t, body)
+			param := ""
+			if e.Param != nil {
+				param = *e.Param
+			}
+			if e.Type != tt.errType || e.Code != tt.code || param != tt.param {
+				t.Errorf("error = %s/%s/%q, want %s/%s/%q", e.Type, e.Code, param, tt.errType, tt.code, tt.param)
+			}
+			if n := ollama.Requests("/api/chat"); n != tt.attempts {
+				t.Errorf("Ollama got %d requests, want %d", n, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestUpstreamUnreachable(t *testing.T) {
+	app, ollama := newGateway(t, nil)
+	ollama.Close()
+
+	resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, chatRequest(gatewaytest.Model, "hi", false))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503, body %s", resp.StatusCode, body)
+	}
+	if e := decodeError(t, body); e.Code != "upstream_unavailable" {
+		t.Errorf("code = %s, want upstream_unavailable", e.Code)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	app, _ := newGateway(t, nil)
+
+	resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, map[string]any{"model": gatewaytest.Model})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+	if e := decodeError(t, body); e.Code != "missing_messages" {
+		t.Errorf("code = %s, want missing_messages", e.Code)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	app, ollama := newGateway(t, map[string]string{"CACHE_BACKEND": "memory"})
+
+	req := chatRequest(gatewaytest.Model, "cache me", false)
+	req["temperature"] = 0
+	for i, want := range []string{"MISS", "HIT"} {
+		resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, body %s", i+1, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache = %q, want %q", i+1, got, want)
+		}
+	}
+	if n := ollama.Requests("/api/chat"); n != 1 {
+		t.Errorf("Ollama got %d requests, want 1", n)
+	}
+}
+
+func TestResponseCacheAlias(t *testing.T) {
+	app, ollama := newGateway(t, map[string]string{
+		"CACHE_BACKEND": "memory",
+		"MODEL_ALIASES": "gpt-4o=" + gatewaytest.Model,
+	})
+
+	for i, model := range []string{gatewaytest.Model, "gpt-4o"} {
+		req := chatRequest(model, "cache me", false)
+		req["temperature"] = 0
+		resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status = %d, body %s", i+1, resp.StatusCode, body)
+		}
+	}
+	if n := ollama.Requests("/api/chat"); n != 1 {
+		t.Errorf("Ollama got %d requests, want 1 as the alias shares the cache entry", n)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	app, _ := newGateway(t, map[string]string{"REQUIRED_MODELS": gatewaytest.Model})
+
+	resp, body := gatewaytest.Do(t, app, http.MethodGet, "/readyz", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	var ready struct {
+		Status   string `json:"status"`
+		Backends []struct {
+			Status  string `json:"status"`
+			Version string `json:"version"`
+		} `json:"backends"`
+	}
+	if err := json.Unmarshal(body, &ready); err != nil {
+		t.Fatal(err)
+	}
+	if ready.Status != "ready" || len(ready.Backends) != 1 || ready.Backends[0].Version != ollamatest.Version {
+		t.Errorf("readiness = %s", body)
+	}
+}
+
+func TestReadinessListsLlamaCppServers(t *testing.T) {
+	loading := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"error":{"code":503,"message":"Loading model","type":"unavailable_error"}}`)
+	}))
+	defer loading.Close()
+	app, _ := newGateway(t, map[string]string{
+		"LLAMACPP_SERVERS":          "local",
+		"LLAMACPP_SERVER_LOCAL_URL": loading.URL,
+	})
+
+	resp, body := gatewaytest.Do(t, app, http.MethodGet, "/readyz", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	var ready struct {
+		Backends []struct {
+			Name   string `json:"name"`
+			Status string `json:"status"`
+		} `json:"backends"`
+	}
+	if err := json.Unmarshal(body, &ready); err != nil {
+		t.Fatal(err)
+	}
+	if len(ready.Backends) != 2 || ready.Backends[1].Name != "local" || ready.Backends[1].Status != "down" {
+		t.Errorf("readiness = %s, want Ollama and the loading llama.cpp server listed", body)
+	}
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	requests := []map[string]any{
+		chatRequest(gatewaytest.Model, "record this", false),
+		chatRequest(gatewaytest.Model, "stream this", true),
+		chatRequest(gatewaytest.OtherModel, "stream this", true),
+	}
+
+	app, ollama := newGateway(t, map[string]string{"CASSETTE_MODE": "record", "CASSETTE_DIR": dir})
+	ollama.Fail(gatewaytest.OtherModel, ollamatest.Failure{Message: "model runner crashed", AfterChunks: 1})
+	recorded := make([][]byte, len(requests))
+	for i, req := range requests {
+		resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("recording request %d: status = %d, body %s", i+1, resp.StatusCode, body)
+		}
+		recorded[i] = normalize(body)
+	}
+	ollama.Close()
+
+	app, ollama = newGateway(t, map[string]string{
+		"CASSETTE_MODE":          "replay",
+		"CASSETTE_DIR":           dir,
+		"CASSETTE_REPLAY_TIMING": "false",
+		"RETRY_MAX_ATTEMPTS":     "1",
+	})
+	for i, req := range requests {
+		resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("replaying request %d: status = %d, body %s", i+1, resp.StatusCode, body)
+		}
+		if got := normalize(body); !bytes.Equal(got, recorded[i]) {
+			t.Errorf("replayed request %d differs:\n--- got\n%s\n--- recorded\n%s", i+1, got, recorded[i])
+		}
+	}
+	if n := ollama.Requests("/api/chat"); n != 0 {
+		t.Errorf("Ollama got %d requests while replaying", n)
+	}
+
+	resp, body := gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, chatRequest(gatewaytest.Model, "never recorded", false))
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("request without a cassette succeeded: %s", body)
+	}
+}
+
+func TestReload(t *testing.T) {
+	srv, _ := gatewaytest.New(t, nil)
+	const newKey = "sk-reloaded-key-654321"
+
+	t.Setenv("API_KEY", newKey)
+	t.Setenv("MODEL_ALIASES", "gpt-4o="+gatewaytest.Model)
+	t.Setenv("PORT", "9090") // needs a restart, logged only
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("config.Load: %v", err)
+	}
+	if err := srv.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	resp, _ := gatewaytest.Do(t, srv.App, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, chatRequest(gatewaytest.Model, "hi", false))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("old key: status = %d, want 401", resp.StatusCode)
+	}
+	resp, body := gatewaytest.Do(t, srv.App, http.MethodPost, "/v1/chat/completions", newKey, chatRequest("gpt-4o", "hi", false))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("alias with the new key: status = %d, body %s", resp.StatusCode, body)
+	}
+
+	// A route to an unknown provider is rejected as a whole
+	t.Setenv("API_KEY", gatewaytest.Key)
+	t.Setenv("MODEL_ROUTES", "gpt-4o=nowhere")
+	if cfg, err = config.Load(""); err != nil {
+		t.Fatalf("config.Load: %v", err)
+	}
+	if err := srv.Reload(cfg); err == nil {
+		t.Fatal("Reload accepted a route to an unknown provider")
+	}
+	resp, body = gatewaytest.Do(t, srv.App, http.MethodPost, "/v1/chat/completions", newKey, chatRequest("gpt-4o", "hi", false))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("after a failed reload: status = %d, body %s", resp.StatusCode, body)
+	}
+}
+
+func TestMetricsModelLabel(t *testing.T) {
+	app, _ := newGateway(t, nil)
+
+	for _, model := range []string{gatewaytest.Model, "no-such-model-1", "no-such-model-2"} {
+		gatewaytest.Do(t, app, http.MethodPost, "/v1/chat/completions", gatewaytest.Key, chatRequest(model, "hi", false))
+	}
+
+	_, body := gatewaytest.Do(t, app, http.MethodGet, "/metrics", "", nil)
+	metrics := string(body)
+	if !strings.Contains(metrics, `model="`+gatewaytest.Model+`"`) {
+		t.Errorf("no series for the configured model %s", gatewaytest.Model)
+	}
+	if strings.Contains(metrics, "no-such-model") {
+		t.Error("unknown models got their own series")
+	}
+	if !strings.Contains(metrics, `model="other",route="/v1/chat/completions",status="404"`) {
+		t.Error("unknown models aren't labelled other")
+	}
+}
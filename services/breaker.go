@@ -0,0 +1,145 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops sending traffic to an upstream after threshold
+// consecutive failures. Once openFor has passed a single trial request is let
+// through; its outcome closes the breaker again or re-opens it.
+type circuitBreaker struct {
+	threshold int
+	openFor   time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trial    bool // a half-open trial request is in flight
+}
+
+func newCircuitBreaker(threshold int, openFor time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		openFor:   openFor,
+	}
+}
+
+// allow reports whether a request may be sent. In the half-open state only
+// the first caller gets through.
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// available is like allow but doesn't claim the half-open trial slot.
+func (b *circuitBreaker) available() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.openFor
+	case breakerHalfOpen:
+		return !b.trial
+	default:
+		return true
+	}
+}
+
+// success records a successful request. It reports whether this closed a
+// breaker that was open or half-open.
+func (b *circuitBreaker) success() bool {
+	if b.threshold <= 0 {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	changed := b.state != breakerClosed
+	b.state = breakerClosed
+	b.failures = 0
+	b.trial = false
+	return changed
+}
+
+// failure records a failed request. It reports whether this opened the
+// breaker.
+func (b *circuitBreaker) failure() bool {
+	if b.threshold <= 0 {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.trial = false
+		return true
+	}
+	return false
+}
+
+// abandon gives back a half-open trial slot when the request was cancelled
+// by us before the upstream could answer.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
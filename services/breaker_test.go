@@ -0,0 +1,134 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// expire moves the breaker's open time back so the open period is over.
+func expire(b *circuitBreaker) {
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-b.openFor)
+	b.mu.Unlock()
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := newCircuitBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if b.failure() {
+			t.Fatalf("failure %d opened the breaker before the threshold", i+1)
+		}
+		if !b.allow() {
+			t.Fatalf("closed breaker rejected a request after %d failures", i+1)
+		}
+	}
+	if !b.failure() {
+		t.Fatal("third failure did not open the breaker")
+	}
+	if got := b.currentState(); got != breakerOpen {
+		t.Fatalf("state = %s, want open", got)
+	}
+	if b.allow() || b.available() {
+		t.Fatal("open breaker let a request through")
+	}
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute)
+
+	b.failure()
+	if b.success() {
+		t.Fatal("success on a closed breaker reported a state change")
+	}
+	if b.failure() {
+		t.Fatal("failure count was not reset by the success in between")
+	}
+	if got := b.currentState(); got != breakerClosed {
+		t.Fatalf("state = %s, want closed", got)
+	}
+}
+
+func TestBreakerHalfOpenAllowsOneTrial(t *testing.T) {
+	b := newCircuitBreaker(1, time.Minute)
+	b.failure()
+	expire(b)
+
+	if !b.available() {
+		t.Fatal("breaker is not available after the open period")
+	}
+	if !b.allow() {
+		t.Fatal("first request after the open period was rejected")
+	}
+	if got := b.currentState(); got != breakerHalfOpen {
+		t.Fatalf("state = %s, want half_open", got)
+	}
+	if b.allow() || b.available() {
+		t.Fatal("half-open breaker let a second request through")
+	}
+}
+
+func TestBreakerHalfOpenTrialOutcome(t *testing.T) {
+	tests := []struct {
+		name    string
+		succeed bool
+		want    breakerState
+	}{
+		{name: "success closes", succeed: true, want: breakerClosed},
+		{name: "failure re-opens", succeed: false, want: breakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(3, time.Minute)
+			for i := 0; i < 3; i++ {
+				b.failure()
+			}
+			expire(b)
+			if !b.allow() {
+				t.Fatal("trial request was rejected")
+			}
+
+			var changed bool
+			if tt.succeed {
+				changed = b.success()
+			} else {
+				changed = b.failure()
+			}
+			if !changed {
+				t.Error("trial outcome did not report a state change")
+			}
+			if got := b.currentState(); got != tt.want {
+				t.Fatalf("state = %s, want %s", got, tt.want)
+			}
+			if allowed := b.allow(); allowed != tt.succeed {
+				t.Errorf("allow() = %v after the trial, want %v", allowed, tt.succeed)
+			}
+		})
+	}
+}
+
+func TestBreakerAbandonReleasesTrial(t *testing.T) {
+	b := newCircuitBreaker(1, time.Minute)
+	b.failure()
+	expire(b)
+
+	if !b.allow() {
+		t.Fatal("trial request was rejected")
+	}
+	b.abandon()
+	if !b.allow() {
+		t.Fatal("abandoned trial slot was not given back")
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		if b.failure() {
+			t.Fatal("disabled breaker opened")
+		}
+	}
+	if !b.allow() || !b.available() {
+		t.Fatal("disabled breaker rejected a request")
+	}
+}
@@ -0,0 +1,353 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cassette modes, see CASSETTE_MODE.
+const (
+	CassetteRecord = "record"
+	CassetteReplay = "replay"
+)
+
+// Cassette holds the recorded answers of Ollama to one request. Requests
+// are told apart by method, path and JSON body, not by backend, so a
+// cassette replays whatever backends are configured.
+type Cassette struct {
+	Request      CassetteRequest `json:"request"`
+	Interactions []Interaction   `json:"interactions"`
+}
+
+type CassetteRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Interaction is one recorded answer: a response, or the connection error
+// that happened instead. Lines are the response body split at newlines
+// with the time they arrived, which replays streaming NDJSON as it was
+// received. Incomplete is set if the body was cut off by an error, or a
+// stream was closed before its end.
+type Interaction struct {
+	RecordedAt  time.Time      `json:"recorded_at"`
+	Backend     string         `json:"backend"`
+	LatencyMs   int64          `json:"latency_ms"`
+	Status      int            `json:"status,omitempty"`
+	ContentType string         `json:"content_type,omitempty"`
+	Lines       []CassetteLine `json:"lines,omitempty"`
+	Incomplete  bool           `json:"incomplete,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+type CassetteLine struct {
+	OffsetMs int64  `json:"offset_ms"` // since the response headers
+	Data     string `json:"data"`
+}
+
+// cassetteTransport records the traffic to Ollama to cassette files in
+// dir, or serves it back from them. Repeated requests are appended to the
+// same cassette and replayed in order, the last answer repeating once all
+// were used, so retries and failovers replay like they happened. GET probes
+// of the health checks only keep their latest answer.
+type cassetteTransport struct {
+	mode   string
+	dir    string
+	timing bool // replay with the recorded latency and line timing
+	next   http.RoundTripper
+
+	mu        sync.Mutex
+	cassettes map[string]*Cassette
+	replayed  map[string]int
+}
+
+// newCassetteTransport creates the transport for mode. Replaying loads
+// every cassette of dir up front and fails if there are none. Recording
+// creates dir with the first cassette, so checking a configuration doesn't
+// write to disk.
+func newCassetteTransport(mode, dir string, timing bool) (*cassetteTransport, error) {
+	t := &cassetteTransport{
+		mode:      mode,
+		dir:       dir,
+		timing:    timing,
+		next:      http.DefaultTransport,
+		cassettes: make(map[string]*Cassette),
+		replayed:  make(map[string]int),
+	}
+
+	switch mode {
+	case CassetteRecord:
+	case CassetteReplay:
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no cassettes found in %s", dir)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("reading cassette: %w", err)
+			}
+			var c Cassette
+			if err := json.Unmarshal(data, &c); err != nil {
+				return nil, fmt.Errorf("parsing cassette %s: %w", file, err)
+			}
+			key, _ := cassetteKey(c.Request.Method, c.Request.Path, c.Request.Body)
+			t.cassettes[key] = &c
+		}
+	default:
+		return nil, fmt.Errorf("unknown CASSETTE_MODE %q, want record or replay", mode)
+	}
+	return t, nil
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	key, canonical := cassetteKey(req.Method, req.URL.Path, body)
+
+	if t.mode == CassetteReplay {
+		return t.replay(req, key)
+	}
+	return t.record(req, key, CassetteRequest{Method: req.Method, Path: req.URL.Path, Body: canonical})
+}
+
+func (t *cassetteTransport) record(req *http.Request, key string, creq CassetteRequest) (*http.Response, error) {
+	start := time.Now()
+	interaction := Interaction{RecordedAt: start.UTC(), Backend: req.URL.Host}
+
+	resp, err := t.next.RoundTrip(req)
+	interaction.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		interaction.Error = err.Error()
+		t.save(key, creq, interaction)
+		return nil, err
+	}
+
+	interaction.Status = resp.StatusCode
+	interaction.ContentType = resp.Header.Get("Content-Type")
+	resp.Body = &recordingBody{
+		body:   resp.Body,
+		start:  time.Now(),
+		stream: strings.Contains(interaction.ContentType, "ndjson"),
+		done: func(lines []CassetteLine, incomplete bool) {
+			interaction.Lines, interaction.Incomplete = lines, incomplete
+			t.save(key, creq, interaction)
+		},
+	}
+	return resp, nil
+}
+
+// save adds an interaction to the cassette of key and writes it out.
+// Failing to write a cassette doesn't fail the request.
+func (t *cassetteTransport) save(key string, creq CassetteRequest, interaction Interaction) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.cassettes[key]
+	if !ok {
+		c = &Cassette{Request: creq}
+		t.cassettes[key] = c
+	}
+	if creq.Method == http.MethodGet {
+		c.Interactions = c.Interactions[:0]
+	}
+	c.Interactions = append(c.Interactions, interaction)
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(t.dir, 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(t.dir, cassetteFile(creq.Path, key)), data, 0o644)
+	}
+	if err != nil {
+		slog.Warn("failed to write cassette", "path", creq.Path, "error", err)
+	}
+}
+
+func (t *cassetteTransport) replay(req *http.Request, key string) (*http.Response, error) {
+	t.mu.Lock()
+	c, ok := t.cassettes[key]
+	ok = ok && len(c.Interactions) > 0
+	var interaction Interaction
+	if ok {
+		i := t.replayed[key]
+		if i < len(c.Interactions)-1 {
+			t.replayed[key]++
+		}
+		interaction = c.Interactions[i]
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no cassette recorded for %s %s (%s)", req.Method, req.URL.Path, cassetteFile(req.URL.Path, key))
+	}
+
+	if t.timing {
+		if err := sleep(req.Context(), time.Duration(interaction.LatencyMs)*time.Millisecond); err != nil {
+			return nil, err
+		}
+	}
+	if interaction.Error != "" {
+		return nil, errors.New(interaction.Error)
+	}
+
+	header := make(http.Header)
+	if interaction.ContentType != "" {
+		header.Set("Content-Type", interaction.ContentType)
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", interaction.Status, http.StatusText(interaction.Status)),
+		StatusCode: interaction.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       replayBody(req.Context(), interaction, t.timing),
+		Request:    req,
+	}, nil
+}
+
+// replayBody serves the recorded lines, waiting for their offsets if
+// timing is set. An incomplete recording ends with an unexpected EOF.
+func replayBody(ctx context.Context, interaction Interaction, timing bool) io.ReadCloser {
+	var end error
+	if interaction.Incomplete {
+		end = io.ErrUnexpectedEOF
+	}
+
+	if !timing {
+		var buf bytes.Buffer
+		for _, line := range interaction.Lines {
+			buf.WriteString(line.Data + "\n")
+		}
+		if end == nil {
+			return io.NopCloser(&buf)
+		}
+		return io.NopCloser(io.MultiReader(&buf, errReader{end}))
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		start := time.Now()
+		for _, line := range interaction.Lines {
+			if err := sleep(ctx, time.Until(start.Add(time.Duration(line.OffsetMs)*time.Millisecond))); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := pw.Write([]byte(line.Data + "\n")); err != nil {
+				return
+			}
+		}
+		pw.CloseWithError(end)
+	}()
+	return pr
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// recordingBody splits a response body into lines as it's read and hands
+// them to done when the body is closed. Closing a whole response drains what
+// the reader didn't consume, e.g. after a JSON decoder stopped at the end of
+// the value. A stream closed before its end is recorded as incomplete
+// instead, since draining it would wait for the rest of the generation.
+type recordingBody struct {
+	body    io.ReadCloser
+	start   time.Time
+	stream  bool
+	partial []byte
+	lines   []CassetteLine
+	err     error
+	once    sync.Once
+	done    func(lines []CassetteLine, incomplete bool)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.add(p[:n])
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *recordingBody) add(data []byte) {
+	offset := time.Since(b.start).Milliseconds()
+	b.partial = append(b.partial, data...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			return
+		}
+		if line := strings.TrimSuffix(string(b.partial[:i]), "\r"); line != "" {
+			b.lines = append(b.lines, CassetteLine{OffsetMs: offset, Data: line})
+		}
+		b.partial = b.partial[i+1:]
+	}
+}
+
+func (b *recordingBody) Close() error {
+	b.once.Do(func() {
+		if b.err == nil && !b.stream {
+			io.Copy(io.Discard, readerFunc(b.Read))
+		}
+		if len(b.partial) > 0 {
+			b.lines = append(b.lines, CassetteLine{OffsetMs: time.Since(b.start).Milliseconds(), Data: string(b.partial)})
+		}
+		b.done(b.lines, b.err != io.EOF)
+	})
+	return b.body.Close()
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// cassetteKey identifies a request. JSON bodies are compared after
+// re-encoding, which sorts object keys; the canonical body is returned to
+// be stored in the cassette.
+func cassetteKey(method, path string, body []byte) (string, json.RawMessage) {
+	var canonical json.RawMessage
+	if len(body) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err == nil {
+			canonical, _ = json.Marshal(v)
+		} else {
+			canonical, _ = json.Marshal(string(body))
+		}
+	}
+	sum := sha256.Sum256([]byte(method + " " + path + "\n" + string(canonical)))
+	return hex.EncodeToString(sum[:6]), canonical
+}
+
+// cassetteFile names the cassette of a request, e.g. api-chat-1a2b3c4d5e6f.json.
+func cassetteFile(path, key string) string {
+	return strings.ReplaceAll(strings.Trim(path, "/"), "/", "-") + "-" + key + ".json"
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordFrom returns a client recording the traffic to handler in dir.
+func recordFrom(t *testing.T, dir string, handler http.HandlerFunc) (*http.Client, string) {
+	t.Helper()
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	transport, err := newCassetteTransport(CassetteRecord, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Transport: transport}, upstream.URL
+}
+
+// readCassette returns the only cassette in dir.
+func readCassette(t *testing.T, dir string) Cassette {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("cassettes = %v, want one", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCassetteRecordCreatesDirOnFirstSave(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cassettes")
+	client, url := recordFrom(t, dir, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"version":"0.5.0"}`+"\n")
+	})
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("the cassette directory was created before recording: %v", err)
+	}
+
+	resp, err := client.Get(url + "/api/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A JSON decoder stops at the end of the value, Close reads the rest
+	var v map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	c := readCassette(t, dir)
+	if i := c.Interactions[0]; i.Incomplete || len(i.Lines) != 1 {
+		t.Errorf("interaction = %+v, want one complete line", i)
+	}
+}
+
+// Closing a stream before its end doesn't wait for the rest of it.
+func TestCassetteRecordStreamClosedEarly(t *testing.T) {
+	dir := t.TempDir()
+	client, url := recordFrom(t, dir, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, `{"message":{"content":"one"},"done":false}`+"\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	resp, err := client.Post(url+"/api/chat", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		resp.Body.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the rest of the stream")
+	}
+
+	c := readCassette(t, dir)
+	if i := c.Interactions[0]; !i.Incomplete || len(i.Lines) != 1 {
+		t.Errorf("interaction = %+v, want one line, incomplete", i)
+	}
+}
+
+func TestCassetteRecordStreamReadToTheEnd(t *testing.T) {
+	dir := t.TempDir()
+	client, url := recordFrom(t, dir, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, `{"message":{"content":"one"},"done":false}`+"\n")
+		io.WriteString(w, `{"message":{"content":""},"done":true}`+"\n")
+	})
+
+	resp, err := client.Post(url+"/api/chat", "application/json", strings.NewReader(`{"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	c := readCassette(t, dir)
+	if i := c.Interactions[0]; i.Incomplete || len(i.Lines) != 2 {
+		t.Errorf("interaction = %+v, want two lines, complete", i)
+	}
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"openai-compatible/config"
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// upstreamResponse is a successful (200) answer from an Ollama backend. The
+// backend stays counted as in flight until release is called.
+type upstreamResponse struct {
+	*http.Response
+	up      *Upstream
+	model   string
+	release func()
+}
+
+// admit waits for a concurrency slot for model on one of the backends. The
+// slot must be released once the request to Ollama is done, for streams once
+// the stream has ended.
+func (s *OllamaService) admit(ctx context.Context, span trace.Span, model string) (*limiter.Slot, error) {
+	return acquireSlot(trace.ContextWithSpan(ctx, span), s.limiter, model)
+}
+
+// acquireSlot waits for a slot of l for model, noting the wait on the span
+// of ctx.
+func acquireSlot(ctx context.Context, l *limiter.Limiter, model string) (*limiter.Slot, error) {
+	start := time.Now()
+	slot, err := l.Acquire(ctx, model)
+	if waited := time.Since(start); waited >= time.Millisecond {
+		trace.SpanFromContext(ctx).AddEvent("queued", trace.WithAttributes(attribute.Int64("wait_ms", waited.Milliseconds())))
+		logging.FromContext(ctx).Debug("waited for a free slot", "model", model, "wait", waited)
+	}
+	return slot, err
+}
+
+// dispatch sends a POST to endpoint for model, retrying connection errors and
+// 5xx responses with exponential backoff. Each retry prefers a backend that
+// wasn't tried yet. When every attempt for a model failed, the configured
+// fallback models are tried in order, except for embeddings. build returns the request body for the
+// model being tried. The first attempt goes to the backend slot was admitted
+// to.
+func (s *OllamaService) dispatch(ctx context.Context, span trace.Span, slot *limiter.Slot, endpoint, model string, build func(model string) ([]byte, error)) (*upstreamResponse, error) {
+	logger := logging.FromContext(ctx)
+
+	cfg := s.config.Load()
+	retry := newRetryPolicy(cfg)
+
+	var lastErr error
+	for i, candidate := range candidateModels(cfg, endpoint, model) {
+		if i > 0 {
+			logger.Warn("falling back to another model", "model", model, "fallback", candidate, "error", lastErr)
+			metrics.ModelFallbacks.WithLabelValues(model, candidate).Inc()
+			span.AddEvent("fallback", trace.WithAttributes(attribute.String("gen_ai.request.model", candidate)))
+		}
+
+		body, err := build(candidate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+
+		tried := make(map[*Upstream]bool)
+		for attempt := 1; attempt <= retry.maxAttempts; attempt++ {
+			if attempt > 1 {
+				delay := retry.backoff(attempt - 1)
+				logger.Warn("Ollama request failed, retrying", "endpoint", endpoint, "attempt", attempt, "delay", delay, "error", lastErr)
+				metrics.UpstreamRetries.WithLabelValues(endpoint).Inc()
+				span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt)))
+				if err := sleep(ctx, delay); err != nil {
+					return nil, err
+				}
+			}
+
+			resp, err := s.send(ctx, span, slot, endpoint, candidate, body, tried)
+			if err == nil {
+				return resp, nil
+			}
+			lastErr = err
+			if !retryable(ctx, err) {
+				return nil, err
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// send makes a single attempt against one backend.
+func (s *OllamaService) send(ctx context.Context, span trace.Span, slot *limiter.Slot, endpoint, model string, body []byte, tried map[*Upstream]bool) (*upstreamResponse, error) {
+	up, err := s.pick(slot, model, tried)
+	if err != nil {
+		return nil, err
+	}
+	tried[up] = true
+
+	span.SetAttributes(attribute.String("server.address", up.URL))
+	logger := logging.FromContext(ctx)
+	logger.Debug("routing request to Ollama backend", "backend", up.Name(), "model", model)
+
+	release := up.acquire()
+
+	httpReq, err := s.newRequest(ctx, up, http.MethodPost, endpoint, body)
+	if err != nil {
+		release()
+		up.breaker.abandon()
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		release()
+		if ctx.Err() != nil {
+			up.breaker.abandon()
+			return nil, fmt.Errorf("failed to make request to Ollama: %w", err)
+		}
+		recordUpstreamError(up, endpoint, "connection")
+		s.recordFailure(ctx, up)
+		return nil, fmt.Errorf("failed to make request to Ollama: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		release()
+		recordUpstreamError(up, endpoint, statusReason(resp.StatusCode))
+		logger.Warn("Ollama returned an error", "backend", up.Name(), "endpoint", endpoint, "status", resp.StatusCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			s.recordFailure(ctx, up)
+		} else {
+			s.recordSuccess(ctx, up)
+		}
+		return nil, statusError(up.Name(), resp.StatusCode, body, model)
+	}
+
+	s.recordSuccess(ctx, up)
+	return &upstreamResponse{Response: resp, up: up, model: model, release: release}, nil
+}
+
+// pick takes the backend slot was admitted to, unless it was tried already
+// or stopped taking traffic since. Any other backend is picked by the pool
+// and the slot moves along, so the limiter counts the backend that serves
+// the request.
+func (s *OllamaService) pick(slot *limiter.Slot, model string, tried map[*Upstream]bool) (*Upstream, error) {
+	up := s.pool.Upstream(slot.Backend())
+	if up == nil || tried[up] || !up.Healthy() || !up.breaker.allow() {
+		var err error
+		if up, err = s.pool.Pick(model, tried); err != nil {
+			return nil, err
+		}
+	}
+	slot.Move(up.Name(), model)
+	return up, nil
+}
+
+// candidateModels lists model followed by the fallback models, without
+// duplicates. The fallbacks are generation models, so embeddings only ever
+// use the requested model.
+func candidateModels(cfg *config.Config, endpoint, model string) []string {
+	candidates := []string{model}
+	if endpoint == "/api/embed" {
+		return candidates
+	}
+	for _, fallback := range cfg.FallbackModels {
+		if fallback != model {
+			candidates = append(candidates, fallback)
+		}
+	}
+	return candidates
+}
+
+func (s *OllamaService) recordFailure(ctx context.Context, up *Upstream) {
+	if up.breaker.failure() {
+		logging.FromContext(ctx).Warn("circuit breaker opened for Ollama backend", "backend", up.Name(), "open_for", s.config.Load().BreakerOpenDuration)
+		metrics.SetCircuitOpen(up.Name(), true)
+	}
+}
+
+func (s *OllamaService) recordSuccess(ctx context.Context, up *Upstream) {
+	if up.breaker.success() {
+		logging.FromContext(ctx).Info("circuit breaker closed for Ollama backend", "backend", up.Name())
+		metrics.SetCircuitOpen(up.Name(), false)
+	}
+}
+
+// responseModel is the model reported back to the client: the requested one,
+// unless a fallback model answered.
+func responseModel(requested, asked, used string) string {
+	if used != asked {
+		return used
+	}
+	return requested
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"openai-compatible/limiter"
+)
+
+// errStreamIdle cancels a stream request when the upstream stops sending
+// data. The relay wraps it with the name of the upstream.
+var errStreamIdle = errors.New("no data within the stream idle timeout")
+
+// Error is a failure classified into an OpenAI style error. Handlers render
+// it with Status and the remaining fields as the error body.
+type Error struct {
+	Status  int
+	Type    string
+	Code    string
+	Param   string
+	Message string
+
+	// RetryAfter is sent as the Retry-After header when set.
+	RetryAfter time.Duration
+
+	// upstreamStatus is the status Ollama answered with, 0 if it didn't.
+	upstreamStatus int
+	err            error
+}
+
+func (e *Error) Error() string {
+	if e.err != nil {
+		return e.Message + ": " + e.err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// optionParams maps Ollama option names that show up in its error messages to
+// the OpenAI request parameter they came from. Longer names come first so
+// a message is matched the same way every time.
+var optionParams = []struct{ option, param string }{
+	{"frequency_penalty", "frequency_penalty"},
+	{"presence_penalty", "presence_penalty"},
+	{"temperature", "temperature"},
+	{"num_predict", "max_tokens"},
+	{"top_p", "top_p"},
+	{"stop", "stop"},
+}
+
+// statusError classifies a non-200 response from an Ollama instance for
+// model. backend names the instance, e.g. "ollama-1".
+func statusError(backend string, status int, body []byte, model string) *Error {
+	message := strings.TrimSpace(string(body))
+	var ollamaErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &ollamaErr) == nil && ollamaErr.Error != "" {
+		message = ollamaErr.Error
+	}
+	lower := strings.ToLower(message)
+
+	e := &Error{upstreamStatus: status, err: fmt.Errorf("%s API error (%d): %s", backend, status, message)}
+	switch {
+	case status == http.StatusNotFound && strings.Contains(lower, "not found"):
+		e.Status, e.Type, e.Code, e.Param = http.StatusNotFound, "invalid_request_error", "model_not_found", "model"
+		e.Message = fmt.Sprintf("The model `%s` does not exist or is not pulled on the Ollama server", model)
+	case isContextOverflow(lower):
+		e.Status, e.Type, e.Code, e.Param = http.StatusBadRequest, "invalid_request_error", "context_length_exceeded", "messages"
+		e.Message = "The request exceeds the model's context length: " + message
+	case status >= 400 && status < 500:
+		e.Status, e.Type, e.Code = http.StatusBadRequest, "invalid_request_error", "invalid_request"
+		e.Param = paramFromMessage(lower)
+		e.Message = message
+	default:
+		e.Status, e.Type, e.Code = http.StatusBadGateway, "server_error", "upstream_error"
+		e.Message = backend + " failed to process the request"
+	}
+	return e
+}
+
+func isContextOverflow(message string) bool {
+	for _, hint := range []string{"context length", "context window", "exceeds the maximum", "too many tokens", "prompt is too long", "context size"} {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+func paramFromMessage(message string) string {
+	for _, p := range optionParams {
+		if strings.Contains(message, p.option) {
+			return p.param
+		}
+	}
+	return ""
+}
+
+// streamError is a failure after a stream to the client has started.
+// backend names the upstream in the message, e.g. "Ollama".
+func streamError(backend, message string, err error) *Error {
+	return &Error{
+		Status:  http.StatusBadGateway,
+		Type:    "server_error",
+		Code:    "upstream_error",
+		Message: backend + " stream failed: " + message,
+		err:     err,
+	}
+}
+
+// streamReadError classifies an error reading a stream body.
+func streamReadError(backend string, err error) *Error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return Classify(&backendError{backend: backend, err: err})
+	}
+	return streamError(backend, "reading the response failed", err)
+}
+
+func streamIdleError(backend string, timeout time.Duration) *Error {
+	return &Error{
+		Status:  http.StatusGatewayTimeout,
+		Type:    "server_error",
+		Code:    "upstream_timeout",
+		Message: fmt.Sprintf("%s sent no data for %s", backend, timeout),
+		err:     errStreamIdle,
+	}
+}
+
+// invalidRequest is a request we refuse before it reaches Ollama.
+func invalidRequest(param, message string) *Error {
+	return &Error{
+		Status:  http.StatusBadRequest,
+		Type:    "invalid_request_error",
+		Code:    "invalid_request",
+		Param:   param,
+		Message: message,
+	}
+}
+
+// unsupportedParameter rejects a request parameter the provider can't honor,
+// rather than silently ignoring it.
+func unsupportedParameter(param, message string) *Error {
+	return &Error{
+		Status:  http.StatusBadRequest,
+		Type:    "invalid_request_error",
+		Code:    "unsupported_parameter",
+		Param:   param,
+		Message: message,
+	}
+}
+
+// backendError names the provider that returned err, for the messages of
+// Classify. The registry wraps the errors of every provider it routes to.
+type backendError struct {
+	backend string
+	err     error
+}
+
+func (e *backendError) Error() string { return e.err.Error() }
+
+func (e *backendError) Unwrap() error { return e.err }
+
+// Classify turns any error returned by a provider into an *Error.
+// Requests rejected by the limiter become 429 or 503, unreachable backends
+// 503, timeouts 504 and anything unexpected 500.
+func Classify(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	backend := "The upstream backend"
+	var named *backendError
+	if errors.As(err, &named) {
+		backend = named.backend
+	}
+
+	var rejected *limiter.RejectedError
+	if errors.As(err, &rejected) {
+		if errors.Is(err, limiter.ErrQueueFull) {
+			return &Error{
+				Status:     http.StatusTooManyRequests,
+				Type:       "rate_limit_error",
+				Code:       "queue_full",
+				Message:    "Too many requests are waiting for the model, please retry later",
+				RetryAfter: rejected.RetryAfter,
+				err:        err,
+			}
+		}
+		return &Error{
+			Status:     http.StatusServiceUnavailable,
+			Type:       "server_error",
+			Code:       "queue_timeout",
+			Message:    "The request waited too long for a free model slot, please retry later",
+			RetryAfter: rejected.RetryAfter,
+			err:        err,
+		}
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &Error{
+			Status:  http.StatusGatewayTimeout,
+			Type:    "server_error",
+			Code:    "upstream_timeout",
+			Message: backend + " did not respond in time",
+			err:     err,
+		}
+	case errors.Is(err, ErrNoHealthyUpstream), netErr != nil:
+		return &Error{
+			Status:  http.StatusServiceUnavailable,
+			Type:    "server_error",
+			Code:    "upstream_unavailable",
+			Message: backend + " is unreachable, please retry the request",
+			err:     err,
+		}
+	default:
+		return &Error{
+			Status:  http.StatusInternalServerError,
+			Type:    "internal_error",
+			Code:    "ollama_error",
+			Message: "Internal server error",
+			err:     err,
+		}
+	}
+}
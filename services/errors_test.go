@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"openai-compatible/models"
+)
+
+func TestParamFromMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"invalid value for temperature", "temperature"},
+		{"num_predict must be positive", "max_tokens"},
+		{"frequency_penalty and stop are incompatible", "frequency_penalty"},
+		{"top_p out of range, temperature ignored", "temperature"},
+		{"something else went wrong", ""},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if got := paramFromMessage(tt.message); got != tt.want {
+				t.Fatalf("paramFromMessage(%q) = %q, want %q", tt.message, got, tt.want)
+			}
+		}
+	}
+}
+
+// failingProvider fails every chat completion with err.
+type failingProvider struct {
+	Provider
+	err error
+}
+
+func (p *failingProvider) ChatCompletion(ctx context.Context, req *models.ChatCompletionRequest) (*models.ChatCompletionResponse, error) {
+	return nil, p.err
+}
+
+func TestClassifyNamesBackend(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	r := NewRegistry("ollama", &failingProvider{err: fmt.Errorf("failed to make request: %w", refused)})
+	if err := r.Register("local", &failingProvider{err: context.DeadlineExceeded}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RoutePrefix("local/", "local"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct{ model, want string }{
+		{"llama3.2", "ollama is unreachable"},
+		{"local/qwen", "local did not respond in time"},
+	}
+	for _, tt := range tests {
+		_, err := r.ChatCompletion(context.Background(), chatRequest(tt.model))
+		if got := Classify(err).Message; !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: message = %q, want it to start with %q", tt.model, got, tt.want)
+		}
+	}
+
+	if got := Classify(refused).Message; !strings.HasPrefix(got, "The upstream backend is unreachable") {
+		t.Errorf("message without a backend = %q", got)
+	}
+}
+
+func TestStatusErrorNamesBackend(t *testing.T) {
+	e := statusError("ollama-1", http.StatusInternalServerError, []byte(`{"error":"out of memory"}`), "llama3.2")
+	if e.Status != http.StatusBadGateway || e.Message != "ollama-1 failed to process the request" || !strings.Contains(e.Error(), "ollama-1 API error (500)") {
+		t.Errorf("error = %+v (%v)", e, e)
+	}
+}
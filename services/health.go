@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
+	"openai-compatible/models"
+)
+
+// HealthChecker probes the backends of a provider for readiness checks.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context, requiredModels []string) []BackendStatus
+}
+
+// HealthCheckers checks the backends of several providers, listing their
+// statuses in order.
+type HealthCheckers []HealthChecker
+
+func (h HealthCheckers) CheckHealth(ctx context.Context, requiredModels []string) []BackendStatus {
+	var statuses []BackendStatus
+	for _, checker := range h {
+		statuses = append(statuses, checker.CheckHealth(ctx, requiredModels)...)
+	}
+	return statuses
+}
+
+// BackendStatus is the result of probing one backend.
+type BackendStatus struct {
+	Name          string   `json:"name"`
+	URL           string   `json:"url"`
+	Status        string   `json:"status"`
+	Version       string   `json:"version,omitempty"`
+	LatencyMs     int64    `json:"latency_ms"`
+	Inflight      int64    `json:"inflight"`
+	Circuit       string   `json:"circuit"`
+	LoadedModels  []string `json:"loaded_models,omitempty"`
+	MissingModels []string `json:"missing_models,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+const (
+	BackendUp   = "up"
+	BackendDown = "down"
+)
+
+// defaultHealthCheckInterval matches the HEALTH_CHECK_INTERVAL default.
+const defaultHealthCheckInterval = 10 * time.Second
+
+// Healthy reports whether the backend is reachable and has every required model.
+func (b BackendStatus) Healthy() bool {
+	return b.Status == BackendUp && len(b.MissingModels) == 0
+}
+
+// CheckHealth probes every configured backend in parallel. requiredModels
+// are reported as missing on backends that haven't pulled them. The results
+// also refresh the routing state used by the load balancer.
+func (s *OllamaService) CheckHealth(ctx context.Context, requiredModels []string) []BackendStatus {
+	upstreams := s.pool.Upstreams()
+	statuses := make([]BackendStatus, len(upstreams))
+
+	var wg sync.WaitGroup
+	for i, up := range upstreams {
+		wg.Add(1)
+		go func(i int, up *Upstream) {
+			defer wg.Done()
+			statuses[i] = s.checkUpstream(ctx, up, requiredModels)
+		}(i, up)
+	}
+	wg.Wait()
+
+	return statuses
+}
+
+// StartHealthChecks probes all backends every interval until ctx is
+// cancelled, taking failing backends out of rotation and putting them back
+// once they recover. A non-positive interval falls back to
+// defaultHealthCheckInterval.
+func (s *OllamaService) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		slog.Warn("invalid health check interval, using default",
+			"interval", interval, "default", defaultHealthCheckInterval)
+		interval = defaultHealthCheckInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			s.CheckHealth(ctx, nil)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *OllamaService) checkUpstream(ctx context.Context, up *Upstream, requiredModels []string) BackendStatus {
+	start := time.Now()
+	status := BackendStatus{
+		Name:     up.Name(),
+		URL:      up.URL,
+		Status:   BackendDown,
+		Inflight: up.Inflight(),
+		Circuit:  up.breaker.currentState().String(),
+	}
+
+	var version models.OllamaVersionResponse
+	versionErr := s.probe(ctx, up, "/api/version", &version)
+
+	var tags models.OllamaModelsResponse
+	var tagsErr error
+	if versionErr == nil {
+		tagsErr = s.probe(ctx, up, "/api/tags", &tags)
+	}
+
+	var available, loaded map[string]bool
+	switch {
+	case versionErr != nil:
+		status.Error = versionErr.Error()
+	case tagsErr != nil:
+		status.Error = tagsErr.Error()
+	default:
+		status.Status = BackendUp
+		status.Version = version.Version
+
+		available = make(map[string]bool, len(tags.Models))
+		for _, m := range tags.Models {
+			available[m.Name] = true
+		}
+		for _, name := range requiredModels {
+			if !available[name] {
+				status.MissingModels = append(status.MissingModels, name)
+			}
+		}
+
+		// /api/ps only feeds model affinity, older Ollama versions don't
+		// have it.
+		var ps models.OllamaProcessResponse
+		if err := s.probe(ctx, up, "/api/ps", &ps); err == nil {
+			loaded = make(map[string]bool, len(ps.Models))
+			for _, m := range ps.Models {
+				loaded[m.Name] = true
+				status.LoadedModels = append(status.LoadedModels, m.Name)
+			}
+			sort.Strings(status.LoadedModels)
+		}
+	}
+	status.LatencyMs = time.Since(start).Milliseconds()
+
+	if up.update(status, loaded, available) {
+		logger := logging.FromContext(ctx)
+		if status.Status == BackendUp {
+			logger.Info("Ollama backend is healthy again", "backend", up.Name(), "url", up.URL)
+		} else {
+			logger.Warn("Ollama backend is unhealthy, removing it from rotation", "backend", up.Name(), "url", up.URL, "error", status.Error)
+		}
+	}
+	metrics.SetBackendHealthy(up.Name(), status.Status == BackendUp)
+
+	return status
+}
+
+// probe GETs a small Ollama endpoint using the short-timeout probe client.
+func (s *OllamaService) probe(ctx context.Context, up *Upstream, path string, out interface{}) error {
+	httpReq, err := s.newRequest(ctx, up, http.MethodGet, path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := s.probeClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("Ollama unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Ollama %s returned HTTP %d", path, resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode Ollama response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"openai-compatible/config"
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
+	"openai-compatible/tracing"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// httpBackend is the HTTP plumbing shared by providers that talk to a
+// single server with a bearer key: admission through the concurrency
+// limiter, a circuit breaker, retries, trace propagation and mapping of
+// OpenAI style error bodies.
+type httpBackend struct {
+	name    string
+	baseURL string
+	apiKey  string
+	client  *http.Client
+	limiter *limiter.Limiter
+	breaker *circuitBreaker
+
+	// config holds the retries and the stream idle timeout, see Reload
+	config atomic.Pointer[config.Config]
+}
+
+func newHTTPBackend(cfg *config.Config, upstream config.Upstream) (*httpBackend, error) {
+	if upstream.BaseURL == "" {
+		return nil, fmt.Errorf("upstream %q has no URL", upstream.Name)
+	}
+	b := &httpBackend{
+		name:    upstream.Name,
+		baseURL: strings.TrimRight(upstream.BaseURL, "/"),
+		apiKey:  upstream.APIKey,
+		client: &http.Client{
+			Timeout: 300 * time.Second, // 5 minutes timeout for long responses
+		},
+		limiter: limiter.New(limiterConfig(cfg), singleBackend(upstream.Name)),
+		breaker: newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerOpenDuration),
+	}
+	b.config.Store(cfg)
+	return b, nil
+}
+
+// Reload applies the retries, concurrency limits and stream idle timeout of
+// cfg, like OllamaService.Reload. The circuit breaker keeps its settings.
+func (b *httpBackend) Reload(cfg *config.Config) {
+	b.config.Store(cfg)
+	b.limiter.SetConfig(limiterConfig(cfg))
+}
+
+// singleBackend shows a server to the limiter as its only backend.
+type singleBackend string
+
+func (b singleBackend) Available() []string { return []string{string(b)} }
+
+func (b singleBackend) Pick(model string, candidates []string) string { return string(b) }
+
+// admit waits for a concurrency slot for model. The slot must be released
+// once the request is done, for streams once the stream has ended.
+func (b *httpBackend) admit(ctx context.Context, model string) (*limiter.Slot, error) {
+	return acquireSlot(ctx, b.limiter, model)
+}
+
+// relay streams resp, the answer to a request on path, to the client.
+// Failures count against the circuit breaker; onEnd runs once the stream
+// has ended.
+func (b *httpBackend) relay(ctx, reqCtx context.Context, cancelReq context.CancelCauseFunc, resp *http.Response, path string, onEnd func(err error)) *streamRelay {
+	return &streamRelay{
+		backend:     b.name,
+		body:        resp.Body,
+		idleTimeout: b.config.Load().StreamIdleTimeout,
+		reqCtx:      reqCtx,
+		cancelReq:   cancelReq,
+		onFail: func(reason string) {
+			b.recordError(path, reason)
+			b.recordFailure(ctx)
+		},
+		onEnd: onEnd,
+	}
+}
+
+// get fetches path without retries and decodes the JSON answer into out.
+func (b *httpBackend) get(ctx context.Context, path string, out interface{}) error {
+	httpReq, err := b.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		b.recordError(path, "connection")
+		return fmt.Errorf("failed to make request to %s: %w", b.name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		b.recordError(path, statusReason(resp.StatusCode))
+		return b.statusError(resp, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		b.recordError(path, "decode")
+		return fmt.Errorf("failed to decode %s response: %w", b.name, err)
+	}
+	return nil
+}
+
+// call POSTs body to path and decodes the JSON answer into out.
+func (b *httpBackend) call(ctx context.Context, path string, body, out interface{}) error {
+	resp, err := b.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		b.recordError(path, "decode")
+		return fmt.Errorf("failed to decode %s response: %w", b.name, err)
+	}
+	return nil
+}
+
+// post sends body to path, retrying connection errors and 5xx responses with
+// exponential backoff. It returns the first 200 response.
+func (b *httpBackend) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	logger := logging.FromContext(ctx)
+	retry := newRetryPolicy(b.config.Load())
+	var lastErr error
+	for attempt := 1; attempt <= retry.maxAttempts; attempt++ {
+		if attempt > 1 {
+			delay := retry.backoff(attempt - 1)
+			logger.Warn("upstream request failed, retrying", "provider", b.name, "path", path, "attempt", attempt, "delay", delay, "error", lastErr)
+			metrics.UpstreamRetries.WithLabelValues(b.name + path).Inc()
+			if err := sleep(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := b.send(ctx, path, data)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if !retryable(ctx, err) {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+// send makes a single attempt, unless the circuit breaker is open.
+func (b *httpBackend) send(ctx context.Context, path string, data []byte) (*http.Response, error) {
+	if !b.breaker.allow() {
+		return nil, b.unavailableError()
+	}
+
+	httpReq, err := b.newRequest(ctx, http.MethodPost, path, data)
+	if err != nil {
+		b.breaker.abandon()
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	logging.FromContext(ctx).Debug("sending request to upstream", "provider", b.name, "path", path)
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			b.breaker.abandon()
+			return nil, fmt.Errorf("failed to make request to %s: %w", b.name, err)
+		}
+		b.recordError(path, "connection")
+		b.recordFailure(ctx)
+		return nil, fmt.Errorf("failed to make request to %s: %w", b.name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		b.recordError(path, statusReason(resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			b.recordFailure(ctx)
+		} else {
+			b.recordSuccess(ctx)
+		}
+		return nil, b.statusError(resp, body)
+	}
+	b.recordSuccess(ctx)
+	return resp, nil
+}
+
+func (b *httpBackend) recordFailure(ctx context.Context) {
+	if b.breaker.failure() {
+		logging.FromContext(ctx).Warn("circuit breaker opened for upstream", "provider", b.name, "open_for", b.breaker.openFor)
+		metrics.SetCircuitOpen(b.name, true)
+	}
+}
+
+func (b *httpBackend) recordSuccess(ctx context.Context) {
+	if b.breaker.success() {
+		logging.FromContext(ctx).Info("circuit breaker closed for upstream", "provider", b.name)
+		metrics.SetCircuitOpen(b.name, false)
+	}
+}
+
+// unavailableError rejects a request while the circuit breaker is open.
+func (b *httpBackend) unavailableError() *Error {
+	return &Error{
+		Status:     http.StatusServiceUnavailable,
+		Type:       "server_error",
+		Code:       "upstream_unavailable",
+		Message:    fmt.Sprintf("%s is unavailable after repeated failures, please retry later", b.name),
+		RetryAfter: b.breaker.openFor,
+		err:        fmt.Errorf("circuit breaker open for %s", b.name),
+	}
+}
+
+func (b *httpBackend) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, b.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if b.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+b.apiKey)
+	}
+	tracing.Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
+
+	return httpReq, nil
+}
+
+// statusError classifies a non-200 response. Client errors keep the
+// upstream's status and error body, an unavailable server (e.g. still loading
+// its model) stays 503, rejected credentials and other server errors become
+// 502.
+func (b *httpBackend) statusError(resp *http.Response, body []byte) *Error {
+	status := resp.StatusCode
+	message := strings.TrimSpace(string(body))
+	var upstream struct {
+		Error interface{} `json:"error"`
+	}
+	if json.Unmarshal(body, &upstream) == nil && upstream.Error != nil {
+		message = errorMessage(upstream.Error)
+	}
+
+	e := &Error{upstreamStatus: status, err: fmt.Errorf("%s API error (%d): %s", b.name, status, message)}
+	switch {
+	case status == http.StatusTooManyRequests:
+		e.Status, e.Type, e.Code = status, "rate_limit_error", "upstream_rate_limited"
+		e.Message = fmt.Sprintf("%s is rate limiting requests: %s", b.name, message)
+		e.RetryAfter = retryAfter(resp)
+	case status == http.StatusServiceUnavailable:
+		e.Status, e.Type, e.Code = status, "server_error", "upstream_unavailable"
+		e.Message = fmt.Sprintf("%s is unavailable: %s", b.name, message)
+		e.RetryAfter = retryAfter(resp)
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.Status, e.Type, e.Code = http.StatusBadGateway, "server_error", "upstream_error"
+		e.Message = fmt.Sprintf("%s rejected the gateway's credentials", b.name)
+	case isContextOverflow(strings.ToLower(message)):
+		e.Status, e.Type, e.Code, e.Param = http.StatusBadRequest, "invalid_request_error", "context_length_exceeded", "messages"
+		e.Message = "The request exceeds the model's context length: " + message
+	case status == http.StatusNotFound:
+		e.Status, e.Type, e.Code, e.Message = status, "invalid_request_error", "model_not_found", message
+		e.Param = "model"
+	case status >= 400 && status < 500:
+		e.Status, e.Type, e.Code, e.Message = http.StatusBadRequest, "invalid_request_error", "invalid_request", message
+		if detail, ok := upstream.Error.(map[string]interface{}); ok {
+			if t, ok := detail["type"].(string); ok && t != "" {
+				e.Type = t
+			}
+			if c, ok := detail["code"].(string); ok && c != "" {
+				e.Code = c
+			}
+			if param, ok := detail["param"].(string); ok {
+				e.Param = param
+			}
+		}
+	default:
+		e.Status, e.Type, e.Code = http.StatusBadGateway, "server_error", "upstream_error"
+		e.Message = fmt.Sprintf("%s failed to process the request: %s", b.name, message)
+	}
+	return e
+}
+
+// retryAfter reads a Retry-After header given in seconds.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (b *httpBackend) recordError(path, reason string) {
+	metrics.UpstreamErrors.WithLabelValues(b.name, path, reason).Inc()
+}
+
+// errorMessage extracts the message of an OpenAI style "error" field, which
+// some servers send as a plain string.
+func errorMessage(v interface{}) string {
+	if detail, ok := v.(map[string]interface{}); ok {
+		if message, ok := detail["message"].(string); ok {
+			return message
+		}
+	}
+	return fmt.Sprint(v)
+}
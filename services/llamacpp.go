@@ -0,0 +1,704 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"openai-compatible/config"
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
+	"openai-compatible/models"
+	"openai-compatible/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// propsTTL is how long the server properties (context size, model path) are
+// reused before they are fetched again.
+const propsTTL = time.Minute
+
+// maxLogprobs is the most alternatives OpenAI returns per token for text
+// completions.
+const maxLogprobs = 5
+
+// minLogprob stands in for the log probability of a token the server didn't
+// report, as OpenAI does for negligible probabilities.
+const minLogprob = -9999.0
+
+// healthProbeTimeout bounds a /health probe, which must fail fast.
+const healthProbeTimeout = 5 * time.Second
+
+// LlamaCppProvider talks to a llama.cpp server (llama-server) through its
+// native API, which exposes what its OpenAI endpoints don't: GBNF grammars,
+// token probabilities and slot selection. The server runs a single model, so
+// every model routed to it by prefix is served by that model.
+type LlamaCppProvider struct {
+	*httpBackend
+	prefix string
+
+	// down is set while the health checks find the server unreachable or
+	// still loading its model.
+	down atomic.Bool
+
+	// noTemplate is set once the server turns out to have no /apply-template
+	// endpoint.
+	noTemplate atomic.Bool
+
+	mu           sync.Mutex
+	props        *models.LlamaCppProps
+	propsFetched time.Time
+}
+
+func NewLlamaCppProvider(cfg *config.Config, upstream config.Upstream) (*LlamaCppProvider, error) {
+	backend, err := newHTTPBackend(cfg, upstream)
+	if err != nil {
+		return nil, err
+	}
+	return &LlamaCppProvider{
+		httpBackend: backend,
+		prefix:      upstream.Prefix,
+	}, nil
+}
+
+// Chat completion with a llama.cpp server
+func (p *LlamaCppProvider) ChatCompletion(ctx context.Context, req *models.ChatCompletionRequest) (_ *models.ChatCompletionResponse, err error) {
+	ctx, span := p.startSpan(ctx, tracing.OperationChat, req.Model, req.Temperature, req.TopP, req.MaxTokens)
+	defer func() { endSpan(span, err) }()
+
+	slot, err := p.admit(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer slot.Release()
+
+	genReq, err := p.chatRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp models.LlamaCppCompletionResponse
+	if err := p.call(ctx, "/completion", genReq, &resp); err != nil {
+		return nil, err
+	}
+	p.observe(req.Model, &resp)
+
+	id := generateID()
+	finish := finishReason(&resp)
+	span.SetAttributes(tracing.ResponseAttributes(id, req.Model, finish, resp.TokensEvaluated, resp.TokensPredicted)...)
+
+	choice := models.ChatCompletionChoice{
+		Index: 0,
+		Message: models.ChatMessage{
+			Role:    "assistant",
+			Content: resp.Content,
+		},
+		FinishReason: finish,
+	}
+	if genReq.NProbs > 0 {
+		choice.Logprobs = chatLogprobs(resp.Probs, topLogprobs(req.TopLogprobs))
+	}
+
+	return &models.ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []models.ChatCompletionChoice{choice},
+		Usage: models.ChatCompletionUsage{
+			PromptTokens:     resp.TokensEvaluated,
+			CompletionTokens: resp.TokensPredicted,
+			TotalTokens:      resp.TokensEvaluated + resp.TokensPredicted,
+		},
+		IDSlot: resp.IDSlot,
+	}, nil
+}
+
+// Streaming chat completion. llama.cpp streams the generated text piece by
+// piece and reports the statistics on the final (stop) chunk.
+func (p *LlamaCppProvider) ChatCompletionStream(ctx context.Context, req *models.ChatCompletionRequest) (<-chan StreamEvent, error) {
+	// The span outlives this call and is ended by the stream goroutine.
+	ctx, span := p.startSpan(ctx, tracing.OperationChat, req.Model, req.Temperature, req.TopP, req.MaxTokens)
+
+	slot, err := p.admit(ctx, req.Model)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	genReq, err := p.chatRequest(ctx, req)
+	if err != nil {
+		slot.Release()
+		endSpan(span, err)
+		return nil, err
+	}
+	genReq.Stream = true
+
+	// The request is cancelled with errStreamIdle if the server goes quiet
+	// mid-stream.
+	reqCtx, cancelReq := context.WithCancelCause(ctx)
+	start := time.Now()
+	resp, err := p.post(reqCtx, "/completion", genReq)
+	if err != nil {
+		cancelReq(nil)
+		slot.Release()
+		endSpan(span, err)
+		return nil, err
+	}
+
+	relay := p.relay(ctx, reqCtx, cancelReq, resp, "/completion", func(err error) {
+		slot.Release()
+		endSpan(span, err)
+	})
+	id := generateID()
+	created := time.Now().Unix()
+	firstToken := true
+
+	return relay.start(ctx, func(line string) ([]string, bool, *streamFailure) {
+		if payload, ok := strings.CutPrefix(line, "error:"); ok {
+			var upstreamErr interface{}
+			if json.Unmarshal([]byte(payload), &upstreamErr) != nil {
+				upstreamErr = strings.TrimSpace(payload)
+			}
+			return nil, false, &streamFailure{"stream", streamError(p.name, errorMessage(upstreamErr), nil)}
+		}
+		payload, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			return nil, false, nil // blank separators
+		}
+
+		var chunk models.LlamaCppCompletionResponse
+		if err := json.Unmarshal([]byte(strings.TrimSpace(payload)), &chunk); err != nil {
+			return nil, false, &streamFailure{"decode", streamError(p.name, "invalid data from upstream", err)}
+		}
+		if chunk.Error != nil {
+			return nil, false, &streamFailure{"stream", streamError(p.name, errorMessage(chunk.Error), nil)}
+		}
+
+		if firstToken && chunk.Content != "" {
+			metrics.ObserveFirstToken(req.Model, time.Since(start))
+			firstToken = false
+		}
+
+		streamResp := models.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []models.ChatCompletionStreamChoice{
+				{
+					Index: 0,
+					Delta: models.ChatCompletionStreamDelta{
+						Content: chunk.Content,
+					},
+				},
+			},
+		}
+		if genReq.NProbs > 0 && len(chunk.Probs) > 0 {
+			streamResp.Choices[0].Logprobs = chatLogprobs(chunk.Probs, topLogprobs(req.TopLogprobs))
+		}
+		if chunk.Stop {
+			finish := finishReason(&chunk)
+			streamResp.Choices[0].FinishReason = &finish
+			streamResp.IDSlot = chunk.IDSlot
+			p.observe(req.Model, &chunk)
+			span.SetAttributes(tracing.ResponseAttributes(id, req.Model, finish, chunk.TokensEvaluated, chunk.TokensPredicted)...)
+		}
+
+		data, err := json.Marshal(streamResp)
+		if err != nil {
+			return nil, false, nil
+		}
+		if chunk.Stop {
+			return []string{string(data), "[DONE]"}, true, nil
+		}
+		return []string{string(data)}, false, nil
+	}), nil
+}
+
+// Text completion with a llama.cpp server
+func (p *LlamaCppProvider) Completion(ctx context.Context, req *models.CompletionRequest) (_ *models.CompletionResponse, err error) {
+	ctx, span := p.startSpan(ctx, tracing.OperationTextCompletion, req.Model, req.Temperature, req.TopP, req.MaxTokens)
+	defer func() { endSpan(span, err) }()
+
+	prompt, err := promptText(req.Prompt)
+	if err != nil {
+		return nil, err
+	}
+	if req.Logprobs != nil && (*req.Logprobs < 0 || *req.Logprobs > maxLogprobs) {
+		return nil, invalidRequest("logprobs", fmt.Sprintf("logprobs must be between 0 and %d, got %d", maxLogprobs, *req.Logprobs))
+	}
+
+	slot, err := p.admit(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer slot.Release()
+
+	if err := p.checkContext(ctx, prompt, req.MaxTokens, "prompt"); err != nil {
+		return nil, err
+	}
+
+	genReq := &models.LlamaCppCompletionRequest{
+		Prompt:           prompt,
+		NPredict:         req.MaxTokens,
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		Stop:             stopSequences(req.Stop),
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Grammar:          req.Grammar,
+		IDSlot:           req.IDSlot,
+		CachePrompt:      true,
+	}
+	if req.Logprobs != nil {
+		genReq.NProbs = max(*req.Logprobs, 1)
+	}
+
+	var resp models.LlamaCppCompletionResponse
+	if err := p.call(ctx, "/completion", genReq, &resp); err != nil {
+		return nil, err
+	}
+	p.observe(req.Model, &resp)
+
+	id := generateID()
+	finish := finishReason(&resp)
+	span.SetAttributes(tracing.ResponseAttributes(id, req.Model, finish, resp.TokensEvaluated, resp.TokensPredicted)...)
+
+	choice := models.CompletionChoice{
+		Text:         resp.Content,
+		Index:        0,
+		FinishReason: finish,
+	}
+	if req.Logprobs != nil {
+		choice.Logprobs = completionLogprobs(resp.Probs, *req.Logprobs, len(prompt))
+	}
+
+	return &models.CompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []models.CompletionChoice{choice},
+		Usage: models.CompletionUsage{
+			PromptTokens:     resp.TokensEvaluated,
+			CompletionTokens: resp.TokensPredicted,
+			TotalTokens:      resp.TokensEvaluated + resp.TokensPredicted,
+		},
+		IDSlot: resp.IDSlot,
+	}, nil
+}
+
+// Embeddings for each input, in order. The server must run with --embedding
+// and a pooling type other than none.
+func (p *LlamaCppProvider) Embed(ctx context.Context, model string, input []string) (_ [][]float32, err error) {
+	ctx, span := p.startSpan(ctx, tracing.OperationEmbeddings, model, nil, nil, nil)
+	defer func() { endSpan(span, err) }()
+
+	slot, err := p.admit(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+	defer slot.Release()
+
+	embeddings := make([][]float32, 0, len(input))
+	for _, text := range input {
+		var raw json.RawMessage
+		if err := p.call(ctx, "/embedding", &models.LlamaCppEmbeddingRequest{Content: text}, &raw); err != nil {
+			return nil, err
+		}
+		vector, err := parseEmbedding(raw)
+		if err != nil {
+			p.recordError("/embedding", "decode")
+			return nil, fmt.Errorf("invalid embedding from %s: %w", p.name, err)
+		}
+		embeddings = append(embeddings, vector)
+	}
+	return embeddings, nil
+}
+
+// Get the model loaded by the server, with the routing prefix. A server that
+// is still loading its model answers 503.
+func (p *LlamaCppProvider) GetModels(ctx context.Context) (_ *models.ModelsResponse, err error) {
+	ctx, span := startSpan(ctx, "GET "+p.name+" /models")
+	defer func() { endSpan(span, err) }()
+
+	var health models.LlamaCppHealthResponse
+	if err := p.get(ctx, "/health", &health); err != nil {
+		return nil, err
+	}
+	props, err := p.properties(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ModelsResponse{
+		Object: "list",
+		Data: []models.Model{
+			{
+				ID:      p.modelID(props),
+				Object:  "model",
+				Created: p.propsCreated(),
+				OwnedBy: p.name,
+			},
+		},
+	}, nil
+}
+
+// CheckHealth probes /health, which answers 503 while the server is still
+// loading its model. requiredModels aren't checked, the server runs whatever
+// model it was started with.
+func (p *LlamaCppProvider) CheckHealth(ctx context.Context, requiredModels []string) []BackendStatus {
+	start := time.Now()
+	status := BackendStatus{
+		Name:    p.name,
+		URL:     p.baseURL,
+		Status:  BackendDown,
+		Circuit: p.breaker.currentState().String(),
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+	var health models.LlamaCppHealthResponse
+	if err := p.get(probeCtx, "/health", &health); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Status = BackendUp
+		if props, err := p.properties(probeCtx); err == nil {
+			status.LoadedModels = []string{p.modelID(props)}
+		}
+	}
+	status.LatencyMs = time.Since(start).Milliseconds()
+
+	up := status.Status == BackendUp
+	if p.down.Swap(!up) == up {
+		logger := logging.FromContext(ctx)
+		if up {
+			logger.Info("llama.cpp server is healthy again", "backend", p.name, "url", p.baseURL)
+		} else {
+			logger.Warn("llama.cpp server is unhealthy, rejecting its requests", "backend", p.name, "url", p.baseURL, "error", status.Error)
+		}
+	}
+	metrics.SetBackendHealthy(p.name, up)
+
+	return []BackendStatus{status}
+}
+
+// StartHealthChecks probes the server every interval until ctx is cancelled.
+// Requests fail fast while it is down, instead of waiting on a server that
+// can't answer. A non-positive interval falls back to
+// defaultHealthCheckInterval.
+func (p *LlamaCppProvider) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			p.CheckHealth(ctx, nil)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// admit rejects requests while the health checks find the server down, then
+// waits for a concurrency slot.
+func (p *LlamaCppProvider) admit(ctx context.Context, model string) (*limiter.Slot, error) {
+	if p.down.Load() {
+		return nil, &Error{
+			Status:     http.StatusServiceUnavailable,
+			Type:       "server_error",
+			Code:       "upstream_unavailable",
+			Message:    fmt.Sprintf("%s is not ready, please retry later", p.name),
+			RetryAfter: defaultHealthCheckInterval,
+			err:        fmt.Errorf("health check failed for %s", p.name),
+		}
+	}
+	return p.httpBackend.admit(ctx, model)
+}
+
+// modelID names the model of the server by its file, with the routing prefix.
+func (p *LlamaCppProvider) modelID(props *models.LlamaCppProps) string {
+	name := strings.TrimSuffix(filepath.Base(props.ModelPath), ".gguf")
+	if props.ModelPath == "" {
+		name = p.name
+	}
+	return p.prefix + name
+}
+
+// chatRequest renders a chat request into a /completion request.
+func (p *LlamaCppProvider) chatRequest(ctx context.Context, req *models.ChatCompletionRequest) (*models.LlamaCppCompletionRequest, error) {
+	// /completion has no tool calling, and answering without the tools
+	// would look like the model chose not to call them.
+	if len(req.Tools) > 0 {
+		return nil, unsupportedParameter("tools", p.name+" does not support tools")
+	}
+	if req.ToolChoice != nil {
+		return nil, unsupportedParameter("tool_choice", p.name+" does not support tool_choice")
+	}
+	prompt, err := p.applyTemplate(ctx, req.Messages)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkContext(ctx, prompt, req.MaxTokens, "messages"); err != nil {
+		return nil, err
+	}
+
+	genReq := &models.LlamaCppCompletionRequest{
+		Prompt:           prompt,
+		NPredict:         req.MaxTokens,
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		Stop:             stopSequences(req.Stop),
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Grammar:          req.Grammar,
+		IDSlot:           req.IDSlot,
+		CachePrompt:      true,
+	}
+	if req.Logprobs != nil && *req.Logprobs {
+		genReq.NProbs = max(topLogprobs(req.TopLogprobs), 1)
+	}
+	return genReq, nil
+}
+
+// applyTemplate renders messages with the model's chat template. Servers
+// without /apply-template get a plain role-prefixed transcript.
+func (p *LlamaCppProvider) applyTemplate(ctx context.Context, messages []models.ChatMessage) (string, error) {
+	if !p.noTemplate.Load() {
+		converted := make([]models.ChatMessage, len(messages))
+		for i, msg := range messages {
+			converted[i] = models.ChatMessage{Role: msg.Role, Content: msg.GetContentAsString(), Name: msg.Name}
+		}
+
+		var resp models.LlamaCppApplyTemplateResponse
+		err := p.call(ctx, "/apply-template", &models.LlamaCppApplyTemplateRequest{Messages: converted}, &resp)
+		var e *Error
+		if err == nil || !errors.As(err, &e) || e.upstreamStatus != http.StatusNotFound {
+			return resp.Prompt, err
+		}
+		logging.FromContext(ctx).Info("llama.cpp server has no chat template endpoint, using a plain transcript", "provider", p.name)
+		p.noTemplate.Store(true)
+	}
+	return formatMessages(messages) + "assistant: ", nil
+}
+
+// checkContext refuses a prompt that doesn't leave room for the requested
+// completion in the server's context. It is best effort: when the server
+// can't tell, the request goes ahead and the server decides.
+func (p *LlamaCppProvider) checkContext(ctx context.Context, prompt string, maxTokens *int, param string) error {
+	logger := logging.FromContext(ctx)
+	props, err := p.properties(ctx)
+	if err != nil {
+		logger.Debug("skipping context length check", "provider", p.name, "error", err)
+		return nil
+	}
+	nCtx := props.DefaultGenerationSettings.NCtx
+	if nCtx <= 0 {
+		return nil
+	}
+
+	var tokens models.LlamaCppTokenizeResponse
+	if err := p.call(ctx, "/tokenize", &models.LlamaCppTokenizeRequest{Content: prompt}, &tokens); err != nil {
+		logger.Debug("skipping context length check", "provider", p.name, "error", err)
+		return nil
+	}
+	completion := 0
+	if maxTokens != nil {
+		completion = *maxTokens
+	}
+	if len(tokens.Tokens)+completion <= nCtx {
+		return nil
+	}
+	return &Error{
+		Status: http.StatusBadRequest,
+		Type:   "invalid_request_error",
+		Code:   "context_length_exceeded",
+		Param:  param,
+		Message: fmt.Sprintf("This model's maximum context length is %d tokens, but the request needs %d (%d in the prompt, %d for the completion)",
+			nCtx, len(tokens.Tokens)+completion, len(tokens.Tokens), completion),
+	}
+}
+
+// properties returns the server properties, fetching them at most once per
+// propsTTL.
+func (p *LlamaCppProvider) properties(ctx context.Context) (*models.LlamaCppProps, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.props != nil && time.Since(p.propsFetched) < propsTTL {
+		return p.props, nil
+	}
+	var props models.LlamaCppProps
+	if err := p.get(ctx, "/props", &props); err != nil {
+		return nil, err
+	}
+	p.props, p.propsFetched = &props, time.Now()
+	return p.props, nil
+}
+
+func (p *LlamaCppProvider) propsCreated() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.propsFetched.Unix()
+}
+
+// observe records the generation speed reported on a final response.
+func (p *LlamaCppProvider) observe(model string, resp *models.LlamaCppCompletionResponse) {
+	if resp.Timings != nil {
+		metrics.ObserveGeneration(model, resp.TokensPredicted, int64(resp.Timings.PredictedMS*float64(time.Millisecond)))
+	}
+}
+
+func (p *LlamaCppProvider) startSpan(ctx context.Context, operation, model string, temperature, topP *float64, maxTokens *int) (context.Context, trace.Span) {
+	return startSpan(ctx, operation+" "+model,
+		tracing.RequestAttributes(p.name, operation, model, temperature, topP, maxTokens)...)
+}
+
+// finishReason maps llama.cpp's stop type to an OpenAI finish reason.
+func finishReason(resp *models.LlamaCppCompletionResponse) string {
+	if resp.StopType == "limit" || resp.StoppedLimit {
+		return "length"
+	}
+	return "stop"
+}
+
+func topLogprobs(n *int) int {
+	if n == nil || *n < 0 {
+		return 0
+	}
+	return *n
+}
+
+// tokenLogprob reads a token's probabilities in either llama.cpp format,
+// keeping at most top alternatives.
+func tokenLogprob(probs models.LlamaCppTokenProbs, top int) models.TokenLogprob {
+	top = max(top, 0)
+	if probs.Logprob != nil {
+		t := models.TokenLogprob{
+			Token:       probs.Token,
+			Logprob:     *probs.Logprob,
+			Bytes:       tokenBytes(probs.Token, probs.Bytes),
+			TopLogprobs: []models.TopLogprob{},
+		}
+		for _, alt := range probs.TopLogprobs[:min(top, len(probs.TopLogprobs))] {
+			t.TopLogprobs = append(t.TopLogprobs, models.TopLogprob{
+				Token:   alt.Token,
+				Logprob: alt.Logprob,
+				Bytes:   tokenBytes(alt.Token, alt.Bytes),
+			})
+		}
+		return t
+	}
+
+	// Older servers only send the probabilities of the top candidates, which
+	// may not include the sampled token.
+	t := models.TokenLogprob{
+		Token:       probs.Content,
+		Logprob:     minLogprob,
+		Bytes:       tokenBytes(probs.Content, nil),
+		TopLogprobs: []models.TopLogprob{},
+	}
+	for i, alt := range probs.Probs {
+		logprob := minLogprob
+		if alt.Prob > 0 {
+			logprob = math.Log(alt.Prob)
+		}
+		if alt.TokStr == probs.Content {
+			t.Logprob = logprob
+		}
+		if i < top {
+			t.TopLogprobs = append(t.TopLogprobs, models.TopLogprob{
+				Token:   alt.TokStr,
+				Logprob: logprob,
+				Bytes:   tokenBytes(alt.TokStr, nil),
+			})
+		}
+	}
+	return t
+}
+
+func tokenBytes(token string, bytes []int) []int {
+	if bytes != nil {
+		return bytes
+	}
+	out := make([]int, len(token))
+	for i := 0; i < len(token); i++ {
+		out[i] = int(token[i])
+	}
+	return out
+}
+
+func chatLogprobs(probs []models.LlamaCppTokenProbs, top int) *models.ChatLogprobs {
+	logprobs := &models.ChatLogprobs{Content: make([]models.TokenLogprob, 0, len(probs))}
+	for _, p := range probs {
+		logprobs.Content = append(logprobs.Content, tokenLogprob(p, top))
+	}
+	return logprobs
+}
+
+// completionLogprobs builds the legacy parallel arrays. Text offsets count
+// from the start of the prompt, like OpenAI's.
+func completionLogprobs(probs []models.LlamaCppTokenProbs, top, promptLen int) *models.CompletionLogprobs {
+	logprobs := &models.CompletionLogprobs{
+		Tokens:        make([]string, 0, len(probs)),
+		TokenLogprobs: make([]float64, 0, len(probs)),
+		TopLogprobs:   make([]map[string]float64, 0, len(probs)),
+		TextOffset:    make([]int, 0, len(probs)),
+	}
+	offset := promptLen
+	for _, p := range probs {
+		t := tokenLogprob(p, top)
+		alternatives := make(map[string]float64, len(t.TopLogprobs))
+		for _, alt := range t.TopLogprobs {
+			alternatives[alt.Token] = alt.Logprob
+		}
+		logprobs.Tokens = append(logprobs.Tokens, t.Token)
+		logprobs.TokenLogprobs = append(logprobs.TokenLogprobs, t.Logprob)
+		logprobs.TopLogprobs = append(logprobs.TopLogprobs, alternatives)
+		logprobs.TextOffset = append(logprobs.TextOffset, offset)
+		offset += len(t.Token)
+	}
+	return logprobs
+}
+
+// parseEmbedding accepts the older {"embedding": [...]} answer and the newer
+// [{"index": 0, "embedding": [[...]]}], which has a single row when the
+// server pools embeddings.
+func parseEmbedding(raw json.RawMessage) ([]float32, error) {
+	var pooled struct {
+		Embedding []float32 `json:"embedding"`
+	}
+	if json.Unmarshal(raw, &pooled) == nil && len(pooled.Embedding) > 0 {
+		return pooled.Embedding, nil
+	}
+
+	var rows []struct {
+		Embedding [][]float32 `json:"embedding"`
+	}
+	if err := json.Unmarshal(raw, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 || len(rows[0].Embedding) != 1 {
+		return nil, errors.New("expected one pooled embedding, is the server running with --pooling none?")
+	}
+	return rows[0].Embedding[0], nil
+}
+
+var _ Provider = (*LlamaCppProvider)(nil)
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"openai-compatible/config"
+	"openai-compatible/limiter"
+	"openai-compatible/models"
+)
+
+// newLlamaCppProvider serves /completion with completion. The chat template
+// is a plain passthrough and /props is missing, so no context check runs.
+func newLlamaCppProvider(t *testing.T, completion http.HandlerFunc, cfg *config.Config) *LlamaCppProvider {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apply-template", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"prompt":"hi"}`)
+	})
+	mux.HandleFunc("/completion", completion)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	p, err := NewLlamaCppProvider(cfg, config.Upstream{Name: "llama.cpp", BaseURL: srv.URL, Prefix: "llamacpp/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLlamaCppStream(t *testing.T) {
+	p := newLlamaCppProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"content\":\"hi\"}\n\n")
+		fmt.Fprint(w, "data: {\"content\":\"\",\"stop\":true,\"stop_type\":\"eos\"}\n\n")
+	}, &config.Config{RetryMaxAttempts: 1})
+
+	events, err := p.ChatCompletionStream(context.Background(), chatRequest("llamacpp/qwen"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []string
+	for event := range events {
+		if event.Err != nil {
+			t.Fatalf("stream failed: %v", event.Err)
+		}
+		data = append(data, event.Data)
+	}
+	if len(data) != 3 || !strings.Contains(data[0], `"content":"hi"`) || !strings.Contains(data[1], `"finish_reason":"stop"`) || data[2] != "data: [DONE]\n\n" {
+		t.Errorf("events = %q, want a content chunk, a stop chunk and [DONE]", data)
+	}
+}
+
+func TestLlamaCppStreamError(t *testing.T) {
+	p := newLlamaCppProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "error: {\"message\":\"slot unavailable\"}\n\n")
+	}, &config.Config{RetryMaxAttempts: 1})
+
+	events, err := p.ChatCompletionStream(context.Background(), chatRequest("llamacpp/qwen"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last StreamEvent
+	for event := range events {
+		last = event
+	}
+	var e *Error
+	if !errors.As(last.Err, &e) || !strings.Contains(e.Message, "slot unavailable") {
+		t.Fatalf("last event = %+v, want the upstream error", last)
+	}
+}
+
+func TestLlamaCppCompletionLogprobs(t *testing.T) {
+	p := newLlamaCppProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a request with invalid logprobs reached the server")
+	}, &config.Config{RetryMaxAttempts: 1})
+
+	for _, logprobs := range []int{-1, maxLogprobs + 1} {
+		_, err := p.Completion(context.Background(), &models.CompletionRequest{Model: "llamacpp/qwen", Prompt: "hi", Logprobs: &logprobs})
+		var e *Error
+		if !errors.As(err, &e) || e.Code != "invalid_request" || e.Param != "logprobs" {
+			t.Errorf("logprobs=%d: err = %v, want invalid_request on logprobs", logprobs, err)
+		}
+	}
+}
+
+func TestTokenLogprobNegativeTop(t *testing.T) {
+	logprob := -0.5
+	probs := models.LlamaCppTokenProbs{
+		Token:       "hi",
+		Logprob:     &logprob,
+		TopLogprobs: []models.LlamaCppTopLogprob{{Token: "hi", Logprob: logprob}},
+	}
+	if got := tokenLogprob(probs, -1); len(got.TopLogprobs) != 0 {
+		t.Errorf("top logprobs = %v, want none", got.TopLogprobs)
+	}
+}
+
+func TestLlamaCppLimiter(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	p := newLlamaCppProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		fmt.Fprint(w, `{"content":"hi","stop":true}`)
+	}, &config.Config{RetryMaxAttempts: 1, MaxParallelPerBackend: 1, QueueSize: 0})
+	defer close(release)
+
+	go p.ChatCompletion(context.Background(), chatRequest("llamacpp/qwen"))
+	<-started
+	if _, err := p.ChatCompletion(context.Background(), chatRequest("llamacpp/qwen")); !errors.Is(err, limiter.ErrQueueFull) {
+		t.Fatalf("err = %v, want ErrQueueFull while the only slot is taken", err)
+	}
+}
+
+func TestLlamaCppRejectsTools(t *testing.T) {
+	p := newLlamaCppProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request reached /completion")
+	}, &config.Config{RetryMaxAttempts: 1})
+
+	tools := chatRequest("llamacpp/qwen")
+	tools.Tools = []models.Tool{{Type: "function", Function: models.ToolFunction{Name: "lookup"}}}
+	choice := chatRequest("llamacpp/qwen")
+	choice.ToolChoice = "none"
+
+	for param, req := range map[string]*models.ChatCompletionRequest{"tools": tools, "tool_choice": choice} {
+		_, err := p.ChatCompletion(context.Background(), req)
+		var e *Error
+		if !errors.As(err, &e) || e.Status != http.StatusBadRequest || e.Code != "unsupported_parameter" || e.Param != param {
+			t.Errorf("%s: err = %v, want a 400 unsupported_parameter error", param, err)
+		}
+		if _, err := p.ChatCompletionStream(context.Background(), req); !errors.As(err, &e) || e.Param != param {
+			t.Errorf("%s stream: err = %v, want an unsupported_parameter error", param, err)
+		}
+	}
+}
+
+func TestLlamaCppHealth(t *testing.T) {
+	var loading atomic.Bool
+	loading.Store(true)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if loading.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":{"code":503,"message":"Loading model","type":"unavailable_error"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"status":"ok"}`)
+	})
+	mux.HandleFunc("/props", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"model_path":"/models/qwen2.5-7b.gguf","default_generation_settings":{"n_ctx":4096}}`)
+	})
+	mux.HandleFunc("/apply-template", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"prompt":"hi"}`)
+	})
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"content":"hi","stop":true}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	p, err := NewLlamaCppProvider(&config.Config{RetryMaxAttempts: 1}, config.Upstream{Name: "llama.cpp", BaseURL: srv.URL, Prefix: "llamacpp/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := p.CheckHealth(context.Background(), []string{"llama3.2"})
+	if len(statuses) != 1 || statuses[0].Status != BackendDown || statuses[0].Error == "" {
+		t.Fatalf("statuses = %+v, want the loading server down", statuses)
+	}
+	_, err = p.ChatCompletion(context.Background(), chatRequest("llamacpp/qwen"))
+	var e *Error
+	if !errors.As(err, &e) || e.Status != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want 503 while the server is down", err)
+	}
+
+	loading.Store(false)
+	statuses = p.CheckHealth(context.Background(), []string{"llama3.2"})
+	if !statuses[0].Healthy() || len(statuses[0].LoadedModels) != 1 || statuses[0].LoadedModels[0] != "llamacpp/qwen2.5-7b" {
+		t.Fatalf("statuses = %+v, want the server up with its model", statuses)
+	}
+	if _, err := p.ChatCompletion(context.Background(), chatRequest("llamacpp/qwen")); err != nil {
+		t.Fatalf("err = %v once the server is up", err)
+	}
+}
+
+// Grammar, slot and logprobs go to /completion and come back in OpenAI's
+// shape.
+func TestLlamaCppChat(t *testing.T) {
+	p := newLlamaCppProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		var req models.LlamaCppCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if req.Prompt != "hi" || req.Grammar != `root ::= "yes"` || req.IDSlot == nil || *req.IDSlot != 1 || req.NProbs != 2 || !req.CachePrompt {
+			t.Errorf("request = %+v, want the template's prompt, the grammar, slot 1 and 2 probabilities", req)
+		}
+		fmt.Fprint(w, `{"content":"yes","stop":true,"stop_type":"limit","id_slot":1,"tokens_evaluated":3,"tokens_predicted":1,
+			"completion_probabilities":[{"token":"yes","logprob":-0.1,"top_logprobs":[{"token":"yes","logprob":-0.1},{"token":"no","logprob":-2.4}]}]}`)
+	}, &config.Config{RetryMaxAttempts: 1})
+
+	req := chatRequest("llamacpp/qwen")
+	req.Grammar = `root ::= "yes"`
+	slot, logprobs, top := 1, true, 2
+	req.IDSlot, req.Logprobs, req.TopLogprobs = &slot, &logprobs, &top
+
+	resp, err := p.ChatCompletion(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	choice := resp.Choices[0]
+	if resp.Model != "llamacpp/qwen" || choice.Message.Content != "yes" || choice.FinishReason != "length" {
+		t.Errorf("response = %+v, want yes from llamacpp/qwen cut at the length limit", resp)
+	}
+	if resp.IDSlot == nil || *resp.IDSlot != 1 || resp.Usage.TotalTokens != 4 {
+		t.Errorf("slot %v, usage %+v, want slot 1 and 4 tokens", resp.IDSlot, resp.Usage)
+	}
+	if choice.Logprobs == nil || len(choice.Logprobs.Content) != 1 || len(choice.Logprobs.Content[0].TopLogprobs) != 2 {
+		t.Fatalf("logprobs = %+v, want one token with two alternatives", choice.Logprobs)
+	}
+}
+
+func TestLlamaCppContextLength(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/props", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"default_generation_settings":{"n_ctx":8}}`)
+	})
+	mux.HandleFunc("/tokenize", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tokens":[1,2,3,4,5]}`)
+	})
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a request over the context length reached the server")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	p, err := NewLlamaCppProvider(&config.Config{RetryMaxAttempts: 1}, config.Upstream{Name: "llama.cpp", BaseURL: srv.URL, Prefix: "llamacpp/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxTokens := 4
+	_, err = p.Completion(context.Background(), &models.CompletionRequest{Model: "llamacpp/qwen", Prompt: "hi", MaxTokens: &maxTokens})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != "context_length_exceeded" || e.Param != "prompt" {
+		t.Fatalf("err = %v, want context_length_exceeded on prompt", err)
+	}
+}
+
+// Older servers send probabilities of the top candidates only.
+func TestTokenLogprobOlderServers(t *testing.T) {
+	probs := models.LlamaCppTokenProbs{
+		Content: "b",
+		Probs:   []models.LlamaCppProb{{TokStr: "a", Prob: 0.5}, {TokStr: "b", Prob: 0.25}, {TokStr: "c", Prob: 0}},
+	}
+	got := tokenLogprob(probs, 1)
+	if got.Token != "b" || got.Logprob != math.Log(0.25) {
+		t.Errorf("token = %s %v, want b %v", got.Token, got.Logprob, math.Log(0.25))
+	}
+	if len(got.TopLogprobs) != 1 || got.TopLogprobs[0].Token != "a" {
+		t.Errorf("top logprobs = %+v, want only a", got.TopLogprobs)
+	}
+
+	missing := tokenLogprob(models.LlamaCppTokenProbs{Content: "d", Probs: probs.Probs}, 0)
+	if missing.Logprob != minLogprob {
+		t.Errorf("logprob of an unreported token = %v, want %v", missing.Logprob, minLogprob)
+	}
+}
+
+func TestCompletionLogprobsOffsets(t *testing.T) {
+	logprob := -0.5
+	probs := []models.LlamaCppTokenProbs{
+		{Token: "Hello", Logprob: &logprob},
+		{Token: " world", Logprob: &logprob},
+	}
+	got := completionLogprobs(probs, 0, 3)
+	if want := []int{3, 8}; len(got.TextOffset) != 2 || got.TextOffset[0] != want[0] || got.TextOffset[1] != want[1] {
+		t.Errorf("text offsets = %v, want %v", got.TextOffset, want)
+	}
+}
@@ -0,0 +1,491 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"openai-compatible/config"
+	"openai-compatible/models"
+)
+
+// mockEmbeddingSize is the length of the mock's bag-of-words embeddings.
+const mockEmbeddingSize = 64
+
+// MockProvider answers requests without a model, for development and tests.
+// Responses are deterministic: scripted by the first rule matching the
+// request, otherwise an echo of the last user message or prompt.
+type MockProvider struct {
+	models     []string
+	rules      []mockRule
+	latency    time.Duration
+	tokenDelay time.Duration
+	created    int64
+}
+
+// MockScript is the JSON file named by MOCK_SCRIPT.
+type MockScript struct {
+	Models []string   `json:"models"` // listed by /v1/models, "mock" by default
+	Rules  []MockRule `json:"rules"`
+}
+
+// MockRule scripts the response to the requests it matches. A rule without
+// Response and ToolCalls echoes, so it can just add latency or an error.
+type MockRule struct {
+	Model   string `json:"model"`   // only requests for this model
+	Match   string `json:"match"`   // case-insensitive substring of the last user message or prompt
+	Pattern string `json:"pattern"` // regular expression, instead of Match
+
+	Response     string         `json:"response"`
+	ToolCalls    []MockToolCall `json:"tool_calls"`
+	FinishReason string         `json:"finish_reason"`
+	Error        *MockError     `json:"error"`
+	ErrorAfter   int            `json:"error_after"` // streams fail after this many chunks
+
+	Latency    string `json:"latency"`     // before the response, e.g. "500ms"
+	TokenDelay string `json:"token_delay"` // between stream chunks
+}
+
+// MockToolCall is a scripted tool call. Arguments may be a JSON object or a
+// string holding one.
+type MockToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// MockError is a scripted failure, rendered like an upstream error.
+type MockError struct {
+	Status     int    `json:"status"`
+	Type       string `json:"type"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after"` // seconds
+}
+
+type mockRule struct {
+	MockRule
+	pattern    *regexp.Regexp
+	latency    *time.Duration
+	tokenDelay *time.Duration
+}
+
+// mockReply is the resolved response to one request.
+type mockReply struct {
+	tokens       []string
+	toolCalls    []models.ToolCall
+	finishReason string
+	err          *Error
+	errorAfter   int
+	latency      time.Duration
+	tokenDelay   time.Duration
+}
+
+func NewMockProvider(cfg *config.Config) (*MockProvider, error) {
+	var script MockScript
+	if cfg.MockScript != "" {
+		data, err := os.ReadFile(cfg.MockScript)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mock script: %w", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&script); err != nil {
+			return nil, fmt.Errorf("invalid mock script %s: %w", cfg.MockScript, err)
+		}
+	}
+	if len(script.Models) == 0 {
+		script.Models = []string{"mock"}
+	}
+
+	p := &MockProvider{
+		models:     script.Models,
+		latency:    cfg.MockLatency,
+		tokenDelay: cfg.MockTokenDelay,
+		created:    time.Now().Unix(),
+	}
+	for i, rule := range script.Rules {
+		compiled, err := compileMockRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mock script %s, rule %d: %w", cfg.MockScript, i+1, err)
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p, nil
+}
+
+func compileMockRule(rule MockRule) (mockRule, error) {
+	compiled := mockRule{MockRule: rule}
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return compiled, fmt.Errorf("pattern: %w", err)
+		}
+		compiled.pattern = pattern
+	}
+	for _, d := range []struct {
+		value string
+		out   **time.Duration
+	}{{rule.Latency, &compiled.latency}, {rule.TokenDelay, &compiled.tokenDelay}} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return compiled, err
+		}
+		*d.out = &duration
+	}
+	if rule.Error != nil && (rule.Error.Status < 400 || rule.Error.Status > 599) {
+		return compiled, fmt.Errorf("error status must be 4xx or 5xx, got %d", rule.Error.Status)
+	}
+	for _, call := range rule.ToolCalls {
+		if call.Name == "" {
+			return compiled, fmt.Errorf("tool call without a name")
+		}
+	}
+	return compiled, nil
+}
+
+// Chat completion from the script, or an echo of the last user message
+func (p *MockProvider) ChatCompletion(ctx context.Context, req *models.ChatCompletionRequest) (*models.ChatCompletionResponse, error) {
+	reply := p.reply(req.Model, lastUserMessage(req.Messages), req.Tools, req.ToolChoice, req.MaxTokens)
+	if err := sleep(ctx, reply.latency); err != nil {
+		return nil, err
+	}
+	if reply.err != nil {
+		return nil, reply.err
+	}
+
+	content := strings.Join(reply.tokens, "")
+	message := models.ChatMessage{Role: "assistant", Content: content, ToolCalls: reply.toolCalls}
+	if content == "" && len(reply.toolCalls) > 0 {
+		message.Content = nil
+	}
+	promptTokens := 0
+	for _, msg := range req.Messages {
+		promptTokens += len(strings.Fields(msg.GetContentAsString()))
+	}
+
+	return &models.ChatCompletionResponse{
+		ID:      generateID(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []models.ChatCompletionChoice{
+			{
+				Index:        0,
+				Message:      message,
+				FinishReason: reply.finishReason,
+			},
+		},
+		Usage: models.ChatCompletionUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: len(reply.tokens),
+			TotalTokens:      promptTokens + len(reply.tokens),
+		},
+	}, nil
+}
+
+// Streaming chat completion, one chunk per word with the token delay between
+// chunks. Tool calls follow the text in a single chunk.
+func (p *MockProvider) ChatCompletionStream(ctx context.Context, req *models.ChatCompletionRequest) (<-chan StreamEvent, error) {
+	reply := p.reply(req.Model, lastUserMessage(req.Messages), req.Tools, req.ToolChoice, req.MaxTokens)
+	if err := sleep(ctx, reply.latency); err != nil {
+		return nil, err
+	}
+	if reply.err != nil && reply.errorAfter <= 0 {
+		return nil, reply.err
+	}
+
+	events := make(chan StreamEvent)
+
+	// send hands an event to the consumer, giving up once ctx is cancelled.
+	send := func(event StreamEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer close(events)
+
+		id := generateID()
+		created := time.Now().Unix()
+		chunk := func(delta models.ChatCompletionStreamDelta, finishReason *string) StreamEvent {
+			data, _ := json.Marshal(models.ChatCompletionStreamResponse{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   req.Model,
+				Choices: []models.ChatCompletionStreamChoice{
+					{Index: 0, Delta: delta, FinishReason: finishReason},
+				},
+			})
+			return StreamEvent{Data: "data: " + string(data) + "\n\n"}
+		}
+
+		for i, token := range reply.tokens {
+			if reply.err != nil && i == reply.errorAfter {
+				send(StreamEvent{Err: reply.err})
+				return
+			}
+			if i > 0 && sleep(ctx, reply.tokenDelay) != nil {
+				return
+			}
+			if !send(chunk(models.ChatCompletionStreamDelta{Content: token}, nil)) {
+				return
+			}
+		}
+		if reply.err != nil {
+			send(StreamEvent{Err: reply.err})
+			return
+		}
+
+		if len(reply.toolCalls) > 0 {
+			calls := make([]models.ToolCall, len(reply.toolCalls))
+			for i, call := range reply.toolCalls {
+				index := i
+				call.Index = &index
+				calls[i] = call
+			}
+			if !send(chunk(models.ChatCompletionStreamDelta{ToolCalls: calls}, nil)) {
+				return
+			}
+		}
+		if !send(chunk(models.ChatCompletionStreamDelta{}, &reply.finishReason)) {
+			return
+		}
+		send(StreamEvent{Data: "data: [DONE]\n\n"})
+	}()
+
+	return events, nil
+}
+
+// Text completion from the script, or an echo of the prompt
+func (p *MockProvider) Completion(ctx context.Context, req *models.CompletionRequest) (*models.CompletionResponse, error) {
+	prompt, err := promptText(req.Prompt)
+	if err != nil {
+		return nil, err
+	}
+	reply := p.reply(req.Model, prompt, nil, nil, req.MaxTokens)
+	if err := sleep(ctx, reply.latency); err != nil {
+		return nil, err
+	}
+	if reply.err != nil {
+		return nil, reply.err
+	}
+
+	promptTokens := len(strings.Fields(prompt))
+	return &models.CompletionResponse{
+		ID:      generateID(),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []models.CompletionChoice{
+			{
+				Text:         strings.Join(reply.tokens, ""),
+				Index:        0,
+				FinishReason: reply.finishReason,
+			},
+		},
+		Usage: models.CompletionUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: len(reply.tokens),
+			TotalTokens:      promptTokens + len(reply.tokens),
+		},
+	}, nil
+}
+
+// Embeddings for each input. Words are hashed into a fixed number of
+// buckets, so texts sharing words are similar.
+func (p *MockProvider) Embed(ctx context.Context, model string, input []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(input))
+	for i, text := range input {
+		vector := make([]float32, mockEmbeddingSize)
+		for _, word := range strings.Fields(strings.ToLower(text)) {
+			h := fnv.New32a()
+			h.Write([]byte(strings.Trim(word, ".,;:!?\"'()")))
+			vector[h.Sum32()%mockEmbeddingSize]++
+		}
+		embeddings[i] = vector
+	}
+	return embeddings, nil
+}
+
+// Get the models of the script. Requests for any other model are answered
+// too.
+func (p *MockProvider) GetModels(ctx context.Context) (*models.ModelsResponse, error) {
+	list := &models.ModelsResponse{Object: "list", Data: make([]models.Model, len(p.models))}
+	for i, name := range p.models {
+		list.Data[i] = models.Model{ID: name, Object: "model", Created: p.created, OwnedBy: "mock"}
+	}
+	return list, nil
+}
+
+// CheckHealth reports the mock as a single healthy backend.
+func (p *MockProvider) CheckHealth(ctx context.Context, requiredModels []string) []BackendStatus {
+	return []BackendStatus{{
+		Name:         "mock",
+		URL:          "mock://",
+		Status:       BackendUp,
+		Circuit:      "closed",
+		LoadedModels: p.models,
+	}}
+}
+
+// reply resolves the response to a request for model whose last user
+// message or prompt is text.
+func (p *MockProvider) reply(model, text string, tools []models.Tool, toolChoice interface{}, maxTokens *int) mockReply {
+	reply := mockReply{latency: p.latency, tokenDelay: p.tokenDelay}
+	content := text
+
+	if rule := p.match(model, text); rule != nil {
+		if rule.Response != "" || len(rule.ToolCalls) > 0 {
+			content = rule.Response
+		}
+		for i, call := range rule.ToolCalls {
+			reply.toolCalls = append(reply.toolCalls, models.ToolCall{
+				ID:       fmt.Sprintf("call_mock_%d", i),
+				Type:     "function",
+				Function: models.FunctionCall{Name: call.Name, Arguments: mockArguments(call.Arguments)},
+			})
+		}
+		reply.finishReason = rule.FinishReason
+		if rule.Error != nil {
+			reply.err = rule.Error.toError()
+			reply.errorAfter = rule.ErrorAfter
+		}
+		if rule.latency != nil {
+			reply.latency = *rule.latency
+		}
+		if rule.tokenDelay != nil {
+			reply.tokenDelay = *rule.tokenDelay
+		}
+	} else if name := forcedTool(tools, toolChoice); name != "" {
+		content = ""
+		reply.toolCalls = []models.ToolCall{{
+			ID:       "call_mock_0",
+			Type:     "function",
+			Function: models.FunctionCall{Name: name, Arguments: "{}"},
+		}}
+	}
+
+	for _, token := range strings.SplitAfter(content, " ") {
+		if token != "" {
+			reply.tokens = append(reply.tokens, token)
+		}
+	}
+	if maxTokens != nil && *maxTokens >= 0 && len(reply.tokens) > *maxTokens {
+		reply.tokens = reply.tokens[:*maxTokens]
+		reply.finishReason = "length"
+	}
+	if reply.finishReason == "" {
+		reply.finishReason = "stop"
+		if len(reply.toolCalls) > 0 {
+			reply.finishReason = "tool_calls"
+		}
+	}
+	return reply
+}
+
+func (p *MockProvider) match(model, text string) *mockRule {
+	lower := strings.ToLower(text)
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if rule.Model != "" && rule.Model != model {
+			continue
+		}
+		switch {
+		case rule.pattern != nil:
+			if rule.pattern.MatchString(text) {
+				return rule
+			}
+		case strings.Contains(lower, strings.ToLower(rule.Match)):
+			return rule
+		}
+	}
+	return nil
+}
+
+func (e *MockError) toError() *Error {
+	err := &Error{
+		Status:     e.Status,
+		Type:       e.Type,
+		Code:       e.Code,
+		Message:    e.Message,
+		RetryAfter: time.Duration(e.RetryAfter) * time.Second,
+	}
+	if err.Type == "" {
+		switch {
+		case e.Status == http.StatusTooManyRequests:
+			err.Type = "rate_limit_error"
+		case e.Status < 500:
+			err.Type = "invalid_request_error"
+		default:
+			err.Type = "server_error"
+		}
+	}
+	if err.Code == "" {
+		err.Code = "mock_error"
+	}
+	if err.Message == "" {
+		err.Message = http.StatusText(e.Status)
+	}
+	return err
+}
+
+// forcedTool returns the tool a request requires to be called: the one
+// named by tool_choice, or the first tool for "required".
+func forcedTool(tools []models.Tool, toolChoice interface{}) string {
+	switch choice := toolChoice.(type) {
+	case string:
+		if choice == "required" && len(tools) > 0 {
+			return tools[0].Function.Name
+		}
+	case map[string]interface{}:
+		if function, ok := choice["function"].(map[string]interface{}); ok {
+			name, _ := function["name"].(string)
+			return name
+		}
+	}
+	return ""
+}
+
+func mockArguments(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return "{}"
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var compact bytes.Buffer
+	if json.Compact(&compact, raw) != nil {
+		return string(raw)
+	}
+	return compact.String()
+}
+
+func lastUserMessage(messages []models.ChatMessage) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].GetContentAsString()
+		}
+	}
+	return ""
+}
+
+var (
+	_ Provider      = (*MockProvider)(nil)
+	_ HealthChecker = (*MockProvider)(nil)
+)
@@ -1,78 +1,149 @@
 package services
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"openai-compatible/config"
+	"openai-compatible/limiter"
+	"openai-compatible/logging"
+	"openai-compatible/metrics"
 	"openai-compatible/models"
+	"openai-compatible/tracing"
 )
 
 type OllamaService struct {
-	config *config.Config
-	client *http.Client
+	config      atomic.Pointer[config.Config] // swapped by Reload
+	pool        *Pool
+	limiter     *limiter.Limiter
+	client      *http.Client
+	probeClient *http.Client
 }
 
-func NewOllamaService(cfg *config.Config) *OllamaService {
-	return &OllamaService{
-		config: cfg,
-		client: &http.Client{
-			Timeout: 300 * time.Second, // 5 minutes timeout for long responses
-		},
+func NewOllamaService(cfg *config.Config) (*OllamaService, error) {
+	strategy, err := NewStrategy(cfg.LoadBalancing)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := NewPool(cfg.OllamaURLs, strategy, PoolOptions{
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerOpenFor:   cfg.BreakerOpenDuration,
+		MaxInflight:      cfg.MaxParallelPerBackend,
+	})
+
+	client := &http.Client{
+		Timeout: 300 * time.Second, // 5 minutes timeout for long responses
+	}
+	probeClient := &http.Client{
+		Timeout: 5 * time.Second, // health checks must fail fast
+	}
+	if cfg.CassetteMode != "" {
+		transport, err := newCassetteTransport(cfg.CassetteMode, cfg.CassetteDir, cfg.CassetteTiming)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport, probeClient.Transport = transport, transport
+		if cfg.CassetteMode == CassetteRecord {
+			slog.Warn("recording Ollama traffic, cassettes contain prompts and responses verbatim", "dir", cfg.CassetteDir)
+		} else {
+			slog.Info("replaying Ollama traffic from cassettes", "dir", cfg.CassetteDir, "cassettes", len(transport.cassettes))
+		}
+	}
+
+	s := &OllamaService{
+		pool:        pool,
+		limiter:     limiter.New(limiterConfig(cfg), poolBackends{pool}),
+		client:      client,
+		probeClient: probeClient,
+	}
+	s.config.Store(cfg)
+	return s, nil
+}
+
+// Reload switches to the default and fallback models, retries, concurrency
+// limits and stream idle timeout of cfg. Requests already running keep the
+// settings they started with. The backends, load balancing and circuit
+// breakers are only read by NewOllamaService.
+func (s *OllamaService) Reload(cfg *config.Config) {
+	s.config.Store(cfg)
+	s.limiter.SetConfig(limiterConfig(cfg))
+}
+
+func limiterConfig(cfg *config.Config) limiter.Config {
+	return limiter.Config{
+		PerModel:     cfg.MaxParallelPerModel,
+		PerBackend:   cfg.MaxParallelPerBackend,
+		QueueSize:    cfg.QueueSize,
+		QueueTimeout: cfg.QueueTimeout,
 	}
 }
 
 // Chat completion with Ollama
-func (s *OllamaService) ChatCompletion(req *models.ChatCompletionRequest) (*models.ChatCompletionResponse, error) {
+func (s *OllamaService) ChatCompletion(ctx context.Context, req *models.ChatCompletionRequest) (_ *models.ChatCompletionResponse, err error) {
 	// Use the model from request, fallback to config if empty
 	modelName := req.Model
 	if modelName == "" {
-		modelName = s.config.OllamaModel
+		modelName = s.config.Load().OllamaModel
 	}
 
 	// Convert messages to ensure content is string for Ollama
 	ollamaMessages := s.convertMessagesForOllama(req.Messages)
 
 	ollamaReq := &models.OllamaChatRequest{
-		Model:    modelName,
 		Messages: ollamaMessages,
 		Stream:   false,
 		Options:  s.convertOptions(req),
 	}
 
-	jsonData, err := json.Marshal(ollamaReq)
+	ctx, span := startSpan(ctx, tracing.OperationChat+" "+modelName,
+		tracing.RequestAttributes(genAISystem, tracing.OperationChat, modelName, req.Temperature, req.TopP, req.MaxTokens)...)
+	defer func() { endSpan(span, err) }()
+
+	slot, err := s.admit(ctx, span, modelName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+		return nil, err
 	}
+	defer slot.Release()
+
+	logging.FromContext(ctx).Debug("sending chat request to Ollama", "model", modelName, "stream", false)
 
-	resp, err := s.client.Post(s.config.OllamaURL+"/api/chat", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := s.dispatch(ctx, span, slot, "/api/chat", modelName, func(model string) ([]byte, error) {
+		ollamaReq.Model = model
+		return json.Marshal(ollamaReq)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request to Ollama: %w", err)
+		return nil, err
 	}
+	defer resp.release()
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("Ollama API error: %s", string(body))
-	}
-
 	var ollamaResp models.OllamaChatResponse
 	if err := json.NewDecoder(resp.Body).Decode(&ollamaResp); err != nil {
+		recordUpstreamError(resp.up, "/api/chat", "decode")
 		return nil, fmt.Errorf("failed to decode Ollama response: %w", err)
 	}
 
+	metrics.ObserveGeneration(resp.model, ollamaResp.EvalCount, ollamaResp.EvalDuration)
+
+	id := generateID()
+	span.SetAttributes(tracing.ResponseAttributes(id, ollamaResp.Model, "stop",
+		usageOrEstimate(ollamaResp.PromptEvalCount, formatMessages(req.Messages)),
+		usageOrEstimate(ollamaResp.EvalCount, ollamaResp.Message.GetContentAsString()))...)
+
 	// Convert to OpenAI format
 	return &models.ChatCompletionResponse{
-		ID:      generateID(),
+		ID:      id,
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
-		Model:   req.Model,
+		Model:   responseModel(req.Model, modelName, resp.model),
 		Choices: []models.ChatCompletionChoice{
 			{
 				Index:        0,
@@ -88,143 +159,194 @@ func (s *OllamaService) ChatCompletion(req *models.ChatCompletionRequest) (*mode
 	}, nil
 }
 
-// Streaming chat completion
-func (s *OllamaService) ChatCompletionStream(req *models.ChatCompletionRequest) (<-chan string, error) {
+// StreamEvent is one item of a streaming response: either a ready to write
+// SSE chunk, or the error that ended the stream. An error is always the last
+// event.
+type StreamEvent struct {
+	Data string
+	Err  error
+}
+
+// Streaming chat completion. The returned channel is closed after the final
+// [DONE] chunk or error event, or once ctx is cancelled.
+func (s *OllamaService) ChatCompletionStream(ctx context.Context, req *models.ChatCompletionRequest) (<-chan StreamEvent, error) {
 	// Use the model from request, fallback to config if empty
 	modelName := req.Model
 	if modelName == "" {
-		modelName = s.config.OllamaModel
+		modelName = s.config.Load().OllamaModel
 	}
 
 	// Convert messages to ensure content is string for Ollama
 	ollamaMessages := s.convertMessagesForOllama(req.Messages)
 
 	ollamaReq := &models.OllamaChatRequest{
-		Model:    modelName,
 		Messages: ollamaMessages,
 		Stream:   true,
 		Options:  s.convertOptions(req),
 	}
 
-	jsonData, err := json.Marshal(ollamaReq)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
-	}
+	// The span outlives this call and is ended by the stream goroutine once
+	// Ollama is done.
+	ctx, span := startSpan(ctx, tracing.OperationChat+" "+modelName,
+		tracing.RequestAttributes(genAISystem, tracing.OperationChat, modelName, req.Temperature, req.TopP, req.MaxTokens)...)
 
-	resp, err := s.client.Post(s.config.OllamaURL+"/api/chat", "application/json", bytes.NewBuffer(jsonData))
+	slot, err := s.admit(ctx, span, modelName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request to Ollama: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		return nil, fmt.Errorf("Ollama API error: %s", string(body))
+		endSpan(span, err)
+		return nil, err
+	}
+
+	logger := logging.FromContext(ctx)
+	logger.Debug("sending chat request to Ollama", "model", modelName, "stream", true)
+
+	// Retries and failover only happen here, before the first chunk reaches
+	// the client. The request is cancelled with errStreamIdle if Ollama goes
+	// quiet mid-stream.
+	reqCtx, cancelReq := context.WithCancelCause(ctx)
+	start := time.Now()
+	resp, err := s.dispatch(reqCtx, span, slot, "/api/chat", modelName, func(model string) ([]byte, error) {
+		ollamaReq.Model = model
+		return json.Marshal(ollamaReq)
+	})
+	if err != nil {
+		cancelReq(nil)
+		slot.Release()
+		endSpan(span, err)
+		return nil, err
+	}
+	responseModelName := responseModel(req.Model, modelName, resp.model)
+
+	relay := &streamRelay{
+		backend:     "Ollama",
+		body:        resp.Body,
+		idleTimeout: s.config.Load().StreamIdleTimeout,
+		reqCtx:      reqCtx,
+		cancelReq:   cancelReq,
+		onFail: func(reason string) {
+			recordUpstreamError(resp.up, "/api/chat", reason)
+			s.recordFailure(ctx, resp.up)
+		},
+		onEnd: func(err error) {
+			resp.release()
+			slot.Release()
+			endSpan(span, err)
+		},
 	}
 
-	streamChan := make(chan string, 100)
-
-	go func() {
-		defer resp.Body.Close()
-		defer close(streamChan)
+	id := generateID()
+	created := time.Now().Unix()
+	firstToken := true
+	var completion strings.Builder
 
-		scanner := bufio.NewScanner(resp.Body)
-		id := generateID()
-		created := time.Now().Unix()
+	return relay.start(ctx, func(line string) ([]string, bool, *streamFailure) {
+		if line == "" {
+			return nil, false, nil
+		}
 
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue
-			}
+		var ollamaResp models.OllamaChatResponse
+		if err := json.Unmarshal([]byte(line), &ollamaResp); err != nil {
+			return nil, false, &streamFailure{"decode", streamError("Ollama", "invalid data from Ollama", err)}
+		}
+		if ollamaResp.Error != "" {
+			return nil, false, &streamFailure{"stream", streamError("Ollama", ollamaResp.Error, nil)}
+		}
 
-			var ollamaResp models.OllamaChatResponse
-			if err := json.Unmarshal([]byte(line), &ollamaResp); err != nil {
-				continue
-			}
+		content := ollamaResp.Message.GetContentAsString()
+		completion.WriteString(content)
+		if firstToken && content != "" {
+			metrics.ObserveFirstToken(resp.model, time.Since(start))
+			firstToken = false
+		}
 
-			// Convert to OpenAI streaming format
-			streamResp := models.ChatCompletionStreamResponse{
-				ID:      id,
-				Object:  "chat.completion.chunk",
-				Created: created,
-				Model:   req.Model,
-				Choices: []models.ChatCompletionStreamChoice{
-					{
-						Index: 0,
-						Delta: models.ChatCompletionStreamDelta{
-							Content: ollamaResp.Message.GetContentAsString(),
-						},
+		// Convert to OpenAI streaming format
+		streamResp := models.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   responseModelName,
+			Choices: []models.ChatCompletionStreamChoice{
+				{
+					Index: 0,
+					Delta: models.ChatCompletionStreamDelta{
+						Content: content,
 					},
 				},
-			}
-
-			if ollamaResp.Done {
-				streamResp.Choices[0].FinishReason = stringPtr("stop")
-			}
-
-			jsonData, err := json.Marshal(streamResp)
-			if err != nil {
-				continue
-			}
-
-			streamChan <- "data: " + string(jsonData) + "\n\n"
+			},
+		}
 
-			if ollamaResp.Done {
-				streamChan <- "data: [DONE]\n\n"
-				break
-			}
+		if ollamaResp.Done {
+			streamResp.Choices[0].FinishReason = stringPtr("stop")
+			metrics.ObserveGeneration(resp.model, ollamaResp.EvalCount, ollamaResp.EvalDuration)
+			span.SetAttributes(tracing.ResponseAttributes(id, ollamaResp.Model, "stop",
+				usageOrEstimate(ollamaResp.PromptEvalCount, formatMessages(req.Messages)),
+				usageOrEstimate(ollamaResp.EvalCount, completion.String()))...)
 		}
-	}()
 
-	return streamChan, nil
+		jsonData, err := json.Marshal(streamResp)
+		if err != nil {
+			return nil, false, nil
+		}
+		if ollamaResp.Done {
+			return []string{string(jsonData), "[DONE]"}, true, nil
+		}
+		return []string{string(jsonData)}, false, nil
+	}), nil
 }
 
 // Text completion
-func (s *OllamaService) Completion(req *models.CompletionRequest) (*models.CompletionResponse, error) {
-	prompt := ""
-	switch p := req.Prompt.(type) {
-	case string:
-		prompt = p
-	case []string:
-		prompt = strings.Join(p, "\n")
-	default:
-		return nil, fmt.Errorf("unsupported prompt type")
+func (s *OllamaService) Completion(ctx context.Context, req *models.CompletionRequest) (_ *models.CompletionResponse, err error) {
+	prompt, err := promptText(req.Prompt)
+	if err != nil {
+		return nil, err
 	}
 
+	modelName := s.config.Load().OllamaModel
 	ollamaReq := &models.OllamaGenerateRequest{
-		Model:   s.config.OllamaModel,
 		Prompt:  prompt,
 		Stream:  false,
 		Options: s.convertOptionsFromCompletion(req),
 	}
 
-	jsonData, err := json.Marshal(ollamaReq)
+	ctx, span := startSpan(ctx, tracing.OperationTextCompletion+" "+modelName,
+		tracing.RequestAttributes(genAISystem, tracing.OperationTextCompletion, modelName, req.Temperature, req.TopP, req.MaxTokens)...)
+	defer func() { endSpan(span, err) }()
+
+	slot, err := s.admit(ctx, span, modelName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+		return nil, err
 	}
+	defer slot.Release()
+
+	logging.FromContext(ctx).Debug("sending generate request to Ollama", "model", modelName)
 
-	resp, err := s.client.Post(s.config.OllamaURL+"/api/generate", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := s.dispatch(ctx, span, slot, "/api/generate", modelName, func(model string) ([]byte, error) {
+		ollamaReq.Model = model
+		return json.Marshal(ollamaReq)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request to Ollama: %w", err)
+		return nil, err
 	}
+	defer resp.release()
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("Ollama API error: %s", string(body))
-	}
-
 	var ollamaResp models.OllamaGenerateResponse
 	if err := json.NewDecoder(resp.Body).Decode(&ollamaResp); err != nil {
+		recordUpstreamError(resp.up, "/api/generate", "decode")
 		return nil, fmt.Errorf("failed to decode Ollama response: %w", err)
 	}
 
+	metrics.ObserveGeneration(resp.model, ollamaResp.EvalCount, ollamaResp.EvalDuration)
+
+	id := generateID()
+	span.SetAttributes(tracing.ResponseAttributes(id, ollamaResp.Model, "stop",
+		usageOrEstimate(ollamaResp.PromptEvalCount, prompt),
+		usageOrEstimate(ollamaResp.EvalCount, ollamaResp.Response))...)
+
 	return &models.CompletionResponse{
-		ID:      generateID(),
+		ID:      id,
 		Object:  "text_completion",
 		Created: time.Now().Unix(),
-		Model:   req.Model,
+		Model:   responseModel(req.Model, modelName, resp.model),
 		Choices: []models.CompletionChoice{
 			{
 				Text:         ollamaResp.Response,
@@ -240,33 +362,75 @@ func (s *OllamaService) Completion(req *models.CompletionRequest) (*models.Compl
 	}, nil
 }
 
-// Get available models
-func (s *OllamaService) GetModels() (*models.ModelsResponse, error) {
-	resp, err := s.client.Get(s.config.OllamaURL + "/api/tags")
+// Embeddings for each input, in order
+func (s *OllamaService) Embed(ctx context.Context, model string, input []string) (_ [][]float32, err error) {
+	ctx, span := startSpan(ctx, tracing.OperationEmbeddings+" "+model,
+		tracing.RequestAttributes(genAISystem, tracing.OperationEmbeddings, model, nil, nil, nil)...)
+	defer func() { endSpan(span, err) }()
+
+	slot, err := s.admit(ctx, span, model)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get models from Ollama: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	defer slot.Release()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("Ollama API error: %s", string(body))
+	resp, err := s.dispatch(ctx, span, slot, "/api/embed", model, func(model string) ([]byte, error) {
+		return json.Marshal(&models.OllamaEmbedRequest{Model: model, Input: input})
+	})
+	if err != nil {
+		return nil, err
 	}
+	defer resp.release()
+	defer resp.Body.Close()
 
-	var ollamaResp models.OllamaModelsResponse
+	var ollamaResp models.OllamaEmbedResponse
 	if err := json.NewDecoder(resp.Body).Decode(&ollamaResp); err != nil {
+		recordUpstreamError(resp.up, "/api/embed", "decode")
 		return nil, fmt.Errorf("failed to decode Ollama response: %w", err)
 	}
+	if len(ollamaResp.Embeddings) != len(input) {
+		return nil, fmt.Errorf("Ollama returned %d embeddings for %d inputs", len(ollamaResp.Embeddings), len(input))
+	}
+	return ollamaResp.Embeddings, nil
+}
 
-	// Convert to OpenAI format
-	openaiModels := make([]models.Model, 0, len(ollamaResp.Models))
-	for _, model := range ollamaResp.Models {
-		openaiModels = append(openaiModels, models.Model{
-			ID:      model.Name,
-			Object:  "model",
-			Created: time.Now().Unix(),
-			OwnedBy: "ollama",
-		})
+// Get available models from every healthy backend
+func (s *OllamaService) GetModels(ctx context.Context) (_ *models.ModelsResponse, err error) {
+	ctx, span := startSpan(ctx, "GET /api/tags")
+	defer func() { endSpan(span, err) }()
+
+	upstreams := s.pool.Healthy()
+	if len(upstreams) == 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+
+	// Convert to OpenAI format, listing models pulled on several backends once
+	seen := make(map[string]bool)
+	openaiModels := make([]models.Model, 0)
+	var lastErr error
+	for _, up := range upstreams {
+		tags, err := s.listTags(ctx, up)
+		if err != nil {
+			lastErr = err
+			logging.FromContext(ctx).Warn("listing models failed on backend", "backend", up.Name(), "error", err)
+			continue
+		}
+		for _, model := range tags.Models {
+			if seen[model.Name] {
+				continue
+			}
+			seen[model.Name] = true
+			openaiModels = append(openaiModels, models.Model{
+				ID:      model.Name,
+				Object:  "model",
+				Created: time.Now().Unix(),
+				OwnedBy: "ollama",
+			})
+		}
+		lastErr = nil
+	}
+	if len(seen) == 0 && lastErr != nil {
+		return nil, lastErr
 	}
 
 	return &models.ModelsResponse{
@@ -275,6 +439,35 @@ func (s *OllamaService) GetModels() (*models.ModelsResponse, error) {
 	}, nil
 }
 
+func (s *OllamaService) listTags(ctx context.Context, up *Upstream) (*models.OllamaModelsResponse, error) {
+	httpReq, err := s.newRequest(ctx, up, http.MethodGet, "/api/tags", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		recordUpstreamError(up, "/api/tags", "connection")
+		return nil, fmt.Errorf("failed to get models from Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		recordUpstreamError(up, "/api/tags", statusReason(resp.StatusCode))
+		logging.FromContext(ctx).Warn("Ollama returned an error", "endpoint", "/api/tags", "status", resp.StatusCode)
+		return nil, statusError(up.Name(), resp.StatusCode, body, "")
+	}
+
+	var ollamaResp models.OllamaModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ollamaResp); err != nil {
+		recordUpstreamError(up, "/api/tags", "decode")
+		return nil, fmt.Errorf("failed to decode Ollama response: %w", err)
+	}
+
+	return &ollamaResp, nil
+}
+
 // Helper functions
 func (s *OllamaService) convertOptions(req *models.ChatCompletionRequest) *models.OllamaOptions {
 	options := &models.OllamaOptions{}
@@ -295,23 +488,7 @@ func (s *OllamaService) convertOptions(req *models.ChatCompletionRequest) *model
 		options.FrequencyPenalty = req.FrequencyPenalty
 	}
 
-	// Handle stop sequences
-	if req.Stop != nil {
-		switch stop := req.Stop.(type) {
-		case string:
-			options.Stop = []string{stop}
-		case []string:
-			options.Stop = stop
-		case []interface{}:
-			stopStrings := make([]string, 0, len(stop))
-			for _, s := range stop {
-				if str, ok := s.(string); ok {
-					stopStrings = append(stopStrings, str)
-				}
-			}
-			options.Stop = stopStrings
-		}
-	}
+	options.Stop = stopSequences(req.Stop)
 
 	return options
 }
@@ -335,25 +512,28 @@ func (s *OllamaService) convertOptionsFromCompletion(req *models.CompletionReque
 		options.FrequencyPenalty = req.FrequencyPenalty
 	}
 
-	// Handle stop sequences
-	if req.Stop != nil {
-		switch stop := req.Stop.(type) {
-		case string:
-			options.Stop = []string{stop}
-		case []string:
-			options.Stop = stop
-		case []interface{}:
-			stopStrings := make([]string, 0, len(stop))
-			for _, s := range stop {
-				if str, ok := s.(string); ok {
-					stopStrings = append(stopStrings, str)
-				}
+	options.Stop = stopSequences(req.Stop)
+
+	return options
+}
+
+// stopSequences reads the string or array forms of the stop parameter.
+func stopSequences(stop interface{}) []string {
+	switch stop := stop.(type) {
+	case string:
+		return []string{stop}
+	case []string:
+		return stop
+	case []interface{}:
+		stopStrings := make([]string, 0, len(stop))
+		for _, s := range stop {
+			if str, ok := s.(string); ok {
+				stopStrings = append(stopStrings, str)
 			}
-			options.Stop = stopStrings
 		}
+		return stopStrings
 	}
-
-	return options
+	return nil
 }
 
 func generateID() string {
@@ -386,6 +566,36 @@ func (s *OllamaService) convertMessagesForOllama(messages []models.ChatMessage)
 	return convertedMessages
 }
 
+// promptText joins the string or array forms of a completion prompt.
+func promptText(prompt interface{}) (string, error) {
+	switch p := prompt.(type) {
+	case string:
+		return p, nil
+	case []string:
+		return strings.Join(p, "\n"), nil
+	case []interface{}:
+		parts := make([]string, 0, len(p))
+		for _, part := range p {
+			str, ok := part.(string)
+			if !ok {
+				return "", invalidRequest("prompt", "prompt must be a string or an array of strings")
+			}
+			parts = append(parts, str)
+		}
+		return strings.Join(parts, "\n"), nil
+	default:
+		return "", invalidRequest("prompt", "prompt must be a string or an array of strings")
+	}
+}
+
 func stringPtr(s string) *string {
 	return &s
 }
+
+func recordUpstreamError(up *Upstream, endpoint, reason string) {
+	metrics.UpstreamErrors.WithLabelValues(up.Name(), endpoint, reason).Inc()
+}
+
+func statusReason(status int) string {
+	return fmt.Sprintf("http_%d", status)
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"openai-compatible/config"
+	"openai-compatible/metrics"
+	"openai-compatible/models"
+	"openai-compatible/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenAIProvider forwards requests to an OpenAI compatible server such as
+// vLLM, the llama.cpp server or LM Studio. Model IDs are routed to it by
+// prefix: the prefix is stripped before the request goes upstream and put
+// back on the model IDs we return.
+type OpenAIProvider struct {
+	*httpBackend
+	prefix string
+}
+
+func NewOpenAIProvider(cfg *config.Config, upstream config.Upstream) (*OpenAIProvider, error) {
+	backend, err := newHTTPBackend(cfg, upstream)
+	if err != nil {
+		return nil, err
+	}
+	return &OpenAIProvider{
+		httpBackend: backend,
+		prefix:      upstream.Prefix,
+	}, nil
+}
+
+// upstreamModel strips the routing prefix from a model ID.
+func (p *OpenAIProvider) upstreamModel(model string) string {
+	return strings.TrimPrefix(model, p.prefix)
+}
+
+// Chat completion with an OpenAI compatible server
+func (p *OpenAIProvider) ChatCompletion(ctx context.Context, req *models.ChatCompletionRequest) (_ *models.ChatCompletionResponse, err error) {
+	ctx, span := p.startSpan(ctx, tracing.OperationChat, req.Model, req.Temperature, req.TopP, req.MaxTokens)
+	defer func() { endSpan(span, err) }()
+
+	slot, err := p.admit(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer slot.Release()
+
+	upstreamReq := *req
+	upstreamReq.Model = p.upstreamModel(req.Model)
+	upstreamReq.Stream = nil
+
+	var resp models.ChatCompletionResponse
+	if err := p.call(ctx, "/chat/completions", &upstreamReq, &resp); err != nil {
+		return nil, err
+	}
+	resp.Model = req.Model
+	return &resp, nil
+}
+
+// Streaming chat completion. The upstream SSE chunks are passed through with
+// the model ID rewritten.
+func (p *OpenAIProvider) ChatCompletionStream(ctx context.Context, req *models.ChatCompletionRequest) (<-chan StreamEvent, error) {
+	// The span outlives this call and is ended by the stream goroutine.
+	ctx, span := p.startSpan(ctx, tracing.OperationChat, req.Model, req.Temperature, req.TopP, req.MaxTokens)
+
+	slot, err := p.admit(ctx, req.Model)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	upstreamReq := *req
+	upstreamReq.Model = p.upstreamModel(req.Model)
+	stream := true
+	upstreamReq.Stream = &stream
+
+	// The request is cancelled with errStreamIdle if the upstream goes quiet
+	// mid-stream.
+	reqCtx, cancelReq := context.WithCancelCause(ctx)
+	start := time.Now()
+	resp, err := p.post(reqCtx, "/chat/completions", &upstreamReq)
+	if err != nil {
+		cancelReq(nil)
+		slot.Release()
+		endSpan(span, err)
+		return nil, err
+	}
+
+	relay := p.relay(ctx, reqCtx, cancelReq, resp, "/chat/completions", func(err error) {
+		slot.Release()
+		endSpan(span, err)
+	})
+	firstToken := true
+
+	return relay.start(ctx, func(line string) ([]string, bool, *streamFailure) {
+		payload, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			return nil, false, nil // blank separators, comments and event names
+		}
+		payload = strings.TrimSpace(payload)
+
+		if payload == "[DONE]" {
+			return []string{payload}, true, nil
+		}
+
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			return nil, false, &streamFailure{"decode", streamError(p.name, "invalid data from upstream", err)}
+		}
+		if upstreamErr, ok := chunk["error"]; ok {
+			return nil, false, &streamFailure{"stream", streamError(p.name, errorMessage(upstreamErr), nil)}
+		}
+
+		if firstToken {
+			metrics.ObserveFirstToken(req.Model, time.Since(start))
+			firstToken = false
+		}
+
+		chunk["model"] = req.Model
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return nil, false, nil
+		}
+		return []string{string(data)}, false, nil
+	}), nil
+}
+
+// Text completion with an OpenAI compatible server
+func (p *OpenAIProvider) Completion(ctx context.Context, req *models.CompletionRequest) (_ *models.CompletionResponse, err error) {
+	ctx, span := p.startSpan(ctx, tracing.OperationTextCompletion, req.Model, req.Temperature, req.TopP, req.MaxTokens)
+	defer func() { endSpan(span, err) }()
+
+	slot, err := p.admit(ctx, req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer slot.Release()
+
+	upstreamReq := *req
+	upstreamReq.Model = p.upstreamModel(req.Model)
+	upstreamReq.Stream = nil
+
+	var resp models.CompletionResponse
+	if err := p.call(ctx, "/completions", &upstreamReq, &resp); err != nil {
+		return nil, err
+	}
+	resp.Model = req.Model
+	return &resp, nil
+}
+
+// Embeddings for each input, in order
+func (p *OpenAIProvider) Embed(ctx context.Context, model string, input []string) (_ [][]float32, err error) {
+	ctx, span := p.startSpan(ctx, tracing.OperationEmbeddings, model, nil, nil, nil)
+	defer func() { endSpan(span, err) }()
+
+	slot, err := p.admit(ctx, model)
+	if err != nil {
+		return nil, err
+	}
+	defer slot.Release()
+
+	var resp models.EmbeddingResponse
+	if err := p.call(ctx, "/embeddings", &models.EmbeddingRequest{Model: p.upstreamModel(model), Input: input}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Data) != len(input) {
+		return nil, fmt.Errorf("%s returned %d embeddings for %d inputs", p.name, len(resp.Data), len(input))
+	}
+	sort.Slice(resp.Data, func(i, j int) bool { return resp.Data[i].Index < resp.Data[j].Index })
+	embeddings := make([][]float32, len(resp.Data))
+	for i, e := range resp.Data {
+		embeddings[i] = e.Embedding
+	}
+	return embeddings, nil
+}
+
+// Get the models served upstream, with the routing prefix
+func (p *OpenAIProvider) GetModels(ctx context.Context) (_ *models.ModelsResponse, err error) {
+	ctx, span := startSpan(ctx, "GET "+p.name+" /models")
+	defer func() { endSpan(span, err) }()
+
+	var list models.ModelsResponse
+	if err := p.get(ctx, "/models", &list); err != nil {
+		return nil, err
+	}
+	for i := range list.Data {
+		list.Data[i].ID = p.prefix + list.Data[i].ID
+		list.Data[i].Object = "model"
+		if list.Data[i].OwnedBy == "" {
+			list.Data[i].OwnedBy = p.name
+		}
+	}
+	list.Object = "list"
+	return &list, nil
+}
+
+func (p *OpenAIProvider) startSpan(ctx context.Context, operation, model string, temperature, topP *float64, maxTokens *int) (context.Context, trace.Span) {
+	return startSpan(ctx, operation+" "+model,
+		tracing.RequestAttributes(p.name, operation, model, temperature, topP, maxTokens)...)
+}
+
+var _ Provider = (*OpenAIProvider)(nil)
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"openai-compatible/config"
+	"openai-compatible/limiter"
+	"openai-compatible/models"
+)
+
+func newOpenAIProvider(t *testing.T, handler http.HandlerFunc, cfg *config.Config) *OpenAIProvider {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	p, err := NewOpenAIProvider(cfg, config.Upstream{Name: "vllm", BaseURL: srv.URL, Prefix: "vllm/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func chatRequest(model string) *models.ChatCompletionRequest {
+	return &models.ChatCompletionRequest{
+		Model:    model,
+		Messages: []models.ChatMessage{{Role: "user", Content: "hi"}},
+	}
+}
+
+func TestOpenAIStream(t *testing.T) {
+	p := newOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"model\":\"llama\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}, &config.Config{RetryMaxAttempts: 1})
+
+	events, err := p.ChatCompletionStream(context.Background(), chatRequest("vllm/llama"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []string
+	for event := range events {
+		if event.Err != nil {
+			t.Fatalf("stream failed: %v", event.Err)
+		}
+		data = append(data, event.Data)
+	}
+	want := []string{
+		"data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}],\"model\":\"vllm/llama\"}\n\n",
+		"data: [DONE]\n\n",
+	}
+	if strings.Join(data, "") != strings.Join(want, "") {
+		t.Errorf("events = %q, want %q", data, want)
+	}
+}
+
+func TestOpenAIStreamIncomplete(t *testing.T) {
+	p := newOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\":[]}\n\n")
+	}, &config.Config{RetryMaxAttempts: 1})
+
+	events, err := p.ChatCompletionStream(context.Background(), chatRequest("vllm/llama"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last StreamEvent
+	for event := range events {
+		last = event
+	}
+	var e *Error
+	if !errors.As(last.Err, &e) || e.Code != "upstream_error" {
+		t.Fatalf("last event = %+v, want an upstream_error", last)
+	}
+}
+
+func TestOpenAICircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	p := newOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, `{"error":"overloaded"}`, http.StatusInternalServerError)
+	}, &config.Config{RetryMaxAttempts: 1, BreakerThreshold: 2, BreakerOpenDuration: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.ChatCompletion(context.Background(), chatRequest("vllm/llama")); err == nil {
+			t.Fatal("request to a failing upstream succeeded")
+		}
+	}
+	_, err := p.ChatCompletion(context.Background(), chatRequest("vllm/llama"))
+	var e *Error
+	if !errors.As(err, &e) || e.Code != "upstream_unavailable" {
+		t.Fatalf("err = %v, want upstream_unavailable while the breaker is open", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+}
+
+func TestOpenAILimiter(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	p := newOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		fmt.Fprint(w, `{"object":"chat.completion","choices":[]}`)
+	}, &config.Config{RetryMaxAttempts: 1, MaxParallelPerBackend: 1, QueueSize: 0})
+	defer close(release)
+
+	go p.ChatCompletion(context.Background(), chatRequest("vllm/llama"))
+	<-started
+	if _, err := p.ChatCompletion(context.Background(), chatRequest("vllm/llama")); !errors.Is(err, limiter.ErrQueueFull) {
+		t.Fatalf("err = %v, want ErrQueueFull while the only slot is taken", err)
+	}
+}
+
+func TestOpenAIReload(t *testing.T) {
+	var requests atomic.Int32
+	p := newOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, `{"error":"overloaded"}`, http.StatusInternalServerError)
+	}, &config.Config{RetryMaxAttempts: 1})
+
+	p.Reload(&config.Config{RetryMaxAttempts: 3, RetryBaseDelay: time.Millisecond, RetryMaxDelay: time.Millisecond})
+	if _, err := p.ChatCompletion(context.Background(), chatRequest("vllm/llama")); err == nil {
+		t.Fatal("request to a failing upstream succeeded")
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("upstream got %d requests, want 3 after reloading the retries", n)
+	}
+}
+
+// The prefix is stripped going upstream and put back on what comes back.
+func TestOpenAIPrefix(t *testing.T) {
+	p := newOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/models" {
+			fmt.Fprint(w, `{"object":"list","data":[{"id":"llama"}]}`)
+			return
+		}
+		var req models.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != "llama" {
+			http.Error(w, `{"error":"unknown model"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"object":"chat.completion","model":"llama","choices":[]}`)
+	}, &config.Config{RetryMaxAttempts: 1})
+
+	resp, err := p.ChatCompletion(context.Background(), chatRequest("vllm/llama"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Model != "vllm/llama" {
+		t.Errorf("model = %q, want vllm/llama", resp.Model)
+	}
+
+	list, err := p.GetModels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Data) != 1 || list.Data[0].ID != "vllm/llama" || list.Data[0].OwnedBy != "vllm" {
+		t.Errorf("models = %+v, want vllm/llama owned by vllm", list.Data)
+	}
+}
+
+func TestOpenAIStatusErrors(t *testing.T) {
+	tests := []struct {
+		status     int
+		body       string
+		wantStatus int
+		wantCode   string
+		wantParam  string
+	}{
+		{http.StatusTooManyRequests, `{"error":"slow down"}`, http.StatusTooManyRequests, "upstream_rate_limited", ""},
+		{http.StatusUnauthorized, `{"error":"bad key"}`, http.StatusBadGateway, "upstream_error", ""},
+		{http.StatusNotFound, `{"error":{"message":"no such model"}}`, http.StatusNotFound, "model_not_found", "model"},
+		{http.StatusUnprocessableEntity, `{"error":{"message":"too hot","code":"bad_temperature","param":"temperature"}}`, http.StatusBadRequest, "bad_temperature", "temperature"},
+		{http.StatusInternalServerError, `{"error":"overloaded"}`, http.StatusBadGateway, "upstream_error", ""},
+	}
+	for _, tt := range tests {
+		p := newOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "7")
+			http.Error(w, tt.body, tt.status)
+		}, &config.Config{RetryMaxAttempts: 1})
+
+		_, err := p.ChatCompletion(context.Background(), chatRequest("vllm/llama"))
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Fatalf("%d: err = %v, want an *Error", tt.status, err)
+		}
+		if e.Status != tt.wantStatus || e.Code != tt.wantCode || e.Param != tt.wantParam {
+			t.Errorf("%d: got %d %s param %q, want %d %s param %q", tt.status, e.Status, e.Code, e.Param, tt.wantStatus, tt.wantCode, tt.wantParam)
+		}
+		if tt.status == http.StatusTooManyRequests && e.RetryAfter != 7*time.Second {
+			t.Errorf("RetryAfter = %v, want 7s", e.RetryAfter)
+		}
+	}
+}
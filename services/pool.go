@@ -0,0 +1,333 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoHealthyUpstream is returned when every configured Ollama backend
+// failed its last health check or has an open circuit breaker.
+var ErrNoHealthyUpstream = errors.New("no healthy Ollama backend available")
+
+// Load balancing strategies.
+const (
+	StrategyRoundRobin    = "round_robin"
+	StrategyLeastInflight = "least_inflight"
+	StrategyModelAffinity = "model_affinity"
+)
+
+// Upstream is one Ollama instance and what the health checker last learned
+// about it.
+type Upstream struct {
+	URL string
+
+	inflight atomic.Int64
+	healthy  atomic.Bool
+	breaker  *circuitBreaker
+
+	mu        sync.RWMutex
+	status    BackendStatus
+	loaded    map[string]bool // models currently in memory (/api/ps)
+	available map[string]bool // models pulled on the host (/api/tags)
+}
+
+func newUpstream(name, url string, breaker *circuitBreaker) *Upstream {
+	url = strings.TrimRight(url, "/")
+	u := &Upstream{
+		URL:     url,
+		breaker: breaker,
+		status: BackendStatus{
+			Name:   name,
+			URL:    url,
+			Status: BackendUp,
+		},
+	}
+	// Optimistically healthy until the first check says otherwise, so
+	// requests aren't rejected during startup.
+	u.healthy.Store(true)
+	return u
+}
+
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+func (u *Upstream) Inflight() int64 {
+	return u.inflight.Load()
+}
+
+// acquire counts a request against the upstream until release is called.
+func (u *Upstream) acquire() (release func()) {
+	u.inflight.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { u.inflight.Add(-1) })
+	}
+}
+
+// Name identifies the upstream in logs, metrics and readiness output.
+func (u *Upstream) Name() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.status.Name
+}
+
+// Status returns the result of the last health check.
+func (u *Upstream) Status() BackendStatus {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.status
+}
+
+func (u *Upstream) hasLoaded(model string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.loaded[model]
+}
+
+func (u *Upstream) hasAvailable(model string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.available[model]
+}
+
+// update records a health check result. It returns true if the upstream
+// changed between healthy and unhealthy.
+func (u *Upstream) update(status BackendStatus, loaded, available map[string]bool) bool {
+	u.mu.Lock()
+	u.status = status
+	if loaded != nil {
+		u.loaded = loaded
+	}
+	if available != nil {
+		u.available = available
+	}
+	u.mu.Unlock()
+
+	healthy := status.Status == BackendUp
+	return u.healthy.Swap(healthy) != healthy
+}
+
+// Strategy picks one upstream out of the healthy candidates for a model.
+type Strategy interface {
+	Pick(candidates []*Upstream, model string) *Upstream
+}
+
+func NewStrategy(name string) (Strategy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", StrategyRoundRobin:
+		return &roundRobin{}, nil
+	case StrategyLeastInflight:
+		return leastInflight{}, nil
+	case StrategyModelAffinity:
+		return modelAffinity{}, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q (want %s, %s or %s)",
+			name, StrategyRoundRobin, StrategyLeastInflight, StrategyModelAffinity)
+	}
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (r *roundRobin) Pick(candidates []*Upstream, _ string) *Upstream {
+	n := r.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+type leastInflight struct{}
+
+func (leastInflight) Pick(candidates []*Upstream, _ string) *Upstream {
+	best := candidates[0]
+	for _, u := range candidates[1:] {
+		if u.Inflight() < best.Inflight() {
+			best = u
+		}
+	}
+	return best
+}
+
+// modelAffinity prefers hosts that already have the model loaded, then hosts
+// that have it pulled, so we avoid paying for a model load on a cold host.
+// Ties are broken by the number of in-flight requests.
+type modelAffinity struct{}
+
+func (modelAffinity) Pick(candidates []*Upstream, model string) *Upstream {
+	var loaded, available []*Upstream
+	for _, u := range candidates {
+		switch {
+		case u.hasLoaded(model):
+			loaded = append(loaded, u)
+		case u.hasAvailable(model):
+			available = append(available, u)
+		}
+	}
+
+	switch {
+	case len(loaded) > 0:
+		return leastInflight{}.Pick(loaded, model)
+	case len(available) > 0:
+		return leastInflight{}.Pick(available, model)
+	default:
+		return leastInflight{}.Pick(candidates, model)
+	}
+}
+
+// PoolOptions tunes the backends of a Pool.
+type PoolOptions struct {
+	// Each backend's circuit breaker opens after BreakerThreshold
+	// consecutive failures and stays open for BreakerOpenFor. A threshold of
+	// 0 disables the breakers.
+	BreakerThreshold int
+	BreakerOpenFor   time.Duration
+
+	// MaxInflight is how many requests a backend should run at once. Full
+	// backends are only picked if every backend is full. 0 means unlimited.
+	MaxInflight int
+}
+
+// Pool is the set of configured Ollama backends.
+type Pool struct {
+	upstreams   []*Upstream
+	strategy    Strategy
+	maxInflight int64
+}
+
+// NewPool creates a backend per URL.
+func NewPool(urls []string, strategy Strategy, opts PoolOptions) *Pool {
+	upstreams := make([]*Upstream, 0, len(urls))
+	for i, url := range urls {
+		name := "ollama"
+		if len(urls) > 1 {
+			name = fmt.Sprintf("ollama-%d", i)
+		}
+		upstreams = append(upstreams, newUpstream(name, url, newCircuitBreaker(opts.BreakerThreshold, opts.BreakerOpenFor)))
+	}
+	return &Pool{
+		upstreams:   upstreams,
+		strategy:    strategy,
+		maxInflight: int64(opts.MaxInflight),
+	}
+}
+
+// Upstreams returns every configured backend, healthy or not.
+func (p *Pool) Upstreams() []*Upstream {
+	return p.upstreams
+}
+
+// Upstream returns the backend called name, or nil.
+func (p *Pool) Upstream(name string) *Upstream {
+	for _, u := range p.upstreams {
+		if u.Name() == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// Healthy returns the backends that passed their last health check.
+func (p *Pool) Healthy() []*Upstream {
+	healthy := make([]*Upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.Healthy() {
+			healthy = append(healthy, u)
+		}
+	}
+	return healthy
+}
+
+// Available returns the healthy backends whose circuit breaker lets
+// traffic through.
+func (p *Pool) Available() []*Upstream {
+	available := make([]*Upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.Healthy() && u.breaker.available() {
+			available = append(available, u)
+		}
+	}
+	return available
+}
+
+// Pick chooses a backend for model using the configured strategy. Backends
+// that are unhealthy, whose circuit breaker is open, or that are in exclude
+// (already tried for this request) are skipped. If only excluded backends
+// are left they are considered again, so a single backend can still be
+// retried. Backends at their in-flight limit are avoided while others have
+// room.
+func (p *Pool) Pick(model string, exclude map[*Upstream]bool) (*Upstream, error) {
+	var candidates, excluded []*Upstream
+	for _, u := range p.Available() {
+		if exclude[u] {
+			excluded = append(excluded, u)
+			continue
+		}
+		candidates = append(candidates, u)
+	}
+	if len(candidates) == 0 {
+		candidates = excluded
+	}
+	if p.maxInflight > 0 {
+		var free []*Upstream
+		for _, u := range candidates {
+			if u.Inflight() < p.maxInflight {
+				free = append(free, u)
+			}
+		}
+		if len(free) > 0 {
+			candidates = free
+		}
+	}
+
+	// The strategy and the breaker's half-open trial slot can race with
+	// other requests, so fall back to the next candidate if we lost.
+	for len(candidates) > 0 {
+		u := p.strategy.Pick(candidates, model)
+		if u.breaker.allow() {
+			return u, nil
+		}
+		candidates = remove(candidates, u)
+	}
+	return nil, ErrNoHealthyUpstream
+}
+
+// poolBackends shows the pool to the limiter, which admits requests per
+// backend and lets the pool's strategy choose between backends with room.
+type poolBackends struct {
+	pool *Pool
+}
+
+func (b poolBackends) Available() []string {
+	var names []string
+	for _, u := range b.pool.Available() {
+		names = append(names, u.Name())
+	}
+	return names
+}
+
+func (b poolBackends) Pick(model string, candidates []string) string {
+	upstreams := make([]*Upstream, 0, len(candidates))
+	for _, name := range candidates {
+		if u := b.pool.Upstream(name); u != nil {
+			upstreams = append(upstreams, u)
+		}
+	}
+	if len(upstreams) == 0 {
+		return candidates[0]
+	}
+	return b.pool.strategy.Pick(upstreams, model).Name()
+}
+
+func remove(upstreams []*Upstream, target *Upstream) []*Upstream {
+	out := make([]*Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u != target {
+			out = append(out, u)
+		}
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"context"
+
+	"openai-compatible/config"
+	"openai-compatible/models"
+)
+
+// Provider is a backend that serves OpenAI style requests. OllamaService is
+// one, Registry routes between several.
+type Provider interface {
+	// ChatCompletion runs a chat completion.
+	ChatCompletion(ctx context.Context, req *models.ChatCompletionRequest) (*models.ChatCompletionResponse, error)
+
+	// ChatCompletionStream starts a streaming chat completion. The channel
+	// carries ready to write SSE chunks and is closed after the final [DONE]
+	// chunk or error event, or once ctx is cancelled.
+	ChatCompletionStream(ctx context.Context, req *models.ChatCompletionRequest) (<-chan StreamEvent, error)
+
+	// Completion runs a text completion.
+	Completion(ctx context.Context, req *models.CompletionRequest) (*models.CompletionResponse, error)
+
+	// Embed returns the embedding of each input, in order.
+	Embed(ctx context.Context, model string, input []string) ([][]float32, error)
+
+	// GetModels lists the models the provider serves.
+	GetModels(ctx context.Context) (*models.ModelsResponse, error)
+}
+
+// Resolver is implemented by providers that serve some models under another
+// name, like the Registry with its aliases.
+type Resolver interface {
+	Resolve(model string) string
+}
+
+// ResolveModel returns the model p serves requests for model with.
+func ResolveModel(p Provider, model string) string {
+	if r, ok := p.(Resolver); ok {
+		return r.Resolve(model)
+	}
+	return model
+}
+
+// Reloader is implemented by providers whose retries, limits and stream
+// idle timeout can change while they run, see Registry.ReloadProviders.
+type Reloader interface {
+	Reload(cfg *config.Config)
+}
+
+var (
+	_ Provider = (*OllamaService)(nil)
+	_ Reloader = (*OllamaService)(nil)
+	_ Reloader = (*OpenAIProvider)(nil)
+	_ Reloader = (*LlamaCppProvider)(nil)
+)
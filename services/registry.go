@@ -0,0 +1,266 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"openai-compatible/config"
+	"openai-compatible/logging"
+	"openai-compatible/models"
+)
+
+// Registry routes each request to a provider by model ID: exact routes
+// first, then the longest matching prefix route. Models without a route go
+// to the default provider. Model aliases are resolved before routing. The
+// registry is itself a Provider, so handlers don't need to know how many
+// backends there are.
+type Registry struct {
+	providers   map[string]Provider
+	names       []string // registration order, for GetModels
+	defaultName string
+	prefixes    map[string]string // model ID prefix -> provider name
+
+	// table holds the routes and aliases. It is never modified, Reload and
+	// the setup methods swap in a new one, so a request routes with one
+	// consistent table.
+	table atomic.Pointer[routingTable]
+	mu    sync.Mutex // serializes table updates
+}
+
+// routingTable maps model IDs, see Registry.
+type routingTable struct {
+	routes  map[string]string // model ID -> provider name
+	aliases map[string]string // alias -> model ID
+}
+
+// NewRegistry creates a registry whose default provider is p, registered
+// under name.
+func NewRegistry(name string, p Provider) *Registry {
+	r := &Registry{
+		providers:   map[string]Provider{name: p},
+		names:       []string{name},
+		defaultName: name,
+		prefixes:    make(map[string]string),
+	}
+	r.table.Store(&routingTable{routes: map[string]string{}, aliases: map[string]string{}})
+	return r
+}
+
+// Register adds a provider under name.
+func (r *Registry) Register(name string, p Provider) error {
+	if _, ok := r.providers[name]; ok {
+		return fmt.Errorf("provider %q is already registered", name)
+	}
+	r.providers[name] = p
+	r.names = append(r.names, name)
+	return nil
+}
+
+// Route sends requests for model to the provider registered as name.
+func (r *Registry) Route(model, name string) error {
+	if _, ok := r.providers[name]; !ok {
+		return fmt.Errorf("model %q is routed to unknown provider %q", model, name)
+	}
+	r.update(func(t *routingTable) { t.routes[model] = name })
+	return nil
+}
+
+// RoutePrefix sends requests for every model starting with prefix to the
+// provider registered as name.
+func (r *Registry) RoutePrefix(prefix, name string) error {
+	if _, ok := r.providers[name]; !ok {
+		return fmt.Errorf("prefix %q is routed to unknown provider %q", prefix, name)
+	}
+	if other, ok := r.prefixes[prefix]; ok && other != name {
+		return fmt.Errorf("prefix %q is routed to both %q and %q", prefix, other, name)
+	}
+	r.prefixes[prefix] = name
+	return nil
+}
+
+// Alias makes requests for alias use model instead. Providers get a copy of
+// the request naming model, the caller's request is left untouched.
+func (r *Registry) Alias(alias, model string) {
+	r.update(func(t *routingTable) { t.aliases[alias] = model })
+}
+
+// update swaps in a copy of the routing table changed by change.
+func (r *Registry) update(change func(t *routingTable)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.table.Load()
+	t := &routingTable{routes: maps.Clone(old.routes), aliases: maps.Clone(old.aliases)}
+	change(t)
+	r.table.Store(t)
+}
+
+// Reload replaces the model routes and aliases. Nothing changes if a route
+// names an unknown provider.
+func (r *Registry) Reload(routes, aliases map[string]string) error {
+	for model, name := range routes {
+		if _, ok := r.providers[name]; !ok {
+			return fmt.Errorf("model %q is routed to unknown provider %q", model, name)
+		}
+	}
+	t := &routingTable{routes: maps.Clone(routes), aliases: maps.Clone(aliases)}
+	if t.routes == nil {
+		t.routes = map[string]string{}
+	}
+	if t.aliases == nil {
+		t.aliases = map[string]string{}
+	}
+	r.mu.Lock()
+	r.table.Store(t)
+	r.mu.Unlock()
+	return nil
+}
+
+// ReloadProviders passes cfg on to the providers whose settings can change
+// while they run.
+func (r *Registry) ReloadProviders(cfg *config.Config) {
+	for _, name := range r.names {
+		if p, ok := r.providers[name].(Reloader); ok {
+			p.Reload(cfg)
+		}
+	}
+}
+
+// Resolve returns the model an alias stands for, or model itself.
+func (r *Registry) Resolve(model string) string {
+	_, _, resolved := r.route(model)
+	return resolved
+}
+
+// Provider returns the provider serving model, and its name.
+func (r *Registry) Provider(model string) (Provider, string) {
+	p, name, _ := r.route(model)
+	return p, name
+}
+
+// route resolves model and picks its provider, both from the same routing
+// table.
+func (r *Registry) route(model string) (p Provider, name, resolved string) {
+	t := r.table.Load()
+	if target, ok := t.aliases[model]; ok {
+		model = target
+	}
+	name, ok := t.routes[model]
+	if !ok {
+		name = r.defaultName
+		longest := -1
+		for prefix, provider := range r.prefixes {
+			if strings.HasPrefix(model, prefix) && len(prefix) > longest {
+				name, longest = provider, len(prefix)
+			}
+		}
+	}
+	return r.providers[name], name, model
+}
+
+func (r *Registry) ChatCompletion(ctx context.Context, req *models.ChatCompletionRequest) (*models.ChatCompletionResponse, error) {
+	p, name, model := r.route(req.Model)
+	resp, err := p.ChatCompletion(ctx, chatRequestFor(req, model))
+	return resp, named(name, err)
+}
+
+func (r *Registry) ChatCompletionStream(ctx context.Context, req *models.ChatCompletionRequest) (<-chan StreamEvent, error) {
+	p, name, model := r.route(req.Model)
+	events, err := p.ChatCompletionStream(ctx, chatRequestFor(req, model))
+	return events, named(name, err)
+}
+
+func (r *Registry) Completion(ctx context.Context, req *models.CompletionRequest) (*models.CompletionResponse, error) {
+	p, name, model := r.route(req.Model)
+	resp, err := p.Completion(ctx, completionRequestFor(req, model))
+	return resp, named(name, err)
+}
+
+func (r *Registry) Embed(ctx context.Context, model string, input []string) ([][]float32, error) {
+	p, name, resolved := r.route(model)
+	embeddings, err := p.Embed(ctx, resolved, input)
+	return embeddings, named(name, err)
+}
+
+// named attaches the name of the provider to err, so Classify can tell which
+// backend failed.
+func named(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &backendError{backend: name, err: err}
+}
+
+// chatRequestFor returns req, or a copy of it naming model if an alias was
+// resolved.
+func chatRequestFor(req *models.ChatCompletionRequest, model string) *models.ChatCompletionRequest {
+	if model == req.Model {
+		return req
+	}
+	resolved := *req
+	resolved.Model = model
+	return &resolved
+}
+
+// completionRequestFor is chatRequestFor for text completions.
+func completionRequestFor(req *models.CompletionRequest, model string) *models.CompletionRequest {
+	if model == req.Model {
+		return req
+	}
+	resolved := *req
+	resolved.Model = model
+	return &resolved
+}
+
+// GetModels merges the model lists of every provider. A provider that fails
+// is left out; the call only fails if every provider did. Aliases are listed
+// like the model they stand for, if it's listed.
+func (r *Registry) GetModels(ctx context.Context) (*models.ModelsResponse, error) {
+	merged := &models.ModelsResponse{Object: "list", Data: []models.Model{}}
+	seen := make(map[string]bool)
+	var errs []error
+	for _, name := range r.names {
+		resp, err := r.providers[name].GetModels(ctx)
+		if err != nil {
+			logging.FromContext(ctx).Warn("listing models failed", "provider", name, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		for _, m := range resp.Data {
+			if !seen[m.ID] {
+				seen[m.ID] = true
+				merged.Data = append(merged.Data, m)
+			}
+		}
+	}
+	if len(errs) == len(r.names) {
+		return nil, errors.Join(errs...)
+	}
+
+	t := r.table.Load()
+	aliases := make([]string, 0, len(t.aliases))
+	for alias := range t.aliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		if seen[alias] {
+			continue
+		}
+		for _, m := range merged.Data {
+			if m.ID == t.aliases[alias] {
+				m.ID = alias
+				merged.Data = append(merged.Data, m)
+				break
+			}
+		}
+	}
+	return merged, nil
+}
+
+var _ Provider = (*Registry)(nil)
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"openai-compatible/models"
+)
+
+// echoProvider answers chat completions with its name and the model it got.
+type echoProvider struct {
+	Provider
+	name string
+}
+
+func (p *echoProvider) ChatCompletion(ctx context.Context, req *models.ChatCompletionRequest) (*models.ChatCompletionResponse, error) {
+	return &models.ChatCompletionResponse{ID: p.name, Model: req.Model}, nil
+}
+
+func TestRegistryRouting(t *testing.T) {
+	r := NewRegistry("ollama", &echoProvider{name: "ollama"})
+	for _, name := range []string{"vllm", "special"} {
+		if err := r.Register(name, &echoProvider{name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.RoutePrefix("vllm/", "vllm"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Route("vllm/special", "special"); err != nil {
+		t.Fatal(err)
+	}
+	r.Alias("gpt-4o", "vllm/llama")
+
+	tests := []struct{ model, provider, served string }{
+		{"llama3.2", "ollama", "llama3.2"},
+		{"vllm/llama", "vllm", "vllm/llama"},
+		{"vllm/special", "special", "vllm/special"},
+		{"gpt-4o", "vllm", "vllm/llama"},
+	}
+	for _, tt := range tests {
+		req := chatRequest(tt.model)
+		resp, err := r.ChatCompletion(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != tt.provider || resp.Model != tt.served {
+			t.Errorf("%s: served by %s as %s, want %s as %s", tt.model, resp.ID, resp.Model, tt.provider, tt.served)
+		}
+		if req.Model != tt.model {
+			t.Errorf("%s: the caller's request was changed to %s", tt.model, req.Model)
+		}
+	}
+}
+
+// A request routes with one routing table, even while Reload swaps tables.
+func TestRegistryReloadIsAtomic(t *testing.T) {
+	r := NewRegistry("ollama", &echoProvider{name: "ollama"})
+	for _, name := range []string{"a", "b"} {
+		if err := r.Register(name, &echoProvider{name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tables := []struct{ routes, aliases map[string]string }{
+		{map[string]string{"model-a": "a"}, map[string]string{"alias": "model-a"}},
+		{map[string]string{"model-b": "b"}, map[string]string{"alias": "model-b"}},
+	}
+
+	if err := r.Reload(tables[0].routes, tables[0].aliases); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ctx.Err() == nil; i++ {
+			table := tables[i%2]
+			if err := r.Reload(table.routes, table.aliases); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100000; i++ {
+		resp, err := r.ChatCompletion(ctx, chatRequest("alias"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("model-%s", resp.ID); resp.Model != want {
+			cancel()
+			wg.Wait()
+			t.Fatalf("provider %s got %s, the alias and the route came from different tables", resp.ID, resp.Model)
+		}
+	}
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"openai-compatible/config"
+)
+
+// retryPolicy controls how often a request is retried against Ollama before
+// any response has been streamed to the client.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+func newRetryPolicy(cfg *config.Config) retryPolicy {
+	return retryPolicy{
+		maxAttempts: cfg.RetryMaxAttempts,
+		baseDelay:   cfg.RetryBaseDelay,
+		maxDelay:    cfg.RetryMaxDelay,
+	}
+}
+
+// backoff returns the delay before retry number attempt (starting at 1),
+// using exponential backoff with full jitter.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	if p.baseDelay <= 0 {
+		return 0
+	}
+	delay := p.baseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryable reports whether err is worth retrying on another attempt:
+// connection failures and 5xx responses are, client errors, timeouts and our
+// own cancellation are not.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e.upstreamStatus >= 500
+	}
+
+	// Don't retry timeouts, the attempt already took the whole client timeout.
+	var netErr net.Error
+	return errors.As(err, &netErr) && !netErr.Timeout()
+}
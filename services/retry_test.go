@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"openai-compatible/config"
+	"openai-compatible/models"
+)
+
+func TestBackoffStaysWithinBounds(t *testing.T) {
+	p := retryPolicy{maxAttempts: 5, baseDelay: 100 * time.Millisecond, maxDelay: 300 * time.Millisecond}
+	for attempt, limit := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 300 * time.Millisecond, 10: 300 * time.Millisecond, 80: 300 * time.Millisecond} {
+		for i := 0; i < 50; i++ {
+			if d := p.backoff(attempt); d < 0 || d > limit {
+				t.Fatalf("backoff(%d) = %s, want at most %s", attempt, d, limit)
+			}
+		}
+	}
+	if d := (retryPolicy{maxAttempts: 3}).backoff(2); d != 0 {
+		t.Errorf("backoff without a base delay = %s, want 0", d)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"connection refused", context.Background(), fmt.Errorf("failed to make request: %w", refused), true},
+		{"server error", context.Background(), &Error{upstreamStatus: http.StatusInternalServerError}, true},
+		{"client error", context.Background(), &Error{upstreamStatus: http.StatusBadRequest}, false},
+		{"cancelled", cancelled, refused, false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("%s: retryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeOllama answers /api/chat for every model but failing, which gets a 500.
+func fakeOllama(t *testing.T, failing string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var req models.OllamaChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model == failing {
+			http.Error(w, `{"error":"model runner crashed"}`, http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"model":%q,"message":{"role":"assistant","content":"hi"},"done":true}`, req.Model)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// A failing backend is retried on the other one, and once its breaker opened
+// it gets no more requests.
+func TestDispatchFailsOverToAnotherBackend(t *testing.T) {
+	down, downRequests := fakeOllama(t, "llama3.2")
+	up, upRequests := fakeOllama(t, "")
+	s, err := NewOllamaService(&config.Config{
+		OllamaURLs:          []string{down.URL, up.URL},
+		RetryMaxAttempts:    2,
+		BreakerThreshold:    1,
+		BreakerOpenDuration: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		req := &models.ChatCompletionRequest{Model: "llama3.2", Messages: []models.ChatMessage{{Role: "user", Content: "hi"}}}
+		if _, err := s.ChatCompletion(context.Background(), req); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if downRequests.Load() > 1 || upRequests.Load() != 3 {
+		t.Errorf("requests = %d to the failing backend and %d to the healthy one, want at most 1 and 3", downRequests.Load(), upRequests.Load())
+	}
+}
+
+func TestDispatchFallsBackToAnotherModel(t *testing.T) {
+	srv, requests := fakeOllama(t, "llama3.2:70b")
+	s, err := NewOllamaService(&config.Config{
+		OllamaURLs:       []string{srv.URL},
+		RetryMaxAttempts: 2,
+		FallbackModels:   []string{"llama3.2"},
+		BreakerThreshold: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &models.ChatCompletionRequest{Model: "llama3.2:70b", Messages: []models.ChatMessage{{Role: "user", Content: "hi"}}}
+	resp, err := s.ChatCompletion(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Model != "llama3.2" || requests.Load() != 3 {
+		t.Errorf("answered by %s after %d requests, want llama3.2 after 3", resp.Model, requests.Load())
+	}
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"openai-compatible/logging"
+)
+
+// streamRelay turns the body of a streaming upstream response into
+// StreamEvents. It owns what every provider's stream needs: the event
+// channel, the idle timeout and the error that ends an incomplete stream.
+type streamRelay struct {
+	backend     string // names the upstream in errors, e.g. "Ollama"
+	body        io.ReadCloser
+	idleTimeout time.Duration
+
+	// reqCtx is the context of the upstream request. cancelReq cancels it,
+	// with errStreamIdle once the upstream goes quiet.
+	reqCtx    context.Context
+	cancelReq context.CancelCauseFunc
+
+	// onFail records a failed stream, e.g. in metrics and the circuit
+	// breaker. reason is "decode", "stream", "idle_timeout" or "eof".
+	onFail func(reason string)
+	// onEnd runs last, with the error that ended the stream or nil.
+	onEnd func(err error)
+}
+
+// streamFailure ends a stream with err, recorded under reason.
+type streamFailure struct {
+	reason string
+	err    *Error
+}
+
+// streamLine handles one line of the upstream body. It returns the SSE
+// payloads to send, e.g. a JSON chunk or "[DONE]", and whether the response
+// is complete.
+type streamLine func(line string) (payloads []string, finished bool, failure *streamFailure)
+
+// start relays the body on a new goroutine. The returned channel is closed
+// after the final [DONE] chunk or error event, or once ctx is cancelled.
+func (r *streamRelay) start(ctx context.Context, handle streamLine) <-chan StreamEvent {
+	logger := logging.FromContext(ctx)
+	events := make(chan StreamEvent, 100)
+
+	// send hands an event to the consumer, giving up once ctx is cancelled so
+	// this goroutine can't block forever on a reader that went away.
+	send := func(event StreamEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		var streamErr error
+		defer func() { r.onEnd(streamErr) }()
+		defer r.cancelReq(nil)
+		defer r.body.Close()
+		defer close(events)
+
+		// fail ends the stream with an error event for the client.
+		fail := func(reason string, err *Error) {
+			streamErr = err
+			r.onFail(reason)
+			logger.Warn("upstream stream failed", "provider", r.backend, "reason", reason, "error", err)
+			send(StreamEvent{Err: err})
+		}
+
+		var idle *time.Timer
+		if r.idleTimeout > 0 {
+			idle = time.AfterFunc(r.idleTimeout, func() { r.cancelReq(fmt.Errorf("%s: %w", r.backend, errStreamIdle)) })
+			defer idle.Stop()
+		}
+
+		scanner := bufio.NewScanner(r.body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		finished := false
+
+	lines:
+		for !finished && scanner.Scan() {
+			if idle != nil {
+				idle.Reset(r.idleTimeout)
+			}
+
+			payloads, done, failure := handle(scanner.Text())
+			if failure != nil {
+				fail(failure.reason, failure.err)
+				return
+			}
+			for _, payload := range payloads {
+				if !send(StreamEvent{Data: "data: " + payload + "\n\n"}) {
+					break lines
+				}
+			}
+			finished = done
+		}
+
+		switch {
+		case finished:
+			// Read to the end, which lets the connection be reused and a
+			// recording see the stream complete. The idle timeout still
+			// bounds a server that doesn't close the body.
+			io.Copy(io.Discard, r.body)
+		case ctx.Err() != nil:
+			streamErr = ctx.Err()
+			logger.Info("stream cancelled before the upstream finished", "provider", r.backend, "reason", context.Cause(ctx))
+		case errors.Is(context.Cause(r.reqCtx), errStreamIdle):
+			fail("idle_timeout", streamIdleError(r.backend, r.idleTimeout))
+		case scanner.Err() != nil:
+			fail("stream", streamReadError(r.backend, scanner.Err()))
+		default:
+			fail("eof", streamError(r.backend, "the stream ended before the response was complete", nil))
+		}
+	}()
+
+	return events
+}
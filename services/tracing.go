@@ -0,0 +1,65 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+
+	"openai-compatible/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const genAISystem = "ollama"
+
+// startSpan starts a client span for a call to a backend. Generation calls are
+// named "<operation> <model>" as the GenAI semantic conventions suggest.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// newRequest builds a request to Ollama that is aborted when ctx is cancelled
+// and carries its W3C trace context.
+func (s *OllamaService) newRequest(ctx context.Context, up *Upstream, method, path string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, up.URL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	tracing.Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
+
+	return httpReq, nil
+}
+
+// usageOrEstimate prefers the token counts reported by Ollama and falls back
+// to the rough estimate used for the OpenAI usage block.
+func usageOrEstimate(reported int, text string) int {
+	if reported > 0 {
+		return reported
+	}
+	return estimateTokens(text)
+}
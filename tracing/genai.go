@@ -0,0 +1,56 @@
+package tracing
+
+import "go.opentelemetry.io/otel/attribute"
+
+// Attribute keys from the OpenTelemetry GenAI semantic conventions.
+const (
+	GenAISystem               = attribute.Key("gen_ai.system")
+	GenAIOperationName        = attribute.Key("gen_ai.operation.name")
+	GenAIRequestModel         = attribute.Key("gen_ai.request.model")
+	GenAIRequestTemperature   = attribute.Key("gen_ai.request.temperature")
+	GenAIRequestTopP          = attribute.Key("gen_ai.request.top_p")
+	GenAIRequestMaxTokens     = attribute.Key("gen_ai.request.max_tokens")
+	GenAIResponseID           = attribute.Key("gen_ai.response.id")
+	GenAIResponseModel        = attribute.Key("gen_ai.response.model")
+	GenAIResponseFinishReason = attribute.Key("gen_ai.response.finish_reasons")
+	GenAIUsageInputTokens     = attribute.Key("gen_ai.usage.input_tokens")
+	GenAIUsageOutputTokens    = attribute.Key("gen_ai.usage.output_tokens")
+)
+
+// Values for gen_ai.operation.name.
+const (
+	OperationChat           = "chat"
+	OperationTextCompletion = "text_completion"
+	OperationEmbeddings     = "embeddings"
+)
+
+// RequestAttributes describes the sampling parameters of a request. Nil
+// parameters are left out.
+func RequestAttributes(system, operation, model string, temperature, topP *float64, maxTokens *int) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		GenAISystem.String(system),
+		GenAIOperationName.String(operation),
+		GenAIRequestModel.String(model),
+	}
+	if temperature != nil {
+		attrs = append(attrs, GenAIRequestTemperature.Float64(*temperature))
+	}
+	if topP != nil {
+		attrs = append(attrs, GenAIRequestTopP.Float64(*topP))
+	}
+	if maxTokens != nil {
+		attrs = append(attrs, GenAIRequestMaxTokens.Int(*maxTokens))
+	}
+	return attrs
+}
+
+// ResponseAttributes describes the outcome of a generation.
+func ResponseAttributes(id, model, finishReason string, inputTokens, outputTokens int) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		GenAIResponseID.String(id),
+		GenAIResponseModel.String(model),
+		GenAIResponseFinishReason.StringSlice([]string{finishReason}),
+		GenAIUsageInputTokens.Int(inputTokens),
+		GenAIUsageOutputTokens.Int(outputTokens),
+	}
+}